@@ -0,0 +1,96 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bariiss/SpoofDPI/util"
+	"github.com/bariiss/SpoofDPI/util/log"
+)
+
+const scopeAdmin = "ADMIN"
+
+// ReloadFunc reloads the configuration and reports why it failed, if it did.
+type ReloadFunc func(ctx context.Context) error
+
+// StatsFunc returns a JSON-serializable snapshot of the runtime counters.
+type StatsFunc func() any
+
+type Server struct {
+	reload ReloadFunc
+	stats  StatsFunc
+	mux    *http.ServeMux
+}
+
+// New creates a new admin API server.
+func New(reload ReloadFunc, stats StatsFunc) *Server {
+	s := &Server{
+		reload: reload,
+		stats:  stats,
+		mux:    http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/reload", s.handleReload)
+	s.mux.HandleFunc("/stats", s.handleStats)
+	return s
+}
+
+// Handle serves another endpoint next to the admin API.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Serve serves the admin API on l until ctx is done.
+func (s *Server) Serve(ctx context.Context, l net.Listener) {
+	ctx = util.GetCtxWithScope(ctx, scopeAdmin)
+	logger := log.GetCtxLogger(ctx)
+
+	srv := &http.Server{
+		Handler:           s.mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	logger.Info().Msgf("admin api is listening on %s", l.Addr())
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error().Msgf("error serving admin api: %s", err)
+	}
+}
+
+// handleReload reloads the configuration on POST /reload.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.reload(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, _ = w.Write([]byte("reloaded\n"))
+}
+
+// handleStats writes the runtime counters as JSON on GET /stats.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.stats())
+}
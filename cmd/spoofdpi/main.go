@@ -2,11 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"github.com/bariiss/SpoofDPI/admin"
+	"github.com/bariiss/SpoofDPI/dns"
+	"github.com/bariiss/SpoofDPI/handoff"
 	"github.com/bariiss/SpoofDPI/proxy"
+	"github.com/bariiss/SpoofDPI/systemd"
 	"github.com/bariiss/SpoofDPI/util"
 	"github.com/bariiss/SpoofDPI/util/log"
 	"github.com/bariiss/SpoofDPI/version"
@@ -22,43 +33,259 @@ func main() {
 	}
 
 	config := util.GetConfig()
-	config.Load(args)
+	if err := config.Load(args); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	log.InitLogger(config)
 
+	os.Exit(run(config))
+}
+
+// run starts the proxy and blocks until it has shut down. It returns the
+// process exit code so that deferred cleanup, such as unsetting the system
+// proxy, runs on every path.
+func run(config *util.Config) int {
 	ctx := util.GetCtxWithScope(context.Background(), "MAIN")
 	logger := log.GetCtxLogger(ctx)
 
+	pxy, err := proxy.New(config)
+	if err != nil {
+		logger.Error().Msgf("error creating proxy: %s", err)
+		return 1
+	}
+
+	inherited, err := systemd.Listeners()
+	if err != nil {
+		logger.Error().Msgf("error receiving sockets from systemd: %s", err)
+		return 1
+	}
+	if len(inherited) > 0 {
+		logger.Info().Msgf("received %d sockets from systemd", len(inherited))
+		pxy.Inherit(inherited)
+	}
+
+	handedOver, err := handoff.Receive()
+	if err != nil {
+		logger.Error().Msgf("error receiving handed over listeners: %s", err)
+		return 1
+	}
+	pxy.Inherit(handedOver.Listeners[handoff.NameProxy])
+
+	if err := pxy.Listen(); err != nil {
+		logger.Error().Msgf("%s", err)
+		return 1
+	}
+
+	socks, err := openSockets(config, handedOver)
+	if err != nil {
+		logger.Error().Msgf("%s", err)
+		return 1
+	}
+
+	if config.User != "" || config.Group != "" {
+		if err := dropPrivileges(ctx, pxy, socks, config); err != nil {
+			logger.Error().Msgf("error dropping privileges: %s", err)
+			return 1
+		}
+	}
+
 	if !config.Silent {
 		util.PrintColoredBanner()
 	}
 
-	if config.SystemProxy {
-		if err := util.SetOsProxy(uint16(config.Port)); err != nil {
-			logger.Fatal().Msgf("error setting system proxy: %s", err)
+	// Set once a new process took over, which then owns the system proxy
+	// and the systemd service
+	var handedOff atomic.Bool
+
+	if port, ok := systemProxyPort(config); config.SystemProxy && ok {
+		if err := util.SetOsProxy(port); errors.Is(err, util.ErrProxyStateNotSaved) {
+			logger.Warn().Msgf("system proxy is set, but %s", err)
+		} else if err != nil {
+			logger.Error().Msgf("error setting system proxy: %s", err)
+			return 1
 		}
 		defer func() {
+			if handedOff.Load() {
+				return
+			}
 			if err := util.UnsetOsProxy(); err != nil {
-				logger.Fatal().Msgf("error unsetting system proxy: %s", err)
+				logger.Error().Msgf("error unsetting system proxy: %s", err)
 			}
 		}()
 	}
 
-	pxy := proxy.New(config)
-	go pxy.Start(context.Background())
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	reload := newReloader(pxy)
+
+	go notifyReady(ctx, pxy, &handedOff)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go handleReloadSignal(ctx, hup, reload)
+
+	if len(restartSignals) > 0 {
+		usr2 := make(chan os.Signal, 1)
+		signal.Notify(usr2, restartSignals...)
+		defer signal.Stop(usr2)
+		go handleRestartSignal(ctx, usr2, func() bool {
+			if !restart(ctx, pxy, socks) {
+				return false
+			}
+			handedOff.Store(true)
+			cancel()
+			return true
+		})
+	}
+
+	dnsServer := dns.NewServer(pxy.ExchangeDNS)
+
+	if socks.admin != nil {
+		stats := func() any { return pxy.Stats() }
+		adminServer := admin.New(reload, stats)
+		if config.DohListen == util.DohOnAdmin {
+			adminServer.Handle(dns.DoHPath, dnsServer)
+		}
+		go adminServer.Serve(ctx, socks.admin)
+	}
+
+	if socks.dnsUDP != nil {
+		if dns.IsSystemServer(config.DnsListen) {
+			logger.Warn().Msgf("the system resolver points to the dns server on %s; resolving every name through %s",
+				config.DnsListen, config.DnsAddr)
+		}
+		go dnsServer.Serve(ctx, socks.dnsUDP, socks.dnsTCP)
+	}
+
+	if socks.doh != nil {
+		go dnsServer.ServeDoH(ctx, socks.doh)
+	}
+
+	if err := pxy.Start(ctx); err != nil {
+		logger.Error().Msgf("%s", err)
+		return 1
+	}
+
+	logger.Info().Msg("shut down gracefully")
+	return 0
+}
+
+// notifyReady tells the process that handed its listeners over, if any, and
+// systemd when the proxy is ready, and systemd when it stops. It pings the
+// systemd watchdog while the proxy runs.
+func notifyReady(ctx context.Context, pxy *proxy.Proxy, handedOff *atomic.Bool) {
+	logger := log.GetCtxLogger(ctx)
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-pxy.Ready():
+	}
+
+	if err := handoff.Ready(); err != nil {
+		logger.Warn().Msgf("error notifying the previous process: %s", err)
+	}
+
+	ok, err := systemd.Notify(systemd.StateReady, systemd.Status("accepting connections"))
+	if err != nil {
+		logger.Warn().Msgf("error notifying systemd: %s", err)
+		return
+	}
+	if !ok {
+		return
+	}
 
-	waitForShutdown()
+	var tick <-chan time.Time
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if !handedOff.Load() {
+				_, _ = systemd.Notify(systemd.StateStopping, systemd.Status("draining connections"))
+			}
+			return
+		case <-tick:
+			status := systemd.Status(fmt.Sprintf("%d active connections", pxy.Stats().Active))
+			if _, err := systemd.Notify(systemd.StateWatchdog, status); err != nil {
+				logger.Warn().Msgf("error notifying systemd watchdog: %s", err)
+			}
+		}
+	}
 }
 
-// waitForShutdown listens for OS signals and blocks until one is received.
-func waitForShutdown() {
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs,
-		syscall.SIGINT,
-		syscall.SIGTERM,
-		syscall.SIGQUIT,
-		syscall.SIGHUP,
-	)
-
-	<-sigs
+// systemProxyPort returns the port of the first http listener on tcp, which
+// is the one the system proxy points to.
+func systemProxyPort(config *util.Config) (uint16, bool) {
+	for _, l := range config.Listeners {
+		if l.Proto != util.ProtoHTTP || l.Network != util.NetworkTCP {
+			continue
+		}
+		_, port, err := net.SplitHostPort(l.Addr)
+		if err != nil {
+			continue
+		}
+		if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+			return uint16(p), true
+		}
+	}
+	return 0, false
+}
+
+// newReloader returns a function that re-reads the configuration and applies
+// it to the proxy. Concurrent reloads are serialized, and a failed reload
+// leaves the running configuration untouched. systemd is told when a reload
+// starts and ends.
+func newReloader(pxy *proxy.Proxy) admin.ReloadFunc {
+	var mu sync.Mutex
+
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		ctx = util.GetCtxWithScope(ctx, "MAIN")
+		logger := log.GetCtxLogger(ctx)
+
+		if _, err := systemd.Notify(systemd.Reloading()...); err != nil {
+			logger.Warn().Msgf("error notifying systemd: %s", err)
+		}
+		defer func() {
+			_, _ = systemd.Notify(systemd.StateReady, systemd.Status("accepting connections"))
+		}()
+
+		config, err := util.ReloadConfig()
+		if err != nil {
+			logger.Error().Msgf("error reloading config, keeping the old one: %s", err)
+			return err
+		}
+
+		if err := pxy.Reload(ctx, config); err != nil {
+			logger.Error().Msgf("error reloading config, keeping the old one: %s", err)
+			return err
+		}
+		return nil
+	}
+}
+
+// handleReloadSignal reloads the configuration on every signal received on
+// sigs until ctx is done.
+func handleReloadSignal(ctx context.Context, sigs <-chan os.Signal, reload admin.ReloadFunc) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+			_ = reload(ctx)
+		}
+	}
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bariiss/SpoofDPI/handoff"
+	"github.com/bariiss/SpoofDPI/privilege"
+	"github.com/bariiss/SpoofDPI/proxy"
+	"github.com/bariiss/SpoofDPI/systemd"
+	"github.com/bariiss/SpoofDPI/util"
+	"github.com/bariiss/SpoofDPI/util/log"
+)
+
+// restartTimeout is how long a new process may take to start accepting
+// connections before the restart is given up.
+const restartTimeout = 30 * time.Second
+
+// dropPrivileges re-executes the process as the configured user and group,
+// handing the open listeners over to the new image. It returns right away
+// when the process already runs as them, as it does after the re-exec.
+func dropPrivileges(ctx context.Context, pxy *proxy.Proxy, socks *sockets, config *util.Config) error {
+	logger := log.GetCtxLogger(ctx)
+
+	cred, err := privilege.Lookup(config.User, config.Group)
+	if err != nil {
+		return err
+	}
+	if cred.Current() {
+		logger.Info().Msgf("running as uid %d, gid %d", cred.Uid, cred.Gid)
+		return nil
+	}
+
+	// The new image reads these files again as the new user, so tell now
+	// which one it could not read
+	for _, path := range config.Files {
+		if err := privilege.CheckReadable(cred, path); err != nil {
+			return fmt.Errorf("uid %d, gid %d cannot read %s, which is read again after the switch: %w",
+				cred.Uid, cred.Gid, path, err)
+		}
+	}
+
+	names, files, err := handoffFiles(pxy, socks)
+	if err != nil {
+		return err
+	}
+	fds := make([]uintptr, len(files))
+	for i, f := range files {
+		fds[i] = f.Fd()
+	}
+
+	logger.Info().Msgf("dropping privileges to uid %d, gid %d", cred.Uid, cred.Gid)
+	return privilege.Drop(cred, files, append(cred.Environ(os.Environ()), handoff.Env(names, fds)))
+}
+
+// restart starts a new process of the binary, which may have been upgraded,
+// and hands the listeners over to it. It reports whether the new process
+// took over; if not, this process keeps serving.
+func restart(ctx context.Context, pxy *proxy.Proxy, socks *sockets) bool {
+	logger := log.GetCtxLogger(ctx)
+
+	names, files, err := handoffFiles(pxy, socks)
+	if err != nil {
+		logger.Error().Msgf("error restarting: %s", err)
+		return false
+	}
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	logger.Info().Msgf("restarting %s", os.Args[0])
+	proc, err := handoff.Restart(names, files, restartTimeout)
+	if err != nil {
+		logger.Error().Msgf("error restarting, keeping the old process: %s", err)
+		return false
+	}
+
+	pxy.HandedOver()
+	logger.Info().Msgf("new process %d took over the listeners, draining connections", proc.Pid)
+	if _, err := systemd.Notify(systemd.MainPid(proc.Pid), systemd.Status("handed over to the new process")); err != nil {
+		logger.Warn().Msgf("error notifying systemd: %s", err)
+	}
+	return true
+}
+
+// handoffFiles returns the names and files of the proxy listeners and the
+// other sockets to hand over to a new process.
+func handoffFiles(pxy *proxy.Proxy, socks *sockets) ([]string, []*os.File, error) {
+	files, err := pxy.Files()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := make([]string, len(files))
+	for i := range files {
+		names[i] = handoff.NameProxy
+	}
+
+	otherNames, otherFiles, err := socks.files()
+	if err != nil {
+		for _, f := range files {
+			_ = f.Close()
+		}
+		return nil, nil, err
+	}
+
+	return append(names, otherNames...), append(files, otherFiles...), nil
+}
+
+// handleRestartSignal restarts on every signal received on sigs until ctx is
+// done or a new process took over.
+func handleRestartSignal(ctx context.Context, sigs <-chan os.Signal, restart func() bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+			if restart() {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignals trigger a zero-downtime restart.
+var restartSignals = []os.Signal{syscall.SIGUSR2}
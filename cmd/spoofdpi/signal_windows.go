@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// restartSignals is empty, as restarts are not supported on windows.
+var restartSignals []os.Signal
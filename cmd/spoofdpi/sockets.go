@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/bariiss/SpoofDPI/handoff"
+	"github.com/bariiss/SpoofDPI/util"
+)
+
+// sockets are the sockets besides the proxy listeners. Like those, they are
+// opened before dropping privileges and handed over on restart.
+type sockets struct {
+	admin  net.Listener
+	dnsUDP net.PacketConn
+	dnsTCP net.Listener
+	doh    net.Listener
+}
+
+// openSockets opens the admin api, dns server and doh sockets, using the ones
+// handed over by the previous process where possible.
+func openSockets(config *util.Config, handedOver *handoff.Sockets) (*sockets, error) {
+	socks := new(sockets)
+
+	if config.AdminAddr != "" {
+		l, err := listenTCP(config.AdminAddr, handedOver.Listeners[handoff.NameAdmin])
+		if err != nil {
+			return nil, fmt.Errorf("error creating admin api listener: %w", err)
+		}
+		socks.admin = l
+	}
+
+	if config.DnsListen != "" {
+		l, err := listenTCP(config.DnsListen, handedOver.Listeners[handoff.NameDNS])
+		if err != nil {
+			socks.close()
+			return nil, fmt.Errorf("error creating dns server listener: %w", err)
+		}
+		socks.dnsTCP = l
+
+		if pcs := handedOver.PacketConns[handoff.NameDNS]; len(pcs) > 0 {
+			socks.dnsUDP = pcs[0]
+		} else if socks.dnsUDP, err = net.ListenPacket("udp", config.DnsListen); err != nil {
+			socks.close()
+			return nil, fmt.Errorf("error creating dns server socket: %w", err)
+		}
+	}
+
+	if config.DohListen != "" && config.DohListen != util.DohOnAdmin {
+		l, err := listenTCP(config.DohListen, handedOver.Listeners[handoff.NameDoH])
+		if err != nil {
+			socks.close()
+			return nil, fmt.Errorf("error creating doh listener: %w", err)
+		}
+		socks.doh = l
+	}
+
+	return socks, nil
+}
+
+// listenTCP returns the first of the handed over listeners, or a new one on
+// addr if there are none.
+func listenTCP(addr string, handedOver []net.Listener) (net.Listener, error) {
+	if len(handedOver) > 0 {
+		return handedOver[0], nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// files returns the names and duplicated files of the sockets to hand over
+// to a new process.
+func (s *sockets) files() ([]string, []*os.File, error) {
+	var (
+		names []string
+		files []*os.File
+	)
+
+	for _, sock := range []struct {
+		name string
+		sock any
+	}{
+		{handoff.NameAdmin, s.admin},
+		{handoff.NameDNS, s.dnsTCP},
+		{handoff.NameDNS, s.dnsUDP},
+		{handoff.NameDoH, s.doh},
+	} {
+		f, err := socketFile(sock.sock)
+		if err != nil {
+			for _, f := range files {
+				_ = f.Close()
+			}
+			return nil, nil, fmt.Errorf("%s socket: %w", sock.name, err)
+		}
+		if f == nil {
+			continue
+		}
+		names = append(names, sock.name)
+		files = append(files, f)
+	}
+
+	return names, files, nil
+}
+
+// close closes all sockets.
+func (s *sockets) close() {
+	if s.admin != nil {
+		_ = s.admin.Close()
+	}
+	if s.dnsTCP != nil {
+		_ = s.dnsTCP.Close()
+	}
+	if s.dnsUDP != nil {
+		_ = s.dnsUDP.Close()
+	}
+	if s.doh != nil {
+		_ = s.doh.Close()
+	}
+}
+
+// socketFile returns a duplicate of the file of a tcp listener or udp socket,
+// or nil if sock is nil.
+func socketFile(sock any) (*os.File, error) {
+	switch sock := sock.(type) {
+	case *net.TCPListener:
+		return sock.File()
+	case *net.UDPConn:
+		return sock.File()
+	case nil:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported socket type %T", sock)
+	}
+}
@@ -4,7 +4,12 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/netip"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bariiss/SpoofDPI/dns/resolver"
@@ -17,40 +22,244 @@ const scopeDNS = "DNS"
 
 type Resolver interface {
 	Resolve(ctx context.Context, host string, qTypes []uint16) ([]net.IPAddr, error)
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
 	String() string
 }
 
+// Dns resolves names with the resolver each one is routed to. The hosts
+// file and the dns rules are swapped atomically on Reload, while the
+// resolvers, their cache and connections are kept as long as their
+// configuration does not change.
 type Dns struct {
-	host          string
-	port          string
-	systemClient  Resolver
-	generalClient Resolver
-	dohClient     Resolver
-	qTypes        []uint16
-}
-
-// NewDns creates a new Dns instance with the given configuration.
-func NewDns(config *util.Config) *Dns {
-	addr := config.DnsAddr
-	port := strconv.Itoa(config.DnsPort)
+	poisoned *resolver.PoisonCounter
+
+	// mu serializes reloads
+	mu       sync.Mutex
+	settings atomic.Pointer[settings]
+}
+
+// settings is the part of the dns configuration that a lookup uses. It is
+// replaced as a whole, so that a lookup never sees parts of two configs.
+type settings struct {
+	qTypes []uint16
+	hosts  util.Hosts
+
+	rules           []util.DnsRule
+	defaultResolver string
+
+	// systemLoops is set when the system resolver points to the local dns
+	// server, which would send the queries right back
+	systemLoops bool
+
+	*resolvers
+}
+
+// resolvers are the resolvers built from the configuration, which share a
+// cache. They are reused across reloads unless their configuration changed.
+type resolvers struct {
+	config      resolverConfig
+	cacheConfig cacheConfig
+	cache       *resolver.Cache
+
+	systemClient Resolver
+	// upstreamClient is the resolver set up by -dns-addr, -enable-doh,
+	// -enable-dot or -dns-upstream
+	upstreamClient Resolver
+	// groups are the resolvers of the -dns-group options by name
+	groups map[string]Resolver
+
+	// upstreams are the names of the resolvers that keep answers in the
+	// cache
+	upstreams []string
+}
+
+// resolverConfig holds the options the resolvers are built from.
+type resolverConfig struct {
+	addr          string
+	port          int
+	upstreams     []util.UpstreamConfig
+	groups        map[string][]util.UpstreamConfig
+	strategy      string
+	enableDoh     bool
+	dohURL        string
+	dohPost       bool
+	dohBootstrap  []netip.Addr
+	enableDot     bool
+	dotServerName string
+	dotPins       [][]byte
+	bogusIPs      []netip.Prefix
+	poisonWait    int
+}
+
+// cacheConfig holds the options of the cache.
+type cacheConfig struct {
+	size     int
+	minTTL   int
+	maxTTL   int
+	staleTTL int
+	prefetch bool
+}
+
+// NewDns creates a new Dns instance with the given configuration. Poisoned
+// answers of plain dns servers are counted in poisoned.
+func NewDns(config *util.Config, poisoned *resolver.PoisonCounter) *Dns {
+	d := &Dns{poisoned: poisoned}
+	d.settings.Store(d.newSettings(config, nil))
+	return d
+}
+
+// Reload replaces the hosts file, the dns rules and the resolvers with the
+// ones of config. Resolvers are only rebuilt if their options changed, and
+// cached answers are only dropped for upstreams that are gone and for names
+// overridden in the old or the new hosts file.
+func (d *Dns) Reload(ctx context.Context, config *util.Config) {
+	ctx = util.GetCtxWithScope(ctx, scopeDNS)
+	logger := log.GetCtxLogger(ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	prev := d.settings.Load()
+	s := d.newSettings(config, prev)
+	d.settings.Store(s)
+
+	if s.resolvers != prev.resolvers {
+		logger.Info().Msg("dns resolver options changed, rebuilt the resolvers")
+		if s.cache == prev.cache {
+			s.cache.Retain(s.upstreams)
+		}
+	}
+
+	if s.cache == prev.cache && !reflect.DeepEqual(s.hosts, prev.hosts) {
+		s.cache.Flush(func(name string) bool {
+			_, old := prev.hosts.Lookup(name)
+			_, overridden := s.hosts.Lookup(name)
+			return old || overridden
+		})
+	}
+}
+
+// newSettings creates the settings of config, reusing the resolvers and the
+// cache of prev, which may be nil, where their options did not change.
+func (d *Dns) newSettings(config *util.Config, prev *settings) *settings {
 	var qTypes []uint16
 	if config.DnsIPv4Only {
 		qTypes = []uint16{dns.TypeA}
 	} else {
 		qTypes = []uint16{dns.TypeAAAA, dns.TypeA}
 	}
-	return &Dns{
-		host:          config.DnsAddr,
-		port:          port,
-		systemClient:  resolver.NewSystemResolver(),
-		generalClient: resolver.NewGeneralResolver(net.JoinHostPort(addr, port)),
-		dohClient:     resolver.NewDOHResolver(addr),
-		qTypes:        qTypes,
+
+	rc := resolverConfig{
+		addr:          config.DnsAddr,
+		port:          config.DnsPort,
+		upstreams:     config.DnsUpstreams,
+		groups:        config.DnsGroups,
+		strategy:      config.DnsStrategy,
+		enableDoh:     config.EnableDoh,
+		dohURL:        config.DohURL,
+		dohPost:       config.DohPost,
+		dohBootstrap:  config.DohBootstrap,
+		enableDot:     config.EnableDot,
+		dotServerName: config.DotServerName,
+		dotPins:       config.DotPins,
+		bogusIPs:      config.DnsBogusIPs,
+		poisonWait:    config.DnsPoisonWait,
+	}
+	cc := cacheConfig{
+		size:     config.DnsCacheSize,
+		minTTL:   config.DnsMinTTL,
+		maxTTL:   config.DnsMaxTTL,
+		staleTTL: config.DnsStaleTTL,
+		prefetch: config.DnsPrefetch,
+	}
+
+	var r *resolvers
+	switch {
+	case prev != nil && prev.cacheConfig == cc && reflect.DeepEqual(prev.config, rc):
+		r = prev.resolvers
+	case prev != nil && prev.cacheConfig == cc:
+		r = d.newResolvers(rc, cc, prev.cache)
+	default:
+		r = d.newResolvers(rc, cc, resolver.NewCache(cc.size,
+			time.Duration(cc.minTTL)*time.Second, time.Duration(cc.maxTTL)*time.Second,
+			time.Duration(cc.staleTTL)*time.Second, cc.prefetch))
+	}
+
+	return &settings{
+		qTypes:          qTypes,
+		hosts:           config.Hosts,
+		rules:           config.DnsRules,
+		defaultResolver: config.DnsDefaultResolver,
+		systemLoops:     config.DnsListen != "" && IsSystemServer(config.DnsListen),
+		resolvers:       r,
+	}
+}
+
+// newResolvers builds the resolvers of config, which keep their answers in
+// cache.
+func (d *Dns) newResolvers(config resolverConfig, cc cacheConfig, cache *resolver.Cache) *resolvers {
+	r := &resolvers{
+		config:       config,
+		cacheConfig:  cc,
+		cache:        cache,
+		systemClient: resolver.NewSystemResolver(),
+		groups:       make(map[string]Resolver),
+	}
+
+	addr := net.JoinHostPort(config.addr, strconv.Itoa(config.port))
+	dohURL := config.dohURL
+	if dohURL == "" {
+		dohURL = config.addr
+	}
+	poison := resolver.NewPoisonGuard(config.bogusIPs,
+		time.Duration(config.poisonWait)*time.Millisecond, d.poisoned)
+
+	switch {
+	case len(config.upstreams) > 0:
+		r.upstreamClient = r.newGroup(config, config.upstreams, poison)
+	case config.enableDoh:
+		r.upstreamClient = cached(r, resolver.NewDOHResolver(dohURL, config.dohPost, config.dohBootstrap, cache))
+	case config.enableDot:
+		r.upstreamClient = cached(r, resolver.NewDOTResolver(addr, config.dotServerName, config.dotPins, cache))
+	default:
+		r.upstreamClient = cached(r, resolver.NewGeneralResolver(addr, poison, cache))
+	}
+
+	for name, upstreams := range config.groups {
+		r.groups[name] = r.newGroup(config, upstreams, poison)
+	}
+	return r
+}
+
+// newGroup creates a resolver group querying upstreams with the configured
+// strategy.
+func (r *resolvers) newGroup(config resolverConfig, upstreams []util.UpstreamConfig, poison *resolver.PoisonGuard) *resolver.Group {
+	members := make([]resolver.Upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		switch u.Proto {
+		case util.UpstreamTLS:
+			members = append(members, cached(r, resolver.NewDOTResolver(u.Addr, u.ServerName, u.Pins, r.cache)))
+		case util.UpstreamHTTPS:
+			members = append(members, cached(r, resolver.NewDOHResolver(u.Addr, config.dohPost, u.Bootstrap, r.cache)))
+		default:
+			members = append(members, cached(r, resolver.NewGeneralResolver(u.Addr, poison, r.cache)))
+		}
 	}
+	return resolver.NewGroup(config.strategy, members)
 }
 
-// ResolveHost resolves the given host using the appropriate resolver based on the configuration.
-func (d *Dns) ResolveHost(ctx context.Context, host string, enableDoh, useSystemDns bool) (string, error) {
+// cached records the name of a resolver of r that keeps its answers in the
+// cache.
+func cached[T resolver.Upstream](r *resolvers, u T) T {
+	r.upstreams = append(r.upstreams, u.String())
+	return u
+}
+
+// ResolveHost resolves the given host using the resolver selected for it,
+// where matched tells whether it matches the patterns. Names pinned to
+// addresses in the hosts file are not looked up, and names rewritten to
+// others are resolved as those.
+func (d *Dns) ResolveHost(ctx context.Context, host string, matched bool) (string, error) {
 	ctx = util.GetCtxWithScope(ctx, scopeDNS)
 	logger := log.GetCtxLogger(ctx)
 
@@ -58,14 +267,32 @@ func (d *Dns) ResolveHost(ctx context.Context, host string, enableDoh, useSystem
 		return ip.String(), nil
 	}
 
-	clt := d.clientFactory(enableDoh, useSystemDns)
+	s := d.settings.Load()
+	chain, pinned, err := s.rewrite(host)
+	if err != nil {
+		return "", err
+	}
+	if pinned != nil {
+		addr, ok := s.pinnedAddr(pinned)
+		if !ok {
+			return "", fmt.Errorf("no address of the looked up types is pinned to %s", host)
+		}
+		logger.Debug().Msgf("resolved %s from %s using the hosts file", addr, host)
+		return addr.String(), nil
+	}
+	clt := s.clientFactory(host, matched)
+	if len(chain) > 1 {
+		logger.Debug().Msgf("rewrote %s to %s using the hosts file", host, chain[len(chain)-1])
+		host = chain[len(chain)-1]
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	logger.Debug().Msgf("resolving %s using %s", host, clt)
 
 	start := time.Now()
-	addrs, err := clt.Resolve(ctx, host, d.qTypes)
+	addrs, err := clt.Resolve(ctx, host, s.qTypes)
 	if err != nil {
 		return "", fmt.Errorf("%s: %w", clt, err)
 	}
@@ -80,15 +307,65 @@ func (d *Dns) ResolveHost(ctx context.Context, host string, enableDoh, useSystem
 	return addrs[0].String(), nil
 }
 
-// clientFactory returns the appropriate resolver based on the configuration.
-func (d *Dns) clientFactory(enableDoh, useSystemDns bool) Resolver {
-	if useSystemDns {
-		return d.systemClient
+// Exchange sends a DNS query of any type through the resolver selected like
+// in ResolveHost and returns the response. Names overridden in the hosts
+// file are answered like in ResolveHost as well.
+func (d *Dns) Exchange(ctx context.Context, msg *dns.Msg, matched bool) (*dns.Msg, error) {
+	ctx = util.GetCtxWithScope(ctx, scopeDNS)
+	logger := log.GetCtxLogger(ctx)
+
+	s := d.settings.Load()
+	q := msg.Question[0]
+	clt := s.clientFactory(strings.TrimSuffix(q.Name, "."), matched)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	chain, pinned, err := s.rewrite(q.Name)
+	if err != nil {
+		return nil, err
 	}
-	if enableDoh {
-		return d.dohClient
+	if pinned != nil || len(chain) > 1 {
+		logger.Debug().Msgf("answering %s (%s) using the hosts file", q.Name, dns.TypeToString[q.Qtype])
+		return exchangeRewritten(ctx, clt, msg, chain, pinned)
+	}
+
+	logger.Debug().Msgf("querying %s (%s) using %s", q.Name, dns.TypeToString[q.Qtype], clt)
+
+	resp, err := clt.Exchange(ctx, msg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", clt, err)
+	}
+	return resp, nil
+}
+
+// clientFactory returns the resolver of the first dns rule host matches,
+// or else the default resolver. Without a default resolver, hosts matching
+// the patterns use the upstream resolver and the others the system one.
+func (s *settings) clientFactory(host string, matched bool) Resolver {
+	name := s.defaultResolver
+	for _, rule := range s.rules {
+		if rule.Pattern.MatchString(host) {
+			name = rule.Resolver
+			break
+		}
+	}
+	if name == "" {
+		name = util.ResolverSystem
+		if matched {
+			name = util.ResolverUpstream
+		}
+	}
+
+	switch name {
+	case util.ResolverSystem:
+		if s.systemLoops {
+			return s.upstreamClient
+		}
+		return s.systemClient
+	case util.ResolverUpstream:
+		return s.upstreamClient
 	}
-	return d.generalClient
+	return s.groups[name]
 }
 
 // parseIpAddr parses the given address string into a net.IPAddr.
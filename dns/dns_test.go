@@ -0,0 +1,231 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bariiss/SpoofDPI/dns/resolver"
+	"github.com/bariiss/SpoofDPI/util"
+	"github.com/miekg/dns"
+)
+
+func newTestConfig() *util.Config {
+	return &util.Config{
+		DnsAddr:      "192.0.2.53",
+		DnsPort:      53,
+		DnsCacheSize: 100,
+		Hosts: util.Hosts{
+			"pinned.example": {Addrs: []netip.Addr{netip.MustParseAddr("192.0.2.1")}},
+		},
+	}
+}
+
+func TestDnsReload(t *testing.T) {
+	config := newTestConfig()
+	d := NewDns(config, resolver.NewPoisonCounter())
+	first := d.settings.Load()
+
+	t.Run("unchanged resolvers", func(t *testing.T) {
+		next := newTestConfig()
+		next.Hosts = util.Hosts{"other.example": {CNAME: "pinned.example"}}
+		next.DnsRules = []util.DnsRule{{Resolver: util.ResolverSystem}}
+		d.Reload(context.Background(), next)
+
+		s := d.settings.Load()
+		if s.resolvers != first.resolvers {
+			t.Error("resolvers were rebuilt although their options did not change")
+		}
+		if _, ok := s.hosts.Lookup("other.example"); !ok {
+			t.Error("hosts file was not replaced")
+		}
+		if len(s.rules) != 1 {
+			t.Error("dns rules were not replaced")
+		}
+	})
+
+	t.Run("changed upstream", func(t *testing.T) {
+		next := newTestConfig()
+		next.DnsAddr = "192.0.2.54"
+		d.Reload(context.Background(), next)
+
+		s := d.settings.Load()
+		if s.resolvers == first.resolvers {
+			t.Fatal("resolvers were kept although the upstream changed")
+		}
+		if s.cache != first.cache {
+			t.Error("cache was replaced although its options did not change")
+		}
+		if want := "general resolver(192.0.2.54:53)"; len(s.upstreams) != 1 || s.upstreams[0] != want {
+			t.Errorf("upstreams = %q, want %q", s.upstreams, want)
+		}
+	})
+
+	t.Run("changed cache", func(t *testing.T) {
+		prev := d.settings.Load()
+		next := newTestConfig()
+		next.DnsAddr = "192.0.2.54"
+		next.DnsCacheSize = 10
+		d.Reload(context.Background(), next)
+
+		if d.settings.Load().cache == prev.cache {
+			t.Error("cache was kept although its size changed")
+		}
+	})
+}
+
+func TestDnsUpstreams(t *testing.T) {
+	config := newTestConfig()
+	config.DnsUpstreams = []util.UpstreamConfig{
+		{Proto: util.UpstreamUDP, Addr: "192.0.2.1:53"},
+		{Proto: util.UpstreamTLS, Addr: "192.0.2.2:853", ServerName: "dns.example"},
+	}
+	config.DnsGroups = map[string][]util.UpstreamConfig{
+		"filter": {{Proto: util.UpstreamUDP, Addr: "192.0.2.3:53"}},
+	}
+
+	s := NewDns(config, nil).settings.Load()
+	if len(s.upstreams) != 3 {
+		t.Errorf("upstreams = %q, want the three group members", s.upstreams)
+	}
+	if s.groups["filter"] == nil {
+		t.Error("group filter is missing")
+	}
+}
+
+// startDNSServer runs a dns server on udp that answers every query with
+// 192.0.2.1, and returns its port and the number of queries it got.
+func startDNSServer(t *testing.T) (int, *atomic.Int32) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := new(dns.Msg)
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			queries.Add(1)
+
+			resp := new(dns.Msg)
+			resp.SetReply(query)
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IPv4(192, 0, 2, 1),
+			}}
+			raw, _ := resp.Pack()
+			_, _ = conn.WriteTo(raw, addr)
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	p, _ := strconv.Atoi(port)
+	return p, &queries
+}
+
+func TestDnsReloadHosts(t *testing.T) {
+	port, queries := startDNSServer(t)
+	config := &util.Config{DnsAddr: "127.0.0.1", DnsPort: port, DnsCacheSize: 100}
+	d := NewDns(config, nil)
+	first := d.settings.Load()
+
+	exchange := func(name string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		if _, err := d.Exchange(ctx, msg, true); err != nil {
+			t.Fatalf("exchange %s: %s", name, err)
+		}
+	}
+
+	exchange("a.example.")
+	exchange("other.test.")
+	if n := queries.Load(); n != 2 {
+		t.Fatalf("server got %d queries, want 2", n)
+	}
+
+	// a.example is pinned for a while, and then resolved again
+	pinned := *config
+	pinned.Hosts = util.Hosts{"*.example": {Addrs: []netip.Addr{netip.MustParseAddr("192.0.2.2")}}}
+	d.Reload(context.Background(), &pinned)
+	exchange("a.example.")
+	d.Reload(context.Background(), config)
+
+	if d.settings.Load().resolvers != first.resolvers {
+		t.Error("resolvers were rebuilt for a hosts file change")
+	}
+
+	exchange("other.test.")
+	if n := queries.Load(); n != 2 {
+		t.Errorf("server got %d queries, want the answer of a name never overridden kept", n)
+	}
+	exchange("a.example.")
+	if n := queries.Load(); n != 3 {
+		t.Errorf("server got %d queries, want the answer cached before the override dropped", n)
+	}
+}
+
+func TestClientFactory(t *testing.T) {
+	system, upstream, filter := &stubResolver{}, &stubResolver{}, &stubResolver{}
+	newSettings := func(defaultResolver string, systemLoops bool) *settings {
+		return &settings{
+			rules: []util.DnsRule{
+				{Pattern: regexp.MustCompile(`\.lan$`), Resolver: util.ResolverSystem},
+				{Pattern: regexp.MustCompile(`ads`), Resolver: "filter"},
+				{Pattern: regexp.MustCompile(`^ads\.lan$`), Resolver: util.ResolverUpstream},
+			},
+			defaultResolver: defaultResolver,
+			systemLoops:     systemLoops,
+			resolvers: &resolvers{
+				systemClient:   system,
+				upstreamClient: upstream,
+				groups:         map[string]Resolver{"filter": filter},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		settings *settings
+		host     string
+		matched  bool
+		want     Resolver
+	}{
+		{name: "rule", settings: newSettings("", false), host: "printer.lan", matched: true, want: system},
+		{name: "group rule", settings: newSettings("", false), host: "ads.example", want: filter},
+		{name: "first rule wins", settings: newSettings("", false), host: "ads.lan", want: system},
+		{name: "matched pattern", settings: newSettings("", false), host: "example.com", matched: true, want: upstream},
+		{name: "unmatched pattern", settings: newSettings("", false), host: "example.com", want: system},
+		{name: "default resolver", settings: newSettings("filter", false), host: "example.com", want: filter},
+		{name: "system loops", settings: newSettings("", true), host: "printer.lan", want: upstream},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.settings.clientFactory(tt.host, tt.matched); got != tt.want {
+				t.Errorf("clientFactory(%q) picked the wrong resolver", tt.host)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package dns
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bariiss/SpoofDPI/util"
+	"github.com/bariiss/SpoofDPI/util/log"
+	"github.com/miekg/dns"
+)
+
+const scopeDoH = "DOH"
+
+// DoHPath is the path of the DoH endpoint.
+const DoHPath = "/dns-query"
+
+// dohContentType is the media type of DNS messages in DoH requests and
+// responses.
+const dohContentType = "application/dns-message"
+
+// ServeHTTP answers RFC 8484 DoH queries, sent either as the base64url
+// encoded dns parameter of a GET request or as the body of a POST request.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := util.GetCtxWithTraceId(util.GetCtxWithScope(r.Context(), scopeDoH))
+	logger := log.GetCtxLogger(ctx)
+
+	var (
+		packed []byte
+		err    error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(packed) == 0 {
+			http.Error(w, "missing or invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != dohContentType {
+			http.Error(w, "content type must be "+dohContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+		packed, err = io.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+		if err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(packed); err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	resp := s.respond(ctx, req, false)
+	out, err := resp.Pack()
+	if err != nil {
+		logger.Debug().Msgf("error packing dns response: %s", err)
+		http.Error(w, "error packing dns response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	if ttl, ok := minTTL(resp); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+	_, _ = w.Write(out)
+}
+
+// ServeDoH serves the DoH endpoint on l until ctx is done.
+func (s *Server) ServeDoH(ctx context.Context, l net.Listener) {
+	ctx = util.GetCtxWithScope(ctx, scopeDoH)
+	logger := log.GetCtxLogger(ctx)
+
+	mux := http.NewServeMux()
+	mux.Handle(DoHPath, s)
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	logger.Info().Msgf("doh endpoint is listening on http://%s%s", l.Addr(), DoHPath)
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error().Msgf("error serving doh: %s", err)
+	}
+}
+
+// minTTL returns the smallest TTL of the records in msg, which is how long
+// the response may be cached by HTTP caches.
+func minTTL(msg *dns.Msg) (uint32, bool) {
+	var (
+		ttl uint32
+		ok  bool
+	)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !ok || rr.Header().Ttl < ttl {
+				ttl, ok = rr.Header().Ttl, true
+			}
+		}
+	}
+	return ttl, ok
+}
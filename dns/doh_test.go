@@ -0,0 +1,71 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestServeHTTP(t *testing.T) {
+	packed, err := newQuery(0).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        []byte
+		want        int
+	}{
+		{name: "get", method: http.MethodGet, target: DoHPath + "?dns=" + base64.RawURLEncoding.EncodeToString(packed), want: http.StatusOK},
+		{name: "get padded", method: http.MethodGet, target: DoHPath + "?dns=" + base64.URLEncoding.EncodeToString(packed), want: http.StatusBadRequest},
+		{name: "get missing parameter", method: http.MethodGet, target: DoHPath, want: http.StatusBadRequest},
+		{name: "get invalid message", method: http.MethodGet, target: DoHPath + "?dns=AAAA", want: http.StatusBadRequest},
+		{name: "post", method: http.MethodPost, target: DoHPath, contentType: dohContentType, body: packed, want: http.StatusOK},
+		{name: "post with parameters", method: http.MethodPost, target: DoHPath, contentType: dohContentType + "; charset=binary", body: packed, want: http.StatusOK},
+		{name: "post other content type", method: http.MethodPost, target: DoHPath, contentType: "application/octet-stream", body: packed, want: http.StatusUnsupportedMediaType},
+		{name: "post without content type", method: http.MethodPost, target: DoHPath, body: packed, want: http.StatusUnsupportedMediaType},
+		{name: "post oversized body", method: http.MethodPost, target: DoHPath, contentType: dohContentType, body: make([]byte, dns.MaxMsgSize+1), want: http.StatusBadRequest},
+		{name: "other method", method: http.MethodPut, target: DoHPath, want: http.StatusMethodNotAllowed},
+	}
+
+	s := NewServer(answersExchange(2))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, bytes.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			if ct := w.Header().Get("Content-Type"); ct != dohContentType {
+				t.Errorf("content type = %q, want %q", ct, dohContentType)
+			}
+			if cc := w.Header().Get("Cache-Control"); cc != "max-age=60" {
+				t.Errorf("cache control = %q, want max-age=60", cc)
+			}
+			resp := new(dns.Msg)
+			if err := resp.Unpack(w.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Answer) != 2 || resp.Truncated {
+				t.Errorf("got %d answers, truncated %t, want all 2", len(resp.Answer), resp.Truncated)
+			}
+		})
+	}
+}
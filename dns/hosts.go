@@ -0,0 +1,106 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// hostsAnswerTTL is the TTL of answers made up from the hosts file, short
+// enough for clients to notice when it is reloaded.
+const hostsAnswerTTL = 30
+
+// maxRewrites bounds the CNAME rewrites followed for a name, so that rewrite
+// loops end.
+const maxRewrites = 8
+
+// rewrite follows the CNAME rewrites of the hosts file from name. It returns
+// the chain of names, starting with name and ending with the one to
+// resolve, and the addresses the last name is pinned to, if any.
+func (s *settings) rewrite(name string) ([]string, []netip.Addr, error) {
+	chain := []string{name}
+	for range maxRewrites {
+		entry, ok := s.hosts.Lookup(chain[len(chain)-1])
+		switch {
+		case !ok:
+			return chain, nil, nil
+		case entry.CNAME == "":
+			return chain, entry.Addrs, nil
+		}
+		chain = append(chain, entry.CNAME)
+	}
+	return nil, nil, fmt.Errorf("more than %d CNAME rewrites for %s", maxRewrites, name)
+}
+
+// pinnedAddr returns the first of the pinned addrs of a type that is looked
+// up.
+func (s *settings) pinnedAddr(addrs []netip.Addr) (netip.Addr, bool) {
+	for _, addr := range addrs {
+		for _, qType := range s.qTypes {
+			if (qType == dns.TypeA && addr.Is4()) || (qType == dns.TypeAAAA && addr.Is6()) {
+				return addr, true
+			}
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// exchangeRewritten answers msg, whose name is overridden in the hosts file
+// with the given chain and pinned addrs. The CNAME records of the chain are
+// followed by the pinned addresses of the queried type or, if the last name
+// is not pinned, by the answer of clt for it.
+func exchangeRewritten(ctx context.Context, clt Resolver, msg *dns.Msg, chain []string, addrs []netip.Addr) (*dns.Msg, error) {
+	q := msg.Question[0]
+
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	resp.RecursionAvailable = true
+
+	owner := q.Name
+	for _, target := range chain[1:] {
+		resp.Answer = append(resp.Answer, &dns.CNAME{
+			Hdr:    hostsHeader(owner, dns.TypeCNAME),
+			Target: dns.Fqdn(target),
+		})
+		owner = dns.Fqdn(target)
+	}
+
+	if addrs != nil {
+		for _, addr := range addrs {
+			switch {
+			case q.Qtype == dns.TypeA && addr.Is4():
+				resp.Answer = append(resp.Answer, &dns.A{Hdr: hostsHeader(owner, dns.TypeA), A: addr.AsSlice()})
+			case q.Qtype == dns.TypeAAAA && addr.Is6():
+				resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hostsHeader(owner, dns.TypeAAAA), AAAA: addr.AsSlice()})
+			}
+		}
+		return resp, nil
+	}
+
+	if q.Qtype == dns.TypeCNAME {
+		return resp, nil
+	}
+
+	query := msg.Copy()
+	query.Question[0].Name = owner
+	upstream, err := clt.Exchange(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", clt, err)
+	}
+	if upstream == nil {
+		return nil, errors.New("no response")
+	}
+
+	resp.Rcode = upstream.Rcode
+	resp.Answer = append(resp.Answer, upstream.Answer...)
+	resp.Ns = upstream.Ns
+	return resp, nil
+}
+
+// hostsHeader returns the header of a record made up from the hosts file.
+func hostsHeader(name string, rrType uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrType, Class: dns.ClassINET, Ttl: hostsAnswerTTL}
+}
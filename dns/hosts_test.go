@@ -0,0 +1,197 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/bariiss/SpoofDPI/util"
+	"github.com/miekg/dns"
+)
+
+// stubResolver answers every query with an A record of 192.0.2.1 and
+// records the names it was asked for.
+type stubResolver struct {
+	names []string
+}
+
+func (r *stubResolver) Resolve(context.Context, string, []uint16) ([]net.IPAddr, error) {
+	return nil, nil
+}
+
+func (r *stubResolver) Exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	r.names = append(r.names, msg.Question[0].Name)
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	}}
+	return resp, nil
+}
+
+func (r *stubResolver) String() string {
+	return "stub"
+}
+
+var testHosts = util.Hosts{
+	"pinned.example":  {Addrs: []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("192.0.2.2")}},
+	"*.cdn.example":   {Addrs: []netip.Addr{netip.MustParseAddr("192.0.2.3")}},
+	"alias.example":   {CNAME: "www.alias.example"},
+	"*.alias.example": {CNAME: "pinned.example"},
+	"mirror.example":  {CNAME: "upstream.example"},
+	"loop1.example":   {CNAME: "loop2.example"},
+	"loop2.example":   {CNAME: "loop1.example"},
+}
+
+func TestRewrite(t *testing.T) {
+	s := &settings{hosts: testHosts}
+
+	tests := []struct {
+		name      string
+		wantChain []string
+		wantAddrs int
+	}{
+		{name: "other.example", wantChain: []string{"other.example"}},
+		{name: "pinned.example", wantChain: []string{"pinned.example"}, wantAddrs: 2},
+		{name: "Edge.CDN.example.", wantChain: []string{"Edge.CDN.example."}, wantAddrs: 1},
+		{name: "alias.example", wantChain: []string{"alias.example", "www.alias.example", "pinned.example"}, wantAddrs: 2},
+		{name: "mirror.example", wantChain: []string{"mirror.example", "upstream.example"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, addrs, err := s.rewrite(tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(chain, tt.wantChain) {
+				t.Errorf("chain = %q, want %q", chain, tt.wantChain)
+			}
+			if len(addrs) != tt.wantAddrs {
+				t.Errorf("addrs = %v, want %d", addrs, tt.wantAddrs)
+			}
+		})
+	}
+
+	if _, _, err := s.rewrite("loop1.example"); err == nil {
+		t.Error("rewrite loop did not fail")
+	}
+}
+
+func TestPinnedAddr(t *testing.T) {
+	addrs := testHosts["pinned.example"].Addrs
+
+	s := &settings{qTypes: []uint16{dns.TypeAAAA, dns.TypeA}}
+	if addr, ok := s.pinnedAddr(addrs); !ok || addr.String() != "2001:db8::1" {
+		t.Errorf("pinnedAddr = %s, %t, want the IPv6 address", addr, ok)
+	}
+
+	s = &settings{qTypes: []uint16{dns.TypeA}}
+	if addr, ok := s.pinnedAddr(addrs); !ok || addr.String() != "192.0.2.2" {
+		t.Errorf("pinnedAddr = %s, %t, want the IPv4 address", addr, ok)
+	}
+
+	if _, ok := s.pinnedAddr(addrs[:1]); ok {
+		t.Error("an IPv6 address was picked for IPv4 lookups")
+	}
+}
+
+func TestDnsExchangeHosts(t *testing.T) {
+	stub := &stubResolver{}
+	d := &Dns{}
+	d.settings.Store(&settings{
+		hosts:     testHosts,
+		resolvers: &resolvers{upstreamClient: stub},
+	})
+
+	exchange := func(name string, qType uint16) *dns.Msg {
+		t.Helper()
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qType)
+		resp, err := d.Exchange(context.Background(), msg, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Id != msg.Id || resp.Question[0].Name != name {
+			t.Errorf("response does not match the query for %s", name)
+		}
+		return resp
+	}
+
+	t.Run("pinned", func(t *testing.T) {
+		resp := exchange("pinned.example.", dns.TypeA)
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+			t.Errorf("answer = %v", resp.Answer)
+		}
+		if ttl := resp.Answer[0].Header().Ttl; ttl != hostsAnswerTTL {
+			t.Errorf("TTL = %d, want %d", ttl, hostsAnswerTTL)
+		}
+	})
+
+	t.Run("pinned other type", func(t *testing.T) {
+		resp := exchange("edge.cdn.example.", dns.TypeAAAA)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+			t.Errorf("response = %v, want no data", resp)
+		}
+	})
+
+	t.Run("cname chain", func(t *testing.T) {
+		resp := exchange("alias.example.", dns.TypeAAAA)
+		var got []string
+		for _, rr := range resp.Answer {
+			got = append(got, rr.String())
+		}
+		if len(resp.Answer) != 3 ||
+			resp.Answer[0].(*dns.CNAME).Target != "www.alias.example." ||
+			resp.Answer[1].(*dns.CNAME).Target != "pinned.example." ||
+			resp.Answer[2].(*dns.AAAA).AAAA.String() != "2001:db8::1" {
+			t.Errorf("answer = %q", got)
+		}
+	})
+
+	t.Run("cname to upstream", func(t *testing.T) {
+		resp := exchange("mirror.example.", dns.TypeA)
+		if len(resp.Answer) != 2 || resp.Answer[0].(*dns.CNAME).Target != "upstream.example." ||
+			resp.Answer[1].Header().Name != "upstream.example." {
+			t.Errorf("answer = %v", resp.Answer)
+		}
+		if !slices.Equal(stub.names, []string{"upstream.example."}) {
+			t.Errorf("upstream was asked for %q, want the CNAME target", stub.names)
+		}
+	})
+
+	t.Run("cname query", func(t *testing.T) {
+		stub.names = nil
+		resp := exchange("mirror.example.", dns.TypeCNAME)
+		if len(resp.Answer) != 1 || len(stub.names) != 0 {
+			t.Errorf("answer = %v, upstream asked for %q, want only the CNAME", resp.Answer, stub.names)
+		}
+	})
+
+	t.Run("not overridden", func(t *testing.T) {
+		stub.names = nil
+		exchange("other.example.", dns.TypeA)
+		if !slices.Equal(stub.names, []string{"other.example."}) {
+			t.Errorf("upstream was asked for %q", stub.names)
+		}
+	})
+}
+
+func TestDnsResolveHostPinned(t *testing.T) {
+	d := &Dns{}
+	d.settings.Store(&settings{
+		qTypes:    []uint16{dns.TypeA},
+		hosts:     testHosts,
+		resolvers: &resolvers{upstreamClient: &stubResolver{}},
+	})
+
+	if addr, err := d.ResolveHost(context.Background(), "alias.example", true); err != nil || addr != "192.0.2.2" {
+		t.Errorf("ResolveHost = %s, %v, want the pinned address of the CNAME target", addr, err)
+	}
+	if _, err := d.ResolveHost(context.Background(), "loop1.example", true); err == nil {
+		t.Error("ResolveHost of a rewrite loop succeeded")
+	}
+}
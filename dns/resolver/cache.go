@@ -0,0 +1,415 @@
+package resolver
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bariiss/SpoofDPI/util/log"
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// staleAnswerTTL is the TTL of stale answers, as recommended by RFC 8767.
+	staleAnswerTTL = 30
+	// staleAnswerDelay is how long a lookup waits for the upstream before it
+	// is answered from an expired entry.
+	staleAnswerDelay = 1800 * time.Millisecond
+	// staleRetryDelay is how long expired entries are served without asking
+	// the upstream again after a refresh failed.
+	staleRetryDelay = 30 * time.Second
+	// refreshTimeout limits refreshes that run in the background.
+	refreshTimeout = 5 * time.Second
+
+	// prefetchHits is the number of hits that makes an entry popular enough
+	// to be refreshed before it expires.
+	prefetchHits = 2
+	// prefetchFraction is the fraction of the TTL left at which popular
+	// entries are refreshed.
+	prefetchFraction = 10
+)
+
+var errUpstreamFailure = errors.New("upstream failure")
+
+// cacheKey identifies a cached answer. Answers of different upstreams are
+// kept apart, as they may differ on purpose. So are answers to queries with
+// the DO bit, which carry DNSSEC records, and with the CD bit, which may
+// include data that failed validation.
+type cacheKey struct {
+	name     string
+	qType    uint16
+	qClass   uint16
+	do       bool
+	cd       bool
+	upstream string
+}
+
+// newCacheKey returns the key of the answer of upstream to msg.
+func newCacheKey(upstream string, msg *dns.Msg) cacheKey {
+	q := msg.Question[0]
+	opt := msg.IsEdns0()
+	return cacheKey{
+		name:     strings.ToLower(q.Name),
+		qType:    q.Qtype,
+		qClass:   q.Qclass,
+		do:       opt != nil && opt.Do(),
+		cd:       msg.CheckingDisabled,
+		upstream: upstream,
+	}
+}
+
+func (k cacheKey) String() string {
+	return k.upstream + " " + k.name + " " + strconv.FormatUint(uint64(k.qType), 10) + " " +
+		strconv.FormatUint(uint64(k.qClass), 10) + " " + strconv.FormatBool(k.do) + " " + strconv.FormatBool(k.cd)
+}
+
+// cacheEntry is a cached response and the time it was received.
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+
+	// hits counts the lookups answered by the entry
+	hits int
+	// refreshing is set once a prefetch of the entry started
+	refreshing bool
+	// retryAfter holds off refreshes of an expired entry after one failed
+	retryAfter time.Time
+}
+
+// cacheState tells how a lookup can be answered from the cache.
+type cacheState int
+
+const (
+	cacheMiss cacheState = iota
+	cacheFresh
+	cachePrefetch
+	cacheStale
+	cacheStaleRetry
+)
+
+// Cache keeps DNS responses in memory for as long as their TTL allows. TTLs
+// are clamped to the configured minimum and maximum. Negative answers,
+// NXDOMAIN and NODATA, are cached for the SOA minimum as described in RFC
+// 2308, and not at all if the response has no SOA record. When the cache is
+// full, the least recently used entry is evicted. Concurrent identical
+// lookups share a single query to the upstream.
+//
+// Expired entries are kept for the stale TTL and served as described in RFC
+// 8767 when the upstream fails or does not answer in time, while the entry
+// is refreshed in the background. With prefetch, popular entries are
+// refreshed shortly before they expire.
+//
+// A nil Cache is valid and caches nothing.
+type Cache struct {
+	size     int
+	minTTL   time.Duration
+	maxTTL   time.Duration
+	staleTTL time.Duration
+	prefetch bool
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+	group   singleflight.Group
+}
+
+// NewCache creates a Cache that holds up to size responses, or returns nil
+// if size is 0. Expired responses are served for up to staleTTL, and popular
+// ones are refreshed before they expire if prefetch is set.
+func NewCache(size int, minTTL, maxTTL, staleTTL time.Duration, prefetch bool) *Cache {
+	if size <= 0 {
+		return nil
+	}
+	return &Cache{
+		size:     size,
+		minTTL:   minTTL,
+		maxTTL:   maxTTL,
+		staleTTL: staleTTL,
+		prefetch: prefetch,
+		entries:  make(map[cacheKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// wrap returns an exchangeFunc that answers from the cache, or sends the
+// query with exchange and caches the response. Callers waiting for the same
+// query share the context of the first one.
+func (c *Cache) wrap(upstream string, exchange exchangeFunc) exchangeFunc {
+	if c == nil {
+		return exchange
+	}
+
+	return func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		if len(msg.Question) != 1 {
+			return exchange(ctx, msg)
+		}
+
+		logger := log.GetCtxLogger(ctx)
+
+		q := msg.Question[0]
+		key := newCacheKey(upstream, msg)
+
+		resp, state := c.get(key)
+		switch state {
+		case cacheFresh:
+			resp.Id = msg.Id
+			return resp, nil
+
+		case cachePrefetch:
+			logger.Debug().Msgf("prefetching %s (%s) from %s", q.Name, recordTypeIDToName(q.Qtype), upstream)
+			c.refresh(key, msg, exchange)
+			resp.Id = msg.Id
+			return resp, nil
+
+		case cacheStale:
+			select {
+			case res := <-c.refresh(key, msg, exchange):
+				if res.Err == nil {
+					fresh := res.Val.(*dns.Msg).Copy()
+					fresh.Id = msg.Id
+					return fresh, nil
+				}
+				logger.Debug().Msgf("serving stale %s (%s): %s", q.Name, recordTypeIDToName(q.Qtype), res.Err)
+			case <-time.After(staleAnswerDelay):
+				logger.Debug().Msgf("serving stale %s (%s): %s is slow", q.Name, recordTypeIDToName(q.Qtype), upstream)
+			}
+			resp.Id = msg.Id
+			return resp, nil
+
+		case cacheStaleRetry:
+			resp.Id = msg.Id
+			return resp, nil
+		}
+
+		v, err, _ := c.group.Do(key.String(), func() (any, error) {
+			resp, err := exchange(ctx, msg)
+			if err != nil {
+				return nil, err
+			}
+			c.put(key, resp)
+			return resp, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		resp = v.(*dns.Msg).Copy()
+		resp.Id = msg.Id
+		return resp, nil
+	}
+}
+
+// refresh queries the upstream for an entry in the background, so that it
+// outlives the lookup that started it. A failed refresh holds off the next
+// one for a while; the expired entry is kept in the meantime.
+func (c *Cache) refresh(key cacheKey, msg *dns.Msg, exchange exchangeFunc) <-chan singleflight.Result {
+	msg = msg.Copy()
+
+	return c.group.DoChan(key.String(), func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+
+		resp, err := exchange(ctx, msg)
+		if err == nil && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			err = errUpstreamFailure
+		}
+		if err != nil {
+			c.holdOff(key)
+			return nil, err
+		}
+
+		c.put(key, resp)
+		return resp, nil
+	})
+}
+
+// holdOff delays the next refresh of an entry after a failed one.
+func (c *Cache) holdOff(key cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).retryAfter = time.Now().Add(staleRetryDelay)
+	}
+}
+
+// get returns a copy of the cached response for key with its TTLs reduced
+// by the time it spent in the cache, or set to the stale TTL if it expired,
+// and how the lookup should be answered.
+func (c *Cache) get(key cacheKey) (*dns.Msg, cacheState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, cacheMiss
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expires.Add(c.staleTTL)) {
+		c.remove(elem)
+		return nil, cacheMiss
+	}
+
+	c.lru.MoveToFront(elem)
+	entry.hits++
+	resp := entry.msg.Copy()
+
+	if !now.Before(entry.expires) {
+		setTTLs(resp, staleAnswerTTL)
+		if now.Before(entry.retryAfter) {
+			return resp, cacheStaleRetry
+		}
+		return resp, cacheStale
+	}
+
+	ageTTLs(resp, uint32(now.Sub(entry.stored)/time.Second))
+
+	ttl := entry.expires.Sub(entry.stored)
+	if c.prefetch && !entry.refreshing && entry.hits >= prefetchHits &&
+		entry.expires.Sub(now) < ttl/prefetchFraction {
+		entry.refreshing = true
+		return resp, cachePrefetch
+	}
+	return resp, cacheFresh
+}
+
+// put stores resp for key if it can be cached, evicting the least recently
+// used entries beyond the size of the cache.
+func (c *Cache) put(key cacheKey, resp *dns.Msg) {
+	ttl, ok := cacheTTL(resp)
+	if !ok {
+		return
+	}
+	ttl = max(ttl, c.minTTL)
+	if c.maxTTL > 0 {
+		ttl = min(ttl, c.maxTTL)
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	entry := &cacheEntry{
+		key:     key,
+		msg:     resp.Copy(),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Retain drops the entries of every upstream but the given ones, for use
+// after the upstreams changed.
+func (c *Cache) Retain(upstreams []string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if !slices.Contains(upstreams, key.upstream) {
+			c.remove(elem)
+		}
+	}
+}
+
+// Flush drops the entries of every name match reports true for. Names are
+// passed in lower case with the trailing dot.
+func (c *Cache) Flush(match func(name string) bool) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if match(key.name) {
+			c.remove(elem)
+		}
+	}
+}
+
+// remove drops an entry. The lock must be held.
+func (c *Cache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+// cacheTTL returns how long resp may be cached before clamping. Positive
+// answers live as long as their shortest record. Negative answers live for
+// the smaller of the SOA's TTL and minimum field. Other responses, such as
+// SERVFAIL, are not cached.
+func cacheTTL(resp *dns.Msg) (time.Duration, bool) {
+	if resp.Truncated {
+		return 0, false
+	}
+
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		ttl := resp.Answer[0].Header().Ttl
+		for _, rr := range resp.Answer[1:] {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+		return time.Duration(ttl) * time.Second, true
+	case resp.Rcode == dns.RcodeSuccess, resp.Rcode == dns.RcodeNameError:
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// ageTTLs reduces the TTLs of all records in msg by age seconds.
+func ageTTLs(msg *dns.Msg, age uint32) {
+	forEachRecord(msg, func(hdr *dns.RR_Header) {
+		hdr.Ttl -= min(hdr.Ttl, age)
+	})
+}
+
+// setTTLs sets the TTLs of all records in msg to ttl seconds.
+func setTTLs(msg *dns.Msg, ttl uint32) {
+	forEachRecord(msg, func(hdr *dns.RR_Header) {
+		hdr.Ttl = ttl
+	})
+}
+
+// forEachRecord calls fn with the header of every record in msg except the
+// EDNS0 pseudo-record, whose TTL field holds flags.
+func forEachRecord(msg *dns.Msg, fn func(hdr *dns.RR_Header)) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			fn(rr.Header())
+		}
+	}
+}
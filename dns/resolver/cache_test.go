@@ -0,0 +1,387 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeUpstream answers every query with an A record of the given TTL, or
+// with err if it is set, and counts the queries.
+type fakeUpstream struct {
+	ttl     uint32
+	rcode   int
+	err     atomic.Pointer[error]
+	queries atomic.Int32
+}
+
+func (u *fakeUpstream) exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	u.queries.Add(1)
+	if err := u.err.Load(); err != nil {
+		return nil, *err
+	}
+
+	resp := new(dns.Msg)
+	resp.SetRcode(msg, u.rcode)
+	if u.rcode == dns.RcodeSuccess {
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: u.ttl},
+			A:   net.IPv4(192, 0, 2, 1),
+		}}
+	}
+	return resp, nil
+}
+
+func (u *fakeUpstream) fail(err error) {
+	u.err.Store(&err)
+}
+
+// query sends a query for name through exchange and returns the response.
+func query(t *testing.T, exchange exchangeFunc, name string) *dns.Msg {
+	t.Helper()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	resp, err := exchange(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("exchange %s: %s", name, err)
+	}
+	if resp.Id != msg.Id {
+		t.Errorf("response id = %d, want %d", resp.Id, msg.Id)
+	}
+	return resp
+}
+
+func TestCacheHit(t *testing.T) {
+	upstream := &fakeUpstream{ttl: 300}
+	cache := NewCache(10, 0, 0, 0, false)
+	exchange := cache.wrap("upstream", upstream.exchange)
+
+	query(t, exchange, "example.com.")
+	resp := query(t, exchange, "EXAMPLE.com.")
+	if n := upstream.queries.Load(); n != 1 {
+		t.Errorf("upstream got %d queries, want 1", n)
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl == 0 || ttl > 300 {
+		t.Errorf("cached TTL = %d", ttl)
+	}
+
+	// Answers of other upstreams are not shared
+	query(t, cache.wrap("other", upstream.exchange), "example.com.")
+	if n := upstream.queries.Load(); n != 2 {
+		t.Errorf("upstream got %d queries, want 2", n)
+	}
+}
+
+func TestCacheNil(t *testing.T) {
+	upstream := &fakeUpstream{ttl: 300}
+	var cache *Cache
+	exchange := cache.wrap("upstream", upstream.exchange)
+
+	query(t, exchange, "example.com.")
+	query(t, exchange, "example.com.")
+	if n := upstream.queries.Load(); n != 2 {
+		t.Errorf("upstream got %d queries, want 2", n)
+	}
+	if NewCache(0, 0, 0, 0, false) != nil {
+		t.Error("a cache of size 0 is not nil")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	soa := &dns.SOA{Hdr: dns.RR_Header{Ttl: 600}, Minttl: 60}
+	tests := []struct {
+		name   string
+		resp   *dns.Msg
+		want   time.Duration
+		cached bool
+	}{
+		{
+			name:   "shortest answer",
+			resp:   &dns.Msg{Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Ttl: 300}}, &dns.A{Hdr: dns.RR_Header{Ttl: 100}}}},
+			want:   100 * time.Second,
+			cached: true,
+		},
+		{
+			name:   "nxdomain with soa",
+			resp:   &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Ns: []dns.RR{soa}},
+			want:   60 * time.Second,
+			cached: true,
+		},
+		{name: "nodata with soa", resp: &dns.Msg{Ns: []dns.RR{soa}}, want: 60 * time.Second, cached: true},
+		{name: "nxdomain without soa", resp: &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}},
+		{name: "servfail", resp: &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}, Ns: []dns.RR{soa}}},
+		{
+			name: "truncated",
+			resp: &dns.Msg{MsgHdr: dns.MsgHdr{Truncated: true}, Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Ttl: 300}}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, ok := cacheTTL(tt.resp)
+			if ok != tt.cached || ttl != tt.want {
+				t.Errorf("cacheTTL = %s, %t, want %s, %t", ttl, ok, tt.want, tt.cached)
+			}
+		})
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	upstream := &fakeUpstream{ttl: 300}
+	// The maximum TTL cuts the answer's 300s down to 20ms
+	cache := NewCache(10, 0, 20*time.Millisecond, 0, false)
+	exchange := cache.wrap("upstream", upstream.exchange)
+
+	query(t, exchange, "example.com.")
+	query(t, exchange, "example.com.")
+	if n := upstream.queries.Load(); n != 1 {
+		t.Fatalf("upstream got %d queries, want 1", n)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	query(t, exchange, "example.com.")
+	if n := upstream.queries.Load(); n != 2 {
+		t.Errorf("upstream got %d queries after expiry, want 2", n)
+	}
+}
+
+func TestCacheMinTTL(t *testing.T) {
+	upstream := &fakeUpstream{ttl: 0}
+	exchange := NewCache(10, time.Minute, 0, 0, false).wrap("upstream", upstream.exchange)
+
+	query(t, exchange, "example.com.")
+	query(t, exchange, "example.com.")
+	if n := upstream.queries.Load(); n != 1 {
+		t.Errorf("upstream got %d queries, want 1", n)
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	upstream := &fakeUpstream{ttl: 300}
+	exchange := NewCache(2, 0, 0, 0, false).wrap("upstream", upstream.exchange)
+
+	query(t, exchange, "a.example.")
+	query(t, exchange, "b.example.")
+	query(t, exchange, "a.example.")
+	query(t, exchange, "c.example.") // evicts b, the least recently used
+	if n := upstream.queries.Load(); n != 3 {
+		t.Fatalf("upstream got %d queries, want 3", n)
+	}
+
+	query(t, exchange, "a.example.")
+	if n := upstream.queries.Load(); n != 3 {
+		t.Errorf("a was evicted")
+	}
+	query(t, exchange, "b.example.")
+	if n := upstream.queries.Load(); n != 4 {
+		t.Errorf("b was not evicted")
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	upstream := &fakeUpstream{ttl: 300}
+	cache := NewCache(10, 0, 20*time.Millisecond, time.Minute, false)
+	exchange := cache.wrap("upstream", upstream.exchange)
+
+	query(t, exchange, "example.com.")
+	time.Sleep(30 * time.Millisecond)
+
+	upstream.fail(errors.New("unreachable"))
+	resp := query(t, exchange, "example.com.")
+	if ttl := resp.Answer[0].Header().Ttl; ttl != staleAnswerTTL {
+		t.Errorf("stale TTL = %d, want %d", ttl, staleAnswerTTL)
+	}
+	if n := upstream.queries.Load(); n != 2 {
+		t.Fatalf("upstream got %d queries, want a refresh", n)
+	}
+
+	// The failed refresh holds off the next one
+	query(t, exchange, "example.com.")
+	if n := upstream.queries.Load(); n != 2 {
+		t.Errorf("upstream got %d queries, want no refresh after a failed one", n)
+	}
+}
+
+func TestCacheStaleRefreshed(t *testing.T) {
+	upstream := &fakeUpstream{ttl: 300}
+	cache := NewCache(10, 0, 20*time.Millisecond, time.Minute, false)
+	exchange := cache.wrap("upstream", upstream.exchange)
+
+	query(t, exchange, "example.com.")
+	time.Sleep(30 * time.Millisecond)
+
+	// A working upstream answers right away instead of the stale entry
+	resp := query(t, exchange, "example.com.")
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 300 {
+		t.Errorf("TTL = %d, want the fresh answer's 300", ttl)
+	}
+}
+
+func TestCacheStaleExpired(t *testing.T) {
+	upstream := &fakeUpstream{ttl: 300}
+	cache := NewCache(10, 0, 10*time.Millisecond, 10*time.Millisecond, false)
+	exchange := cache.wrap("upstream", upstream.exchange)
+
+	query(t, exchange, "example.com.")
+	time.Sleep(30 * time.Millisecond)
+
+	upstream.fail(errors.New("unreachable"))
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := exchange(context.Background(), msg); err == nil {
+		t.Error("an entry past its stale TTL was served")
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	upstream := &fakeUpstream{ttl: 300}
+	// Entries live for 100ms and are prefetched in their last 10ms
+	cache := NewCache(10, 0, 100*time.Millisecond, 0, true)
+	exchange := cache.wrap("upstream", upstream.exchange)
+
+	query(t, exchange, "example.com.")
+	query(t, exchange, "example.com.")
+	time.Sleep(95 * time.Millisecond)
+	query(t, exchange, "example.com.")
+
+	deadline := time.Now().Add(time.Second)
+	for upstream.queries.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := upstream.queries.Load(); n != 2 {
+		t.Errorf("upstream got %d queries, want a prefetch", n)
+	}
+}
+
+func TestCacheRetain(t *testing.T) {
+	upstream := &fakeUpstream{ttl: 300}
+	cache := NewCache(10, 0, 0, 0, false)
+	kept := cache.wrap("kept", upstream.exchange)
+	gone := cache.wrap("gone", upstream.exchange)
+
+	query(t, kept, "example.com.")
+	query(t, gone, "example.com.")
+	cache.Retain([]string{"kept"})
+
+	query(t, kept, "example.com.")
+	if n := upstream.queries.Load(); n != 2 {
+		t.Errorf("answer of a retained upstream was dropped")
+	}
+	query(t, gone, "example.com.")
+	if n := upstream.queries.Load(); n != 3 {
+		t.Errorf("answer of a removed upstream was kept")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(msg *dns.Msg)
+	}{
+		{name: "qclass", setup: func(msg *dns.Msg) { msg.Question[0].Qclass = dns.ClassCHAOS }},
+		{name: "do", setup: func(msg *dns.Msg) { msg.SetEdns0(1232, true) }},
+		{name: "cd", setup: func(msg *dns.Msg) { msg.CheckingDisabled = true }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &fakeUpstream{ttl: 300}
+			exchange := NewCache(10, 0, 0, 0, false).wrap("upstream", upstream.exchange)
+
+			query(t, exchange, "example.com.")
+
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			tt.setup(msg)
+			for range 2 {
+				if _, err := exchange(context.Background(), msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := upstream.queries.Load(); n != 2 {
+				t.Errorf("upstream got %d queries, want 2", n)
+			}
+		})
+	}
+
+	// EDNS0 without the DO bit shares the answer
+	upstream := &fakeUpstream{ttl: 300}
+	exchange := NewCache(10, 0, 0, 0, false).wrap("upstream", upstream.exchange)
+	query(t, exchange, "example.com.")
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.SetEdns0(1232, false)
+	if _, err := exchange(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if n := upstream.queries.Load(); n != 1 {
+		t.Errorf("upstream got %d queries, want 1", n)
+	}
+}
+
+func TestCacheSingleflight(t *testing.T) {
+	release := make(chan struct{})
+	upstream := &fakeUpstream{ttl: 300}
+	blocking := func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		<-release
+		return upstream.exchange(ctx, msg)
+	}
+	exchange := NewCache(10, 0, 0, 0, false).wrap("upstream", blocking)
+
+	send := func(do bool) <-chan *dns.Msg {
+		done := make(chan *dns.Msg, 1)
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		if do {
+			msg.SetEdns0(1232, true)
+		}
+		go func() {
+			resp, _ := exchange(context.Background(), msg)
+			done <- resp
+		}()
+		return done
+	}
+
+	var results []<-chan *dns.Msg
+	for range 3 {
+		results = append(results, send(false))
+	}
+	results = append(results, send(true))
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for _, done := range results {
+		if resp := <-done; resp == nil {
+			t.Fatal("lookup failed")
+		}
+	}
+	// The plain lookups share a query; the DNSSEC one gets its own
+	if n := upstream.queries.Load(); n != 2 {
+		t.Errorf("upstream got %d queries, want 2", n)
+	}
+}
+
+func TestCacheFlush(t *testing.T) {
+	upstream := &fakeUpstream{ttl: 300}
+	cache := NewCache(10, 0, 0, 0, false)
+	exchange := cache.wrap("upstream", upstream.exchange)
+
+	query(t, exchange, "a.example.")
+	query(t, exchange, "B.example.")
+	cache.Flush(func(name string) bool { return name == "b.example." })
+
+	query(t, exchange, "a.example.")
+	if n := upstream.queries.Load(); n != 2 {
+		t.Errorf("answer of a name that was not flushed was dropped")
+	}
+	query(t, exchange, "b.example.")
+	if n := upstream.queries.Load(); n != 3 {
+		t.Errorf("answer of a flushed name was kept")
+	}
+}
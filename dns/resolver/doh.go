@@ -9,38 +9,95 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"regexp"
+	"net/netip"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// dohContentType is the media type of DNS messages in DoH requests and
+// responses.
+const dohContentType = "application/dns-message"
+
 type DOHResolver struct {
 	upstream string
+	post     bool
 	client   *http.Client
+	cache    *Cache
 }
 
-// NewDOHResolver creates a new DOHResolver instance.
-func NewDOHResolver(host string) *DOHResolver {
-	host = regexp.MustCompile(`^https://|/dns-query$`).ReplaceAllString(host, "")
-	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
-		host = fmt.Sprintf("[%s]", ip)
+// NewDOHResolver creates a new DOHResolver instance for the DoH URL
+// upstream. A bare host is taken as https://upstream, and a URL without a
+// path gets the usual /dns-query. Queries are sent as POST requests if post
+// is set, and as GET requests otherwise. If bootstrap addresses are given,
+// the host of the URL is connected to at those instead of being resolved by
+// the system. Answers are kept in cache, which may be nil.
+func NewDOHResolver(upstream string, post bool, bootstrap []netip.Addr, cache *Cache) *DOHResolver {
+	if !strings.Contains(upstream, "://") {
+		if ip := net.ParseIP(upstream); ip != nil && ip.To4() == nil {
+			upstream = fmt.Sprintf("[%s]", ip)
+		}
+		upstream = "https://" + upstream
+	}
+	if u, err := url.Parse(upstream); err == nil && (u.Path == "" || u.Path == "/") {
+		u.Path = "/dns-query"
+		upstream = u.String()
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   3 * time.Second,
+		KeepAlive: 30 * time.Second,
 	}
 
 	return &DOHResolver{
-		upstream: "https://" + host + "/dns-query",
+		upstream: upstream,
+		post:     post,
 		client: &http.Client{
 			Timeout: 5 * time.Second,
 			Transport: &http.Transport{
-				DialContext: (&net.Dialer{
-					Timeout:   3 * time.Second,
-					KeepAlive: 30 * time.Second,
-				}).DialContext,
+				DialContext:         bootstrapDialer(dialer, bootstrap),
+				ForceAttemptHTTP2:   true,
 				TLSHandshakeTimeout: 5 * time.Second,
 				MaxIdleConnsPerHost: 100,
 				MaxIdleConns:        100,
+				IdleConnTimeout:     90 * time.Second,
 			},
 		},
+		cache: cache,
+	}
+}
+
+// bootstrapDialer returns a dial function that connects to the bootstrap
+// addresses, in order, instead of resolving the host. TLS is still verified
+// against the host. Without bootstrap addresses, it is dialer.DialContext.
+func bootstrapDialer(dialer *net.Dialer, bootstrap []netip.Addr) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(bootstrap) == 0 {
+		return dialer.DialContext
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := netip.ParseAddr(host); err == nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		var errs []error
+		for _, ip := range bootstrap {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, errors.Join(errs...)
 	}
 }
 
@@ -51,25 +108,32 @@ func (r *DOHResolver) String() string {
 
 // Resolve performs a DNS lookup for the given host and returns the IP addresses.
 func (r *DOHResolver) Resolve(ctx context.Context, host string, qTypes []uint16) ([]net.IPAddr, error) {
-	resultCh := lookupAllTypes(ctx, host, qTypes, r.exchange)
+	resultCh := lookupAllTypes(ctx, host, qTypes, r.Exchange)
 	return processResults(ctx, resultCh)
 }
 
-// exchange sends a DNS query to the server and returns the response.
+// Exchange sends a DNS query to the server, or answers it from the cache,
+// and returns the response.
+func (r *DOHResolver) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	return r.cache.wrap(r.String(), r.exchange)(ctx, msg)
+}
+
+// exchange sends a DNS query to the server and returns the response. The
+// query is sent with id 0, as RFC 8484 recommends so that identical queries
+// can be answered by HTTP caches.
 func (r *DOHResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
-	packed, err := msg.Pack()
+	query := msg.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
 	if err != nil {
 		return nil, err
 	}
 
-	encoded := base64.RawStdEncoding.EncodeToString(packed)
-	url := fmt.Sprintf("%s?dns=%s", r.upstream, encoded)
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	req, err := r.newRequest(ctx, packed)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Accept", "application/dns-message")
+	req.Header.Set("Accept", dohContentType)
 
 	resp, err := r.client.Do(req)
 	if err != nil {
@@ -87,7 +151,7 @@ func (r *DOHResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, err
 	}
 
 	var buf bytes.Buffer
-	if _, err := buf.ReadFrom(resp.Body); err != nil {
+	if _, err := buf.ReadFrom(io.LimitReader(resp.Body, dns.MaxMsgSize)); err != nil {
 		return nil, err
 	}
 
@@ -95,10 +159,31 @@ func (r *DOHResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, err
 	if err := result.Unpack(buf.Bytes()); err != nil {
 		return nil, err
 	}
+	result.Id = msg.Id
+
+	return result, nil
+}
+
+// newRequest builds the HTTP request carrying a packed query, either as the
+// body of a POST request or as the base64url encoded dns parameter of a GET
+// request, added to the parameters the URL may have already.
+func (r *DOHResolver) newRequest(ctx context.Context, packed []byte) (*http.Request, error) {
+	if r.post {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.upstream, bytes.NewReader(packed))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", dohContentType)
+		return req, nil
+	}
 
-	if result.Rcode != dns.RcodeSuccess {
-		return nil, errors.New("doh rcode wasn't successful")
+	u, err := url.Parse(r.upstream)
+	if err != nil {
+		return nil, err
 	}
+	params := u.Query()
+	params.Set("dns", base64.RawURLEncoding.EncodeToString(packed))
+	u.RawQuery = params.Encode()
 
-	return result, nil
+	return http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 }
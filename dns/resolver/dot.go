@@ -0,0 +1,336 @@
+package resolver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+// dotIdleTimeout is how long a connection without pending queries is kept
+// open for the next ones.
+const dotIdleTimeout = 30 * time.Second
+
+// dotMaxPending bounds the queries waiting for a response on a connection,
+// so that a server that stops answering cannot run out of message ids.
+const dotMaxPending = 1024
+
+var (
+	errConnClosed     = errors.New("connection closed")
+	errTooManyQueries = errors.New("too many pending queries")
+)
+
+type DOTResolver struct {
+	server    string
+	tlsConfig *tls.Config
+	dialer    *net.Dialer
+	cache     *Cache
+
+	mu   sync.Mutex
+	conn *dotConn
+	// dials makes concurrent queries wait for a single new connection
+	dials singleflight.Group
+}
+
+// NewDOTResolver creates a new DOTResolver instance for the server at
+// host:port, authenticated as serverName, or host if serverName is empty.
+// If pins are given, the server is authenticated by the sha256 digest of
+// its public key instead of its certificate chain. Answers are kept in
+// cache, which may be nil.
+func NewDOTResolver(server, serverName string, pins [][]byte, cache *Cache) *DOTResolver {
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(server)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(pins) > 0 {
+		// The pins replace the chain validation, so that servers with a
+		// self-signed certificate can be used as well (RFC 7858, section 4.2)
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPins(rawCerts, pins)
+		}
+	}
+
+	return &DOTResolver{
+		server:    server,
+		tlsConfig: tlsConfig,
+		dialer: &net.Dialer{
+			Timeout:   3 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+		cache: cache,
+	}
+}
+
+// String returns a string representation of the DOTResolver.
+func (r *DOTResolver) String() string {
+	return fmt.Sprintf("dot resolver(%s)", r.server)
+}
+
+// Resolve performs a DNS lookup for the given host and returns the IP addresses.
+func (r *DOTResolver) Resolve(ctx context.Context, host string, qTypes []uint16) ([]net.IPAddr, error) {
+	resultCh := lookupAllTypes(ctx, host, qTypes, r.Exchange)
+	return processResults(ctx, resultCh)
+}
+
+// Exchange sends a DNS query to the server, or answers it from the cache,
+// and returns the response.
+func (r *DOTResolver) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	return r.cache.wrap(r.String(), r.exchange)(ctx, msg)
+}
+
+// exchange sends a DNS query over the shared connection and returns the
+// response. Servers close idle connections at any time, so a query that
+// failed because its connection was closed is retried once on a new one.
+func (r *DOTResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	for attempt := 0; ; attempt++ {
+		c, err := r.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.exchange(ctx, msg)
+		if err == nil || attempt > 0 || !errors.Is(err, errConnClosed) || ctx.Err() != nil {
+			return resp, err
+		}
+	}
+}
+
+// connect returns the open connection to the server, or dials a new one.
+// Queries that need a connection while it is dialed wait for the same one,
+// sharing the context of the first query; queries on the open connection
+// are not held up by the dial.
+func (r *DOTResolver) connect(ctx context.Context) (*dotConn, error) {
+	if c := r.openConn(); c != nil {
+		return c, nil
+	}
+
+	v, err, _ := r.dials.Do(r.server, func() (any, error) {
+		if c := r.openConn(); c != nil {
+			return c, nil
+		}
+
+		dialer := &tls.Dialer{NetDialer: r.dialer, Config: r.tlsConfig}
+		conn, err := dialer.DialContext(ctx, "tcp", r.server)
+		if err != nil {
+			return nil, err
+		}
+
+		c := newDotConn(conn)
+		r.mu.Lock()
+		r.conn = c
+		r.mu.Unlock()
+		return c, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*dotConn), nil
+}
+
+// openConn returns the connection to the server, or nil if there is no open
+// one.
+func (r *DOTResolver) openConn() *dotConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn != nil && !r.conn.closed() {
+		return r.conn
+	}
+	return nil
+}
+
+// dotConn is a connection to a DoT server that carries any number of
+// queries at once. Responses, which may arrive in any order, are matched to
+// the queries by their message id.
+type dotConn struct {
+	conn    *dns.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	idle    *time.Timer
+	err     error
+}
+
+// newDotConn starts reading responses from conn.
+func newDotConn(conn net.Conn) *dotConn {
+	c := &dotConn{
+		conn:    &dns.Conn{Conn: conn},
+		pending: make(map[uint16]chan *dns.Msg),
+	}
+	c.idle = time.AfterFunc(dotIdleTimeout, c.closeIdle)
+	go c.readLoop()
+	return c
+}
+
+// exchange sends msg with an id that is unique on the connection and waits
+// for the response.
+func (c *dotConn) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	id, ch, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id)
+
+	query := msg.Copy()
+	query.Id = id
+
+	c.writeMu.Lock()
+	deadline, _ := ctx.Deadline()
+	_ = c.conn.SetWriteDeadline(deadline)
+	err = c.conn.WriteMsg(query)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, c.closedErr()
+	}
+
+	select {
+	case resp := <-ch:
+		if resp == nil {
+			return nil, c.closedErr()
+		}
+		resp.Id = msg.Id
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// register reserves a free message id for a query. It fails if
+// dotMaxPending queries are waiting already.
+func (c *dotConn) register() (uint16, chan *dns.Msg, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+	if len(c.pending) >= dotMaxPending {
+		return 0, nil, errTooManyQueries
+	}
+
+	id := dns.Id()
+	for c.pending[id] != nil {
+		id++
+	}
+
+	ch := make(chan *dns.Msg, 1)
+	c.pending[id] = ch
+	c.idle.Stop()
+	return id, ch, nil
+}
+
+// unregister releases the message id of a query, and starts the idle timer
+// if it was the last pending one.
+func (c *dotConn) unregister(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, id)
+	if len(c.pending) == 0 && c.err == nil {
+		c.idle.Reset(dotIdleTimeout)
+	}
+}
+
+// readLoop hands the responses over to the waiting queries until the
+// connection fails.
+func (c *dotConn) readLoop() {
+	for {
+		resp, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		// Responses to queries that gave up already, and duplicates, are
+		// dropped
+		c.mu.Lock()
+		select {
+		case c.pending[resp.Id] <- resp:
+		default:
+		}
+		c.mu.Unlock()
+	}
+}
+
+// closeIdle closes the connection if no query is pending.
+func (c *dotConn) closeIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.pending) == 0 {
+		c.closeLocked(errors.New("idle"))
+	}
+}
+
+// close closes the connection and fails the pending queries.
+func (c *dotConn) close(cause error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked(cause)
+}
+
+// closeLocked is close with the lock held.
+func (c *dotConn) closeLocked(cause error) {
+	if c.err != nil {
+		return
+	}
+	c.err = fmt.Errorf("%w: %w", errConnClosed, cause)
+	c.idle.Stop()
+	_ = c.conn.Close()
+
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// closed reports whether the connection can no longer be used.
+func (c *dotConn) closed() bool {
+	return c.closedErr() != nil
+}
+
+// closedErr returns why the connection was closed, or nil if it is open.
+func (c *dotConn) closedErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// verifyPins checks that the server's own certificate, the first one it
+// presented, has one of the pinned public keys. The rest of the chain is
+// not trusted, as anyone can present a pinned intermediate along with a
+// certificate of their own.
+func verifyPins(rawCerts [][]byte, pins [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server presented no certificate")
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	if !slices.ContainsFunc(pins, func(pin []byte) bool {
+		return string(pin) == string(digest[:])
+	}) {
+		return errors.New("server certificate does not match the pinned public keys")
+	}
+	return nil
+}
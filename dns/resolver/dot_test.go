@@ -0,0 +1,303 @@
+package resolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestCert creates a certificate for 127.0.0.1 signed by parent, or a
+// self-signed one if parent is nil.
+func newTestCert(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+
+	issuer, signer := template, any(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// pinOf returns the pin of the public key of cert.
+func pinOf(cert tls.Certificate) []byte {
+	digest := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	return digest[:]
+}
+
+func TestVerifyPins(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	leaf := newTestCert(t, "leaf", &ca)
+	chain := [][]byte{leaf.Certificate[0], ca.Certificate[0]}
+
+	tests := []struct {
+		name     string
+		rawCerts [][]byte
+		pins     [][]byte
+		ok       bool
+	}{
+		{name: "leaf pinned", rawCerts: chain, pins: [][]byte{pinOf(ca), pinOf(leaf)}, ok: true},
+		{name: "intermediate pinned", rawCerts: chain, pins: [][]byte{pinOf(ca)}},
+		{name: "nothing pinned", rawCerts: chain, pins: [][]byte{make([]byte, sha256.Size)}},
+		{name: "no certificate", pins: [][]byte{pinOf(leaf)}},
+		{name: "invalid certificate", rawCerts: [][]byte{[]byte("junk")}, pins: [][]byte{pinOf(leaf)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyPins(tt.rawCerts, tt.pins)
+			if (err == nil) != tt.ok {
+				t.Errorf("verifyPins = %v, want ok %t", err, tt.ok)
+			}
+		})
+	}
+}
+
+// answer returns a response to query with an A record for its name.
+func answer(query *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	}}
+	return resp
+}
+
+func TestDotConnMultiplexing(t *testing.T) {
+	client, server := net.Pipe()
+	c := newDotConn(client)
+	defer c.close(errors.New("done"))
+
+	names := []string{"a.example.", "b.example.", "c.example.", "d.example."}
+
+	// The server answers once it has all queries, in reverse order
+	serverErr := make(chan error, 1)
+	go func() {
+		conn := &dns.Conn{Conn: server}
+		var queries []*dns.Msg
+		ids := make(map[uint16]bool)
+		for range names {
+			query, err := conn.ReadMsg()
+			if err != nil {
+				serverErr <- err
+				return
+			}
+			if ids[query.Id] {
+				serverErr <- errors.New("message id used twice")
+				return
+			}
+			ids[query.Id] = true
+			queries = append(queries, query)
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			if err := conn.WriteMsg(answer(queries[i])); err != nil {
+				serverErr <- err
+				return
+			}
+		}
+		serverErr <- nil
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Every query has the same id, as those of different clients may
+			msg := new(dns.Msg)
+			msg.SetQuestion(name, dns.TypeA)
+			msg.Id = 1234
+
+			resp, err := c.exchange(ctx, msg)
+			if err != nil {
+				t.Errorf("%s: %s", name, err)
+				return
+			}
+			if resp.Id != 1234 {
+				t.Errorf("%s: response id = %d, want the query's", name, resp.Id)
+			}
+			if got := resp.Answer[0].Header().Name; got != name {
+				t.Errorf("%s: got the answer for %s", name, got)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDotConnClosed(t *testing.T) {
+	client, server := net.Pipe()
+	c := newDotConn(client)
+
+	go func() {
+		conn := &dns.Conn{Conn: server}
+		_, _ = conn.ReadMsg()
+		_ = server.Close()
+	}()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := c.exchange(context.Background(), msg); !errors.Is(err, errConnClosed) {
+		t.Errorf("exchange = %v, want errConnClosed", err)
+	}
+	if !c.closed() {
+		t.Error("connection is not closed")
+	}
+	if _, err := c.exchange(context.Background(), msg); !errors.Is(err, errConnClosed) {
+		t.Errorf("exchange on a closed connection = %v, want errConnClosed", err)
+	}
+}
+
+func TestDotConnMaxPending(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() {
+		_ = server.Close()
+	}()
+	c := newDotConn(client)
+	defer c.close(errors.New("done"))
+
+	var ids []uint16
+	for range dotMaxPending {
+		id, _, err := c.register()
+		if err != nil {
+			t.Fatalf("register with %d pending queries: %s", len(ids), err)
+		}
+		ids = append(ids, id)
+	}
+
+	if _, _, err := c.register(); !errors.Is(err, errTooManyQueries) {
+		t.Fatalf("register beyond the limit = %v, want errTooManyQueries", err)
+	}
+
+	c.unregister(ids[0])
+	if _, _, err := c.register(); err != nil {
+		t.Errorf("register after a query was done: %s", err)
+	}
+}
+
+// startDoTServer runs a DoT server with cert, which answers every query,
+// and returns its address and the number of connections it accepted.
+func startDoTServer(t *testing.T, cert tls.Certificate) (string, *atomic.Int32) {
+	t.Helper()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				dnsConn := &dns.Conn{Conn: conn}
+				for {
+					query, err := dnsConn.ReadMsg()
+					if err != nil {
+						return
+					}
+					if err := dnsConn.WriteMsg(answer(query)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), &accepted
+}
+
+func TestDOTResolverSingleDial(t *testing.T) {
+	cert := newTestCert(t, "dot", nil)
+	addr, accepted := startDoTServer(t, cert)
+	r := NewDOTResolver(addr, "", [][]byte{pinOf(cert)}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			if _, err := r.Exchange(ctx, msg); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("server accepted %d connections, want 1", n)
+	}
+}
+
+func TestDOTResolverWrongPin(t *testing.T) {
+	cert := newTestCert(t, "dot", nil)
+	addr, _ := startDoTServer(t, cert)
+	r := NewDOTResolver(addr, "", [][]byte{make([]byte, sha256.Size)}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := r.Exchange(ctx, msg); err == nil {
+		t.Error("exchange with a server that does not match the pin succeeded")
+	}
+}
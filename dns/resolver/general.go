@@ -9,15 +9,23 @@ import (
 )
 
 type GeneralResolver struct {
-	client *dns.Client
-	server string
+	client    *dns.Client
+	tcpClient *dns.Client
+	server    string
+	poison    *PoisonGuard
+	cache     *Cache
 }
 
-// NewGeneralResolver creates a new GeneralResolver instance.
-func NewGeneralResolver(server string) *GeneralResolver {
+// NewGeneralResolver creates a new GeneralResolver instance that discards
+// poisoned answers with poison and keeps its answers in cache, both of
+// which may be nil.
+func NewGeneralResolver(server string, poison *PoisonGuard, cache *Cache) *GeneralResolver {
 	return &GeneralResolver{
-		client: &dns.Client{},
-		server: server,
+		client:    &dns.Client{},
+		tcpClient: &dns.Client{Net: "tcp"},
+		server:    server,
+		poison:    poison,
+		cache:     cache,
 	}
 }
 
@@ -28,12 +36,37 @@ func (r *GeneralResolver) String() string {
 
 // Resolve performs a DNS lookup for the given host and returns the IP addresses.
 func (r *GeneralResolver) Resolve(ctx context.Context, host string, qTypes []uint16) ([]net.IPAddr, error) {
-	resultCh := lookupAllTypes(ctx, host, qTypes, r.exchange)
+	resultCh := lookupAllTypes(ctx, host, qTypes, r.Exchange)
 	return processResults(ctx, resultCh)
 }
 
-// exchange sends a DNS query to the server and returns the response.
-func (r *GeneralResolver) exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
-	resp, _, err := r.client.Exchange(msg, r.server)
-	return resp, err
+// Exchange sends a DNS query to the server, or answers it from the cache,
+// and returns the response.
+func (r *GeneralResolver) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	return r.cache.wrap(r.String(), r.exchange)(ctx, msg)
+}
+
+// exchange sends a DNS query to the server and returns the response. A
+// truncated response over udp is retried over tcp.
+func (r *GeneralResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	var (
+		resp *dns.Msg
+		err  error
+	)
+	if r.poison != nil {
+		resp, err = r.poison.exchangeUDP(ctx, r.client, msg, r.server)
+	} else {
+		resp, _, err = r.client.ExchangeContext(ctx, msg, r.server)
+	}
+
+	if err == nil && resp.Truncated {
+		resp, _, err = r.tcpClient.ExchangeContext(ctx, msg, r.server)
+		if err == nil {
+			err = r.poison.check(ctx, msg, resp)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
@@ -0,0 +1,242 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bariiss/SpoofDPI/util"
+	"github.com/bariiss/SpoofDPI/util/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// upstreamTimeout limits a query to a single upstream of a group when the
+	// lookup itself has no deadline.
+	upstreamTimeout = 2 * time.Second
+	// maxFailures is the number of failures in a row after which an upstream
+	// is skipped for a while.
+	maxFailures = 3
+	// downTime is how long an upstream that keeps failing is skipped.
+	downTime = 30 * time.Second
+)
+
+// Upstream is a dns server a Group sends queries to.
+type Upstream interface {
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+	String() string
+}
+
+// member is an upstream of a group along with its health.
+type member struct {
+	Upstream
+
+	mu        sync.Mutex
+	failures  int
+	downUntil time.Time
+}
+
+// healthy reports whether the upstream is not being skipped.
+func (m *member) healthy(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return !now.Before(m.downUntil)
+}
+
+// succeed resets the failures of the upstream.
+func (m *member) succeed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures = 0
+}
+
+// fail counts a failure of the upstream, and reports whether it is skipped
+// from now on.
+func (m *member) fail() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.failures++
+	if m.failures < maxFailures {
+		return false
+	}
+	m.failures = 0
+	m.downUntil = time.Now().Add(downTime)
+	return true
+}
+
+// Group sends queries to a list of upstreams with one of the strategies:
+// failover tries them in order until one answers, race queries all of them
+// at once and takes the first answer, and round-robin is failover starting
+// at the next upstream for every query. An upstream that fails several times
+// in a row is skipped for a while, unless all of them are.
+type Group struct {
+	strategy string
+	members  []*member
+	next     atomic.Uint32
+}
+
+// NewGroup creates a Group that queries upstreams with strategy.
+func NewGroup(strategy string, upstreams []Upstream) *Group {
+	g := &Group{strategy: strategy}
+	for _, upstream := range upstreams {
+		g.members = append(g.members, &member{Upstream: upstream})
+	}
+	return g
+}
+
+// String returns a string representation of the Group.
+func (g *Group) String() string {
+	names := make([]string, 0, len(g.members))
+	for _, m := range g.members {
+		names = append(names, m.String())
+	}
+	return fmt.Sprintf("%s group(%s)", g.strategy, strings.Join(names, ", "))
+}
+
+// Resolve performs a DNS lookup for the given host and returns the IP addresses.
+func (g *Group) Resolve(ctx context.Context, host string, qTypes []uint16) ([]net.IPAddr, error) {
+	resultCh := lookupAllTypes(ctx, host, qTypes, g.Exchange)
+	return processResults(ctx, resultCh)
+}
+
+// Exchange sends a DNS query to the upstreams according to the strategy and
+// returns the first valid response. If every upstream fails, the last
+// response is returned, or an error if none responded.
+func (g *Group) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	members := g.candidates()
+	if g.strategy == util.StrategyRace {
+		return g.race(ctx, msg, members)
+	}
+	return g.failover(ctx, msg, members)
+}
+
+// candidates returns the healthy upstreams in the order they are tried, or
+// all of them if none is healthy.
+func (g *Group) candidates() []*member {
+	members := g.members
+	if g.strategy == util.StrategyRoundRobin && len(members) > 1 {
+		start := int(g.next.Add(1)-1) % len(members)
+		members = append(members[start:len(members):len(members)], members[:start]...)
+	}
+
+	now := time.Now()
+	healthy := make([]*member, 0, len(members))
+	for _, m := range members {
+		if m.healthy(now) {
+			healthy = append(healthy, m)
+		}
+	}
+	if len(healthy) == 0 {
+		return members
+	}
+	return healthy
+}
+
+// failover tries the upstreams in order. Each gets an equal share of the
+// time left, so that a slow upstream leaves time for the next ones.
+func (g *Group) failover(ctx context.Context, msg *dns.Msg, members []*member) (*dns.Msg, error) {
+	var (
+		last *dns.Msg
+		errs []error
+	)
+
+	for i, m := range members {
+		attemptCtx, cancel := attemptContext(ctx, len(members)-i)
+		resp, err := m.Exchange(attemptCtx, msg)
+		cancel()
+
+		if g.record(ctx, m, resp, err) {
+			return resp, nil
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", m, err))
+		} else {
+			last = resp
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if last != nil {
+		return last, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// race queries all upstreams at once and returns the first valid response.
+// The queries still running are canceled then.
+func (g *Group) race(ctx context.Context, msg *dns.Msg, members []*member) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		m    *member
+		resp *dns.Msg
+		err  error
+	}
+
+	resultCh := make(chan result, len(members))
+	for _, m := range members {
+		go func() {
+			resp, err := m.Exchange(ctx, msg)
+			resultCh <- result{m: m, resp: resp, err: err}
+		}()
+	}
+
+	var (
+		last *dns.Msg
+		errs []error
+	)
+	for range members {
+		r := <-resultCh
+		if g.record(ctx, r.m, r.resp, r.err) {
+			return r.resp, nil
+		}
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.m, r.err))
+		} else {
+			last = r.resp
+		}
+	}
+
+	if last != nil {
+		return last, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// record updates the health of an upstream with the outcome of a query and
+// reports whether the response is valid. Queries that failed because ctx
+// was done are not held against the upstream.
+func (g *Group) record(ctx context.Context, m *member, resp *dns.Msg, err error) bool {
+	if err == nil && (resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError) {
+		m.succeed()
+		return true
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if m.fail() {
+		logger := log.GetCtxLogger(ctx)
+		logger.Warn().Msgf("%s failed %d times in a row, skipping it for %s", m, maxFailures, downTime)
+	}
+	return false
+}
+
+// attemptContext returns the context of a query to one of the left
+// upstreams, limited to an equal share of the time left.
+func attemptContext(ctx context.Context, left int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithTimeout(ctx, upstreamTimeout)
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(left))
+}
@@ -0,0 +1,279 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bariiss/SpoofDPI/util"
+	"github.com/miekg/dns"
+)
+
+// groupUpstream is an upstream of a group that answers with rcode, fails
+// with err, or waits for the query to be canceled if slow is set.
+type groupUpstream struct {
+	name    string
+	rcode   atomic.Int32
+	err     error
+	slow    bool
+	queries atomic.Int32
+}
+
+func (u *groupUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	u.queries.Add(1)
+	if u.slow {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if u.err != nil {
+		return nil, u.err
+	}
+
+	resp := new(dns.Msg)
+	resp.SetRcode(msg, int(u.rcode.Load()))
+	resp.Ns = []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: "upstream.", Rrtype: dns.TypeTXT}, Txt: []string{u.name}}}
+	return resp, nil
+}
+
+func (u *groupUpstream) String() string {
+	return u.name
+}
+
+// answeredBy returns the name of the upstream that sent resp.
+func answeredBy(resp *dns.Msg) string {
+	return resp.Ns[0].(*dns.TXT).Txt[0]
+}
+
+// exchangeGroup sends a query through g.
+func exchangeGroup(g *Group) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	return g.Exchange(ctx, msg)
+}
+
+func newServfail(name string) *groupUpstream {
+	u := &groupUpstream{name: name}
+	u.rcode.Store(dns.RcodeServerFailure)
+	return u
+}
+
+func TestGroupFailover(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstreams []*groupUpstream
+		want      string
+		wantErr   bool
+	}{
+		{
+			name:      "first answers",
+			upstreams: []*groupUpstream{{name: "a"}, {name: "b"}},
+			want:      "a",
+		},
+		{
+			name:      "error",
+			upstreams: []*groupUpstream{{name: "a", err: errors.New("refused")}, {name: "b"}},
+			want:      "b",
+		},
+		{
+			name:      "servfail",
+			upstreams: []*groupUpstream{newServfail("a"), {name: "b"}},
+			want:      "b",
+		},
+		{
+			name:      "all servfail",
+			upstreams: []*groupUpstream{newServfail("a"), newServfail("b")},
+			want:      "b",
+		},
+		{
+			name:      "all fail",
+			upstreams: []*groupUpstream{{name: "a", err: errors.New("refused")}, {name: "b", err: errors.New("refused")}},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreams := make([]Upstream, 0, len(tt.upstreams))
+			for _, u := range tt.upstreams {
+				upstreams = append(upstreams, u)
+			}
+
+			resp, err := exchangeGroup(NewGroup(util.StrategyFailover, upstreams))
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "a: refused") || !strings.Contains(err.Error(), "b: refused") {
+					t.Errorf("error = %v, want the errors of all upstreams", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := answeredBy(resp); got != tt.want {
+				t.Errorf("answered by %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupNXDomain(t *testing.T) {
+	a, b := &groupUpstream{name: "a"}, &groupUpstream{name: "b"}
+	a.rcode.Store(dns.RcodeNameError)
+
+	resp, err := exchangeGroup(NewGroup(util.StrategyFailover, []Upstream{a, b}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeNameError || b.queries.Load() != 0 {
+		t.Error("NXDOMAIN is not taken as an answer")
+	}
+}
+
+func TestGroupFailoverSlow(t *testing.T) {
+	slow, fast := &groupUpstream{name: "slow", slow: true}, &groupUpstream{name: "fast"}
+	g := NewGroup(util.StrategyFailover, []Upstream{slow, fast})
+
+	// The slow upstream gets half of the time, leaving the rest to the next
+	resp, err := exchangeGroup(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := answeredBy(resp); got != "fast" {
+		t.Errorf("answered by %s, want fast", got)
+	}
+}
+
+func TestGroupRace(t *testing.T) {
+	slow, fast := &groupUpstream{name: "slow", slow: true}, &groupUpstream{name: "fast"}
+	g := NewGroup(util.StrategyRace, []Upstream{slow, fast})
+
+	start := time.Now()
+	resp, err := exchangeGroup(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := answeredBy(resp); got != "fast" {
+		t.Errorf("answered by %s, want fast", got)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("race waited %s for the slow upstream", elapsed)
+	}
+}
+
+func TestGroupRaceAllFail(t *testing.T) {
+	g := NewGroup(util.StrategyRace, []Upstream{newServfail("a"), newServfail("b")})
+
+	resp, err := exchangeGroup(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode = %s, want the last SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestGroupRoundRobin(t *testing.T) {
+	g := NewGroup(util.StrategyRoundRobin, []Upstream{
+		&groupUpstream{name: "a"}, &groupUpstream{name: "b"}, &groupUpstream{name: "c"},
+	})
+
+	var got []string
+	for range 4 {
+		resp, err := exchangeGroup(g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, answeredBy(resp))
+	}
+	if want := "a b c a"; strings.Join(got, " ") != want {
+		t.Errorf("answered by %q, want %q", got, want)
+	}
+}
+
+func TestGroupHealth(t *testing.T) {
+	down, up := &groupUpstream{name: "down", err: errors.New("refused")}, &groupUpstream{name: "up"}
+	g := NewGroup(util.StrategyFailover, []Upstream{down, up})
+
+	for range maxFailures {
+		if _, err := exchangeGroup(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := down.queries.Load(); n != maxFailures {
+		t.Fatalf("failing upstream got %d queries, want %d", n, maxFailures)
+	}
+
+	// It is skipped after failing maxFailures times in a row
+	if _, err := exchangeGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	if n := down.queries.Load(); n != maxFailures {
+		t.Errorf("failing upstream got %d queries, want it skipped", n)
+	}
+
+	// Once it is due again, it is tried first
+	g.members[0].mu.Lock()
+	g.members[0].downUntil = time.Now()
+	g.members[0].mu.Unlock()
+	if _, err := exchangeGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	if n := down.queries.Load(); n != maxFailures+1 {
+		t.Errorf("failing upstream got %d queries, want it tried again", n)
+	}
+}
+
+func TestGroupAllDown(t *testing.T) {
+	a, b := newServfail("a"), newServfail("b")
+	g := NewGroup(util.StrategyFailover, []Upstream{a, b})
+
+	for range maxFailures + 1 {
+		if _, err := exchangeGroup(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Both are down, so both are still tried rather than none
+	if a.queries.Load() != maxFailures+1 || b.queries.Load() != maxFailures+1 {
+		t.Errorf("upstreams got %d and %d queries, want %d each", a.queries.Load(), b.queries.Load(), maxFailures+1)
+	}
+}
+
+func TestGroupCanceled(t *testing.T) {
+	slow := &groupUpstream{name: "slow", slow: true}
+	g := NewGroup(util.StrategyFailover, []Upstream{slow})
+
+	for range maxFailures + 1 {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		_, _ = g.Exchange(ctx, msg)
+		cancel()
+	}
+
+	// Lookups that ran out of time are not held against the upstream
+	if !g.members[0].healthy(time.Now()) {
+		t.Error("upstream is skipped after lookups timed out")
+	}
+}
+
+func TestAttemptContext(t *testing.T) {
+	ctx, cancel := attemptContext(context.Background(), 3)
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > upstreamTimeout {
+		t.Errorf("attempt without deadline is not limited to %s", upstreamTimeout)
+	}
+
+	parent, cancelParent := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancelParent()
+	ctx, cancel = attemptContext(parent, 3)
+	defer cancel()
+	if deadline, _ := ctx.Deadline(); time.Until(deadline) > time.Second {
+		t.Errorf("attempt got %s, want a third of the time left", time.Until(deadline))
+	}
+}
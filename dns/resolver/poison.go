@@ -0,0 +1,228 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bariiss/SpoofDPI/util/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// poisonUDPTimeout limits a udp query without a deadline, like the
+	// default timeout of dns.Client.
+	poisonUDPTimeout = 2 * time.Second
+	// maxPoisonedDomains bounds the number of domains counted separately.
+	maxPoisonedDomains = 1024
+	// otherPoisonedDomains counts the domains beyond maxPoisonedDomains.
+	otherPoisonedDomains = "*"
+)
+
+var errBogusAnswer = errors.New("only bogus answers received")
+
+// PoisonCounter counts the poisoned answers detected per domain. It outlives
+// the resolvers, which are replaced on reload.
+type PoisonCounter struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+// NewPoisonCounter creates an empty PoisonCounter.
+func NewPoisonCounter() *PoisonCounter {
+	return &PoisonCounter{counts: make(map[string]uint64)}
+}
+
+// add counts a poisoned answer for domain.
+func (c *PoisonCounter) add(domain string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.counts[domain]; !ok && len(c.counts) >= maxPoisonedDomains {
+		domain = otherPoisonedDomains
+	}
+	c.counts[domain]++
+}
+
+// Snapshot returns a copy of the counts.
+func (c *PoisonCounter) Snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.counts)
+}
+
+// PoisonGuard detects poisoned answers of plain dns servers. Answers with a
+// bogus address, such as the sinkhole of a blocking ISP, are discarded. Over
+// udp, the guard also keeps listening for a while after the first answer: a
+// different second answer means the first one was injected by a middlebox,
+// as injected answers arrive before the real one.
+//
+// A nil PoisonGuard is valid and detects nothing.
+type PoisonGuard struct {
+	bogus   []netip.Prefix
+	wait    time.Duration
+	counter *PoisonCounter
+}
+
+// NewPoisonGuard creates a PoisonGuard that discards answers with addresses
+// in bogus and waits up to wait for a second udp answer, counting what it
+// detects in counter. It returns nil if there is nothing to detect.
+func NewPoisonGuard(bogus []netip.Prefix, wait time.Duration, counter *PoisonCounter) *PoisonGuard {
+	if len(bogus) == 0 && wait <= 0 {
+		return nil
+	}
+	return &PoisonGuard{bogus: bogus, wait: wait, counter: counter}
+}
+
+// exchangeUDP sends msg to server over udp and returns the answer that is
+// neither bogus nor injected, reading every answer until the wait after
+// the first one is over.
+func (g *PoisonGuard) exchangeUDP(ctx context.Context, client *dns.Client, msg *dns.Msg, server string) (*dns.Msg, error) {
+	conn, err := client.DialContext(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if opt := msg.IsEdns0(); opt != nil {
+		conn.UDPSize = max(opt.UDPSize(), dns.MinMsgSize)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(poisonUDPTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if err := conn.WriteMsg(msg); err != nil {
+		return nil, err
+	}
+
+	var (
+		answer *dns.Msg
+		bogus  bool
+	)
+	for {
+		resp, err := conn.ReadMsg()
+		var netErr net.Error
+		switch {
+		case err != nil && !errors.As(err, &netErr):
+			// Not a dns message, or a malformed one
+			continue
+		case err != nil && answer != nil:
+			return answer, nil
+		case err != nil && bogus && ctx.Err() == nil:
+			return nil, errBogusAnswer
+		case err != nil:
+			return nil, err
+		case resp.Id != msg.Id:
+			continue
+		}
+
+		// The real answer, if any, follows soon after a bogus one
+		if g.isBogus(ctx, msg, resp) {
+			if !bogus && answer == nil {
+				g.waitFor(conn, deadline)
+			}
+			bogus = true
+			continue
+		}
+
+		if answer == nil {
+			answer = resp
+			if g.wait <= 0 {
+				return answer, nil
+			}
+			g.waitFor(conn, deadline)
+			continue
+		}
+
+		if answerKey(resp) != answerKey(answer) {
+			g.detected(ctx, msg, "two different answers, the first one is taken as injected")
+			return resp, nil
+		}
+	}
+}
+
+// waitFor limits the next reads on conn to the wait, if it ends before
+// deadline.
+func (g *PoisonGuard) waitFor(conn *dns.Conn, deadline time.Time) {
+	if waitUntil := time.Now().Add(g.wait); g.wait > 0 && waitUntil.Before(deadline) {
+		_ = conn.SetReadDeadline(waitUntil)
+	}
+}
+
+// check returns an error if resp, received over tcp, has a bogus address.
+func (g *PoisonGuard) check(ctx context.Context, msg, resp *dns.Msg) error {
+	if g != nil && g.isBogus(ctx, msg, resp) {
+		return errBogusAnswer
+	}
+	return nil
+}
+
+// isBogus reports, and counts, whether resp has an address in the bogus
+// ranges.
+func (g *PoisonGuard) isBogus(ctx context.Context, msg, resp *dns.Msg) bool {
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		if slices.ContainsFunc(g.bogus, func(prefix netip.Prefix) bool {
+			return prefix.Contains(addr)
+		}) {
+			g.detected(ctx, msg, fmt.Sprintf("bogus address %s", addr))
+			return true
+		}
+	}
+	return false
+}
+
+// detected logs and counts a poisoned answer to msg.
+func (g *PoisonGuard) detected(ctx context.Context, msg *dns.Msg, reason string) {
+	domain := strings.ToLower(strings.TrimSuffix(msg.Question[0].Name, "."))
+
+	logger := log.GetCtxLogger(ctx)
+	logger.Warn().Msgf("possible dns poisoning of %s (%s): %s", domain, recordTypeIDToName(msg.Question[0].Qtype), reason)
+	if g.counter != nil {
+		g.counter.add(domain)
+	}
+}
+
+// answerKey returns the rcode and records of the answer section of msg,
+// without their TTLs and in a fixed order, so that two answers with the
+// same content have the same key.
+func answerKey(msg *dns.Msg) string {
+	records := make([]string, 0, len(msg.Answer))
+	for _, rr := range msg.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		records = append(records, rr.String())
+	}
+	slices.Sort(records)
+	return dns.RcodeToString[msg.Rcode] + "\n" + strings.Join(records, "\n")
+}
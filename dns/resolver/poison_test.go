@@ -0,0 +1,265 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// udpReply is a datagram a fake udp server sends after delay.
+type udpReply struct {
+	delay time.Duration
+	msg   *dns.Msg
+	raw   []byte
+}
+
+// startUDPServer runs a dns server on udp that answers every query with the
+// replies of script, and returns its address.
+func startUDPServer(t *testing.T, script func(query *dns.Msg) []udpReply) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := new(dns.Msg)
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+
+			go func() {
+				for _, reply := range script(query) {
+					time.Sleep(reply.delay)
+					raw := reply.raw
+					if reply.msg != nil {
+						raw, _ = reply.msg.Pack()
+					}
+					_, _ = conn.WriteTo(raw, addr)
+				}
+			}()
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// aReply returns a response to query with A records of addrs.
+func aReply(query *dns.Msg, ttl uint32, addrs ...string) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	for _, addr := range addrs {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.ParseIP(addr),
+		})
+	}
+	return resp
+}
+
+var testBogus = []netip.Prefix{netip.MustParsePrefix("10.10.34.0/24")}
+
+func TestPoisonGuardExchangeUDP(t *testing.T) {
+	tests := []struct {
+		name    string
+		wait    time.Duration
+		script  func(query *dns.Msg) []udpReply
+		want    string
+		wantErr error
+		counted bool
+	}{
+		{
+			name: "single answer",
+			script: func(query *dns.Msg) []udpReply {
+				return []udpReply{{msg: aReply(query, 60, "192.0.2.1")}}
+			},
+			want: "192.0.2.1",
+		},
+		{
+			name: "bogus before the real answer",
+			script: func(query *dns.Msg) []udpReply {
+				return []udpReply{
+					{msg: aReply(query, 60, "10.10.34.34")},
+					{delay: 20 * time.Millisecond, msg: aReply(query, 60, "192.0.2.1")},
+				}
+			},
+			want:    "192.0.2.1",
+			counted: true,
+		},
+		{
+			name: "only bogus",
+			wait: 100 * time.Millisecond,
+			script: func(query *dns.Msg) []udpReply {
+				return []udpReply{{msg: aReply(query, 60, "10.10.34.34")}}
+			},
+			wantErr: errBogusAnswer,
+			counted: true,
+		},
+		{
+			name: "injected answer",
+			wait: 200 * time.Millisecond,
+			script: func(query *dns.Msg) []udpReply {
+				return []udpReply{
+					{msg: aReply(query, 60, "198.51.100.1")},
+					{delay: 20 * time.Millisecond, msg: aReply(query, 60, "192.0.2.1")},
+				}
+			},
+			want:    "192.0.2.1",
+			counted: true,
+		},
+		{
+			name: "same answer twice",
+			wait: 200 * time.Millisecond,
+			script: func(query *dns.Msg) []udpReply {
+				return []udpReply{
+					{msg: aReply(query, 60, "192.0.2.1", "192.0.2.2")},
+					{delay: 20 * time.Millisecond, msg: aReply(query, 30, "192.0.2.2", "192.0.2.1")},
+				}
+			},
+			want: "192.0.2.1",
+		},
+		{
+			name: "junk and other ids",
+			script: func(query *dns.Msg) []udpReply {
+				other := aReply(query, 60, "198.51.100.1")
+				other.Id = query.Id + 1
+				return []udpReply{
+					{raw: []byte("junk")},
+					{msg: other},
+					{msg: aReply(query, 60, "192.0.2.1")},
+				}
+			},
+			want: "192.0.2.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startUDPServer(t, tt.script)
+			counter := NewPoisonCounter()
+			g := NewPoisonGuard(testBogus, tt.wait, counter)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			msg := new(dns.Msg)
+			msg.SetQuestion("Example.com.", dns.TypeA)
+			resp, err := g.exchangeUDP(ctx, &dns.Client{}, msg, server)
+
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("exchangeUDP = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if got := resp.Answer[0].(*dns.A).A.String(); got != tt.want {
+				t.Errorf("answer = %s, want %s", got, tt.want)
+			}
+
+			counts := counter.Snapshot()
+			if counted := counts["example.com"] == 1; counted != tt.counted || len(counts) > 1 {
+				t.Errorf("counts = %v, want counted %t", counts, tt.counted)
+			}
+		})
+	}
+}
+
+func TestPoisonGuardTimeout(t *testing.T) {
+	server := startUDPServer(t, func(*dns.Msg) []udpReply { return nil })
+	g := NewPoisonGuard(testBogus, 0, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	var netErr net.Error
+	if _, err := g.exchangeUDP(ctx, &dns.Client{}, msg, server); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("exchangeUDP = %v, want a timeout", err)
+	}
+}
+
+func TestPoisonGuardCheck(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	g := NewPoisonGuard(testBogus, 0, nil)
+	if err := g.check(context.Background(), msg, aReply(msg, 60, "10.10.34.34")); !errors.Is(err, errBogusAnswer) {
+		t.Errorf("check of a bogus answer = %v", err)
+	}
+	if err := g.check(context.Background(), msg, aReply(msg, 60, "192.0.2.1")); err != nil {
+		t.Errorf("check of a real answer = %v", err)
+	}
+
+	// IPv4-mapped addresses are bogus as well
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	resp.Answer = []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeAAAA}, AAAA: net.ParseIP("::ffff:10.10.34.34")}}
+	if err := g.check(context.Background(), msg, resp); !errors.Is(err, errBogusAnswer) {
+		t.Errorf("check of a mapped bogus answer = %v", err)
+	}
+
+	var none *PoisonGuard
+	if err := none.check(context.Background(), msg, aReply(msg, 60, "10.10.34.34")); err != nil {
+		t.Errorf("check of a nil guard = %v", err)
+	}
+	if NewPoisonGuard(nil, 0, nil) != nil {
+		t.Error("guard without bogus ranges and wait is not nil")
+	}
+}
+
+func TestAnswerKey(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+
+	a := aReply(query, 60, "192.0.2.1", "192.0.2.2")
+	b := aReply(query, 10, "192.0.2.2", "192.0.2.1")
+	if answerKey(a) != answerKey(b) {
+		t.Error("answers differing in TTL and order have different keys")
+	}
+
+	c := aReply(query, 60, "192.0.2.1")
+	if answerKey(a) == answerKey(c) {
+		t.Error("answers with different records have the same key")
+	}
+
+	d := aReply(query, 60, "192.0.2.1", "192.0.2.2")
+	d.Rcode = dns.RcodeServerFailure
+	if answerKey(a) == answerKey(d) {
+		t.Error("answers with different rcodes have the same key")
+	}
+}
+
+func TestPoisonCounterCap(t *testing.T) {
+	c := NewPoisonCounter()
+	for i := range maxPoisonedDomains + 5 {
+		c.add(fmt.Sprintf("d%d.example", i))
+	}
+	c.add("d0.example")
+
+	counts := c.Snapshot()
+	if len(counts) != maxPoisonedDomains+1 {
+		t.Errorf("%d domains counted, want %d", len(counts), maxPoisonedDomains+1)
+	}
+	if counts[otherPoisonedDomains] != 5 {
+		t.Errorf("other domains = %d, want 5", counts[otherPoisonedDomains])
+	}
+	if counts["d0.example"] != 2 {
+		t.Errorf("d0.example = %d, want 2", counts["d0.example"])
+	}
+}
@@ -81,6 +81,12 @@ func lookupType(ctx context.Context, host string, qType uint16, exchange exchang
 		err = fmt.Errorf("resolving %s (%s): %w", host, recordTypeIDToName(qType), err)
 		return &DNSResult{err: err}
 	}
+
+	// NXDOMAIN simply resolves to no addresses
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		err = fmt.Errorf("resolving %s (%s): %s", host, recordTypeIDToName(qType), dns.RcodeToString[resp.Rcode])
+		return &DNSResult{err: err}
+	}
 	return &DNSResult{msg: resp}
 }
 
@@ -2,17 +2,31 @@ package resolver
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"strings"
+
+	"github.com/miekg/dns"
 )
 
+// resolvConf is the file listing the system's name servers on unix.
+const resolvConf = "/etc/resolv.conf"
+
+// systemAnswerTTL is the TTL of answers made up from the system resolver,
+// which does not tell how long they are valid.
+const systemAnswerTTL = 30
+
 type SystemResolver struct {
 	*net.Resolver
+	client *dns.Client
 }
 
 // NewSystemResolver creates a new SystemResolver instance using Go's built-in resolver.
 func NewSystemResolver() *SystemResolver {
 	return &SystemResolver{
 		Resolver: &net.Resolver{PreferGo: true},
+		client:   &dns.Client{},
 	}
 }
 
@@ -29,3 +43,60 @@ func (r *SystemResolver) Resolve(ctx context.Context, host string, _ []uint16) (
 	}
 	return addrs, nil
 }
+
+// Exchange answers a DNS query. A and AAAA queries are answered through the
+// built-in resolver, so that the hosts file is honored, and other types are
+// sent to the first name server of resolv.conf.
+func (r *SystemResolver) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if len(msg.Question) != 1 {
+		return nil, errors.New("expected exactly one question")
+	}
+
+	q := msg.Question[0]
+	if q.Qclass == dns.ClassINET && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		return r.lookupIP(ctx, msg)
+	}
+
+	config, err := dns.ClientConfigFromFile(resolvConf)
+	if err != nil || len(config.Servers) == 0 {
+		return nil, fmt.Errorf("%s queries are not supported by the system resolver", recordTypeIDToName(q.Qtype))
+	}
+
+	server := net.JoinHostPort(config.Servers[0], config.Port)
+	resp, _, err := r.client.ExchangeContext(ctx, msg, server)
+	if err == nil && resp.Truncated {
+		tcpClient := &dns.Client{Net: "tcp"}
+		resp, _, err = tcpClient.ExchangeContext(ctx, msg, server)
+	}
+	return resp, err
+}
+
+// lookupIP answers an A or AAAA query. Names without addresses of the type
+// are answered with no records rather than NXDOMAIN, as the built-in
+// resolver does not tell the two apart.
+func (r *SystemResolver) lookupIP(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	q := msg.Question[0]
+	network := "ip4"
+	if q.Qtype == dns.TypeAAAA {
+		network = "ip6"
+	}
+
+	addrs, err := r.LookupNetIP(ctx, network, strings.TrimSuffix(q.Name, "."))
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	resp.RecursionAvailable = true
+	for _, addr := range addrs {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: systemAnswerTTL}
+		if q.Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: addr.Unmap().AsSlice()})
+		} else {
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,200 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/bariiss/SpoofDPI/util"
+	"github.com/bariiss/SpoofDPI/util/log"
+	"github.com/miekg/dns"
+)
+
+const scopeDNSServer = "DNS-SERVER"
+
+// serverUDPSize is the EDNS0 udp payload size the server advertises and
+// asks upstreams for, as recommended by DNS Flag Day 2020.
+const serverUDPSize = 1232
+
+// resolvConf is the file listing the system's name servers on unix.
+const resolvConf = "/etc/resolv.conf"
+
+// ExchangeFunc answers a DNS query.
+type ExchangeFunc func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+
+// Server is a DNS server for the local machine that answers queries of any
+// type through an ExchangeFunc.
+type Server struct {
+	exchange ExchangeFunc
+}
+
+// NewServer creates a DNS server that answers queries with exchange.
+func NewServer(exchange ExchangeFunc) *Server {
+	return &Server{exchange: exchange}
+}
+
+// Serve serves DNS over udp on pc and over tcp on l until ctx is done.
+// Either may be nil.
+func (s *Server) Serve(ctx context.Context, pc net.PacketConn, l net.Listener) {
+	ctx = util.GetCtxWithScope(ctx, scopeDNSServer)
+	logger := log.GetCtxLogger(ctx)
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		s.serveDNS(ctx, w, req)
+	})
+
+	var servers []*dns.Server
+	if pc != nil {
+		servers = append(servers, &dns.Server{PacketConn: pc, Handler: handler})
+		logger.Info().Msgf("dns server is listening on udp %s", pc.LocalAddr())
+	}
+	if l != nil {
+		servers = append(servers, &dns.Server{Listener: l, Handler: handler})
+		logger.Info().Msgf("dns server is listening on tcp %s", l.Addr())
+	}
+
+	for _, srv := range servers {
+		go func() {
+			<-ctx.Done()
+			_ = srv.Shutdown()
+		}()
+
+		go func() {
+			if err := srv.ActivateAndServe(); err != nil && ctx.Err() == nil {
+				logger.Error().Msgf("error serving dns: %s", err)
+			}
+		}()
+	}
+}
+
+// serveDNS answers a single query.
+func (s *Server) serveDNS(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+	ctx = util.GetCtxWithTraceId(ctx)
+	logger := log.GetCtxLogger(ctx)
+
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	if err := w.WriteMsg(s.respond(ctx, req, udp)); err != nil {
+		logger.Debug().Msgf("error writing dns response: %s", err)
+	}
+}
+
+// respond returns the response to req with an EDNS0 record if req had one.
+// Responses over udp are truncated to fit the client's buffer.
+func (s *Server) respond(ctx context.Context, req *dns.Msg, udp bool) *dns.Msg {
+	logger := log.GetCtxLogger(ctx)
+
+	resp, err := s.answer(ctx, req)
+	if err != nil {
+		logger.Debug().Msgf("error answering %s: %s", questionString(req), err)
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		resp.RecursionAvailable = true
+	}
+
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(serverUDPSize, opt.Do())
+		size = max(size, int(min(opt.UDPSize(), serverUDPSize)))
+	}
+	if udp {
+		resp.Truncate(size)
+	}
+	return resp
+}
+
+// answer resolves req and returns the response for the client, without an
+// EDNS0 record.
+func (s *Server) answer(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if req.Opcode != dns.OpcodeQuery {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeNotImplemented)
+		return resp, nil
+	}
+	if len(req.Question) != 1 {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeFormatError)
+		return resp, nil
+	}
+
+	if opt := req.IsEdns0(); opt != nil && opt.Version() != 0 {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeBadVers)
+		return resp, nil
+	}
+
+	q := req.Question[0]
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(q.Name), q.Qtype)
+	query.Question[0].Qclass = q.Qclass
+	query.CheckingDisabled = req.CheckingDisabled
+	dnssec := false
+	if opt := req.IsEdns0(); opt != nil {
+		dnssec = opt.Do()
+	}
+	query.SetEdns0(serverUDPSize, dnssec)
+
+	start := time.Now()
+	upstream, err := s.exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if upstream == nil {
+		return nil, errors.New("no response")
+	}
+
+	logger := log.GetCtxLogger(ctx)
+	logger.Debug().Msgf("answered %s with %s in %d ms", questionString(req),
+		dns.RcodeToString[upstream.Rcode], time.Since(start).Milliseconds())
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Rcode = upstream.Rcode
+	resp.RecursionAvailable = true
+	resp.AuthenticatedData = upstream.AuthenticatedData
+	resp.Answer = upstream.Answer
+	resp.Ns = upstream.Ns
+	for _, rr := range upstream.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			resp.Extra = append(resp.Extra, rr)
+		}
+	}
+	resp.Compress = true
+	return resp, nil
+}
+
+// questionString returns the name and type of the question of msg.
+func questionString(msg *dns.Msg) string {
+	if len(msg.Question) == 0 {
+		return "empty query"
+	}
+	q := msg.Question[0]
+	return q.Name + " (" + dns.TypeToString[q.Qtype] + ")"
+}
+
+// IsSystemServer reports whether the system's name servers include addr, the
+// listen address of a dns server, so that queries sent through the system
+// resolver would come back to it.
+func IsSystemServer(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+
+	config, err := dns.ClientConfigFromFile(resolvConf)
+	if err != nil || config.Port != port {
+		return false
+	}
+
+	for _, server := range config.Servers {
+		serverIP := net.ParseIP(server)
+		if serverIP == nil {
+			continue
+		}
+		if serverIP.Equal(ip) || ((ip == nil || ip.IsUnspecified()) && serverIP.IsLoopback()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// answersExchange answers every query with n A records.
+func answersExchange(n int) ExchangeFunc {
+	return func(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		for i := range n {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, byte(i)),
+			})
+		}
+		return resp, nil
+	}
+}
+
+// newQuery returns an A query for example.com., with an EDNS0 record
+// advertising udpSize if it is not 0.
+func newQuery(udpSize uint16) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if udpSize != 0 {
+		msg.SetEdns0(udpSize, false)
+	}
+	return msg
+}
+
+func TestServerRespondSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		udpSize uint16
+		udp     bool
+		maxLen  int
+		trunc   bool
+	}{
+		{name: "udp without edns", udp: true, maxLen: dns.MinMsgSize, trunc: true},
+		{name: "udp with small edns buffer", udpSize: 800, udp: true, maxLen: 800, trunc: true},
+		{name: "udp with edns buffer below minimum", udpSize: 100, udp: true, maxLen: dns.MinMsgSize, trunc: true},
+		{name: "udp with large edns buffer", udpSize: 4096, udp: true, maxLen: serverUDPSize, trunc: true},
+		{name: "tcp", udpSize: 4096},
+	}
+
+	s := NewServer(answersExchange(200))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := s.respond(context.Background(), newQuery(tt.udpSize), tt.udp)
+			if resp.Truncated != tt.trunc {
+				t.Errorf("truncated = %t, want %t", resp.Truncated, tt.trunc)
+			}
+			if tt.maxLen != 0 && resp.Len() > tt.maxLen {
+				t.Errorf("response is %d bytes, want at most %d", resp.Len(), tt.maxLen)
+			}
+			if !tt.udp && len(resp.Answer) != 200 {
+				t.Errorf("got %d answers over tcp, want all 200", len(resp.Answer))
+			}
+
+			opt := resp.IsEdns0()
+			if (opt != nil) != (tt.udpSize != 0) {
+				t.Fatalf("response has edns0 record: %t, want %t", opt != nil, tt.udpSize != 0)
+			}
+			if opt != nil && opt.UDPSize() != serverUDPSize {
+				t.Errorf("advertised udp size = %d, want %d", opt.UDPSize(), serverUDPSize)
+			}
+		})
+	}
+}
+
+func TestServerRespondRcode(t *testing.T) {
+	badVers := newQuery(1232)
+	badVers.IsEdns0().SetVersion(1)
+
+	noQuestion := newQuery(0)
+	noQuestion.Question = nil
+
+	twoQuestions := newQuery(0)
+	twoQuestions.Question = append(twoQuestions.Question, dns.Question{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+	notify := newQuery(0)
+	notify.Opcode = dns.OpcodeNotify
+
+	tests := []struct {
+		name     string
+		req      *dns.Msg
+		exchange ExchangeFunc
+		want     int
+	}{
+		{name: "answered", req: newQuery(0), exchange: answersExchange(1), want: dns.RcodeSuccess},
+		{name: "no question", req: noQuestion, want: dns.RcodeFormatError},
+		{name: "two questions", req: twoQuestions, want: dns.RcodeFormatError},
+		{name: "other opcode", req: notify, want: dns.RcodeNotImplemented},
+		{name: "edns version", req: badVers, want: dns.RcodeBadVers},
+		{
+			name: "upstream error",
+			req:  newQuery(0),
+			exchange: func(context.Context, *dns.Msg) (*dns.Msg, error) {
+				return nil, errors.New("upstream failed")
+			},
+			want: dns.RcodeServerFailure,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exchanged := false
+			s := NewServer(func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+				exchanged = true
+				if tt.exchange == nil {
+					t.Error("query was sent upstream")
+					return nil, errors.New("unexpected query")
+				}
+				return tt.exchange(ctx, msg)
+			})
+
+			resp := s.respond(context.Background(), tt.req, true)
+			if resp.Rcode != tt.want {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.want])
+			}
+			if resp.Id != tt.req.Id || !resp.Response {
+				t.Error("response does not answer the query")
+			}
+			if tt.exchange != nil && !exchanged {
+				t.Error("query was not sent upstream")
+			}
+		})
+	}
+}
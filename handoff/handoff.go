@@ -0,0 +1,106 @@
+package handoff
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Names of the sockets that can be handed over.
+const (
+	NameProxy = "proxy"
+	NameAdmin = "admin"
+	NameDNS   = "dns"
+	NameDoH   = "doh"
+)
+
+// envListenFds lists the names and file descriptors of the sockets handed
+// over to a new process, e.g. "proxy:3,proxy:4,admin:5".
+const envListenFds = "SPOOFDPI_LISTEN_FDS"
+
+// Sockets are the sockets handed over by the previous process, by name.
+type Sockets struct {
+	Listeners   map[string][]net.Listener
+	PacketConns map[string][]net.PacketConn
+}
+
+// Env returns the environment entry that hands the sockets with the given
+// names and file descriptors over to a new process.
+func Env(names []string, fds []uintptr) string {
+	values := make([]string, len(fds))
+	for i, fd := range fds {
+		values[i] = names[i] + ":" + strconv.FormatUint(uint64(fd), 10)
+	}
+	return envListenFds + "=" + strings.Join(values, ",")
+}
+
+// Receive returns the sockets handed over by the previous process. The maps
+// are empty if there are none. The variable is removed from the environment
+// so that it is not passed on by accident. Unix sockets are owned by the new
+// process and removed when their listener is closed.
+func Receive() (*Sockets, error) {
+	sockets := &Sockets{
+		Listeners:   make(map[string][]net.Listener),
+		PacketConns: make(map[string][]net.PacketConn),
+	}
+
+	value, ok := os.LookupEnv(envListenFds)
+	if !ok {
+		return sockets, nil
+	}
+	_ = os.Unsetenv(envListenFds)
+
+	for _, field := range strings.Split(value, ",") {
+		name, fdValue, _ := strings.Cut(field, ":")
+		fd, err := strconv.ParseUint(fdValue, 10, 0)
+		if err != nil {
+			sockets.Close()
+			return nil, fmt.Errorf("invalid %s %q", envListenFds, value)
+		}
+
+		if err := sockets.add(name, os.NewFile(uintptr(fd), name)); err != nil {
+			sockets.Close()
+			return nil, fmt.Errorf("handed over %s fd %d: %w", name, fd, err)
+		}
+	}
+
+	return sockets, nil
+}
+
+// add adds the listener or, failing that, the packet socket of f.
+func (s *Sockets) add(name string, f *os.File) error {
+	defer func() {
+		_ = f.Close()
+	}()
+
+	if l, err := net.FileListener(f); err == nil {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+		s.Listeners[name] = append(s.Listeners[name], l)
+		return nil
+	}
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return err
+	}
+	s.PacketConns[name] = append(s.PacketConns[name], pc)
+	return nil
+}
+
+// Close closes all sockets.
+func (s *Sockets) Close() {
+	for _, ls := range s.Listeners {
+		for _, l := range ls {
+			_ = l.Close()
+		}
+	}
+	for _, pcs := range s.PacketConns {
+		for _, pc := range pcs {
+			_ = pc.Close()
+		}
+	}
+}
@@ -0,0 +1,251 @@
+//go:build !windows
+
+package handoff
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Modes of the test binary when it is started by Restart, set in
+// envTestChild.
+const (
+	envTestChild = "SPOOFDPI_HANDOFF_TEST_CHILD"
+	childReady   = "ready"
+	childExit    = "exit"
+	childHang    = "hang"
+)
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(envTestChild) {
+	case childReady:
+		sockets, err := Receive()
+		if err != nil || len(sockets.Listeners[NameProxy]) != 1 {
+			os.Exit(3)
+		}
+		if err := Ready(); err != nil {
+			os.Exit(4)
+		}
+		os.Exit(0)
+	case childExit:
+		os.Exit(1)
+	case childHang:
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// setEnv sets the environment entry "key=value" for the test.
+func setEnv(t *testing.T, entry string) {
+	t.Helper()
+	key, value, _ := strings.Cut(entry, "=")
+	t.Setenv(key, value)
+}
+
+// listenerFile returns a duplicate of the file descriptor of a new tcp
+// listener.
+func listenerFile(t *testing.T) *os.File {
+	t.Helper()
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = l.Close()
+	}()
+
+	f, err := l.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = f.Close()
+	})
+	return f
+}
+
+// dupFd returns a duplicate of the file descriptor of f, to be owned by
+// Receive or Ready, which close it.
+func dupFd(t *testing.T, f *os.File) int {
+	t.Helper()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestReceive(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = pc.Close()
+	}()
+	pcFile, err := pc.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = pcFile.Close()
+	}()
+
+	proxy1, proxy2 := listenerFile(t), listenerFile(t)
+	setEnv(t, Env(
+		[]string{NameProxy, NameProxy, NameDNS},
+		[]uintptr{uintptr(dupFd(t, proxy1)), uintptr(dupFd(t, proxy2)), uintptr(dupFd(t, pcFile))},
+	))
+
+	sockets, err := Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sockets.Close()
+
+	if n := len(sockets.Listeners[NameProxy]); n != 2 {
+		t.Errorf("got %d proxy listeners, want 2", n)
+	}
+	if n := len(sockets.PacketConns[NameDNS]); n != 1 {
+		t.Errorf("got %d dns packet sockets, want 1", n)
+	}
+	if len(sockets.Listeners) != 1 || len(sockets.PacketConns) != 1 {
+		t.Errorf("got sockets %v, want only proxy and dns", sockets)
+	}
+	if _, ok := os.LookupEnv(envListenFds); ok {
+		t.Errorf("%s was not removed from the environment", envListenFds)
+	}
+}
+
+func TestReceiveNone(t *testing.T) {
+	sockets, err := Receive()
+	if err != nil || len(sockets.Listeners) != 0 || len(sockets.PacketConns) != 0 {
+		t.Errorf("Receive = %v, %v, want no sockets", sockets, err)
+	}
+}
+
+func TestReceiveErrors(t *testing.T) {
+	regular, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = regular.Close()
+	}()
+
+	tests := []struct {
+		name  string
+		value func() string
+		want  string
+	}{
+		{name: "no fd", value: func() string { return "proxy" }, want: "invalid"},
+		{name: "non-numeric fd", value: func() string { return "proxy:three" }, want: "invalid"},
+		{name: "negative fd", value: func() string { return "proxy:-1" }, want: "invalid"},
+		{name: "empty", value: func() string { return "" }, want: "invalid"},
+		{name: "closed fd", value: func() string { return "proxy:99999" }, want: "proxy fd 99999"},
+		{name: "not a socket", value: func() string { return "dns:" + strconv.Itoa(dupFd(t, regular)) }, want: "dns fd"},
+		{
+			name:  "one bad fd of many",
+			value: func() string { return "proxy:" + strconv.Itoa(dupFd(t, listenerFile(t))) + ",proxy:x" },
+			want:  "invalid",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(envListenFds, tt.value())
+			_, err := Receive()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Receive = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReady(t *testing.T) {
+	t.Run("not restarted", func(t *testing.T) {
+		if err := Ready(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalid fd", func(t *testing.T) {
+		t.Setenv(envReadyFd, "ready")
+		if err := Ready(); err == nil {
+			t.Error("Ready succeeded")
+		}
+	})
+
+	t.Run("missing fd", func(t *testing.T) {
+		t.Setenv(envReadyFd, "99999")
+		if err := Ready(); err == nil {
+			t.Error("Ready succeeded")
+		}
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = r.Close()
+		}()
+		fd := dupFd(t, w)
+		_ = w.Close()
+
+		t.Setenv(envReadyFd, strconv.Itoa(fd))
+		if err := Ready(); err != nil {
+			t.Fatal(err)
+		}
+
+		var b [2]byte
+		if n, _ := r.Read(b[:]); n != 1 {
+			t.Errorf("read %d bytes, want the ready byte", n)
+		}
+		if _, ok := os.LookupEnv(envReadyFd); ok {
+			t.Errorf("%s was not removed from the environment", envReadyFd)
+		}
+	})
+}
+
+func TestRestart(t *testing.T) {
+	tests := []struct {
+		name    string
+		child   string
+		timeout time.Duration
+		want    string
+	}{
+		{name: "ready", child: childReady, timeout: 10 * time.Second},
+		{name: "exits", child: childExit, timeout: 10 * time.Second, want: "exited before it was ready"},
+		{name: "too slow", child: childHang, timeout: 200 * time.Millisecond, want: "not ready within"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(envTestChild, tt.child)
+
+			proc, err := Restart([]string{NameProxy}, []*os.File{listenerFile(t)}, tt.timeout)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if proc == nil || proc.Pid == os.Getpid() {
+					t.Errorf("Restart = %v, want the new process", proc)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Restart = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
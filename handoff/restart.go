@@ -0,0 +1,99 @@
+package handoff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// envReadyFd is the file descriptor a new process writes to once it is
+// accepting connections.
+const envReadyFd = "SPOOFDPI_READY_FD"
+
+// firstExtraFd is the file descriptor of the first of exec.Cmd.ExtraFiles.
+const firstExtraFd = 3
+
+// Restart starts the binary found at the path the process was started with,
+// which may have been replaced by a newer version, with the same arguments.
+// It hands the given listeners over and waits up to timeout for the new
+// process to accept connections on them. On error, the new process is killed
+// and the caller keeps serving.
+func Restart(names []string, files []*os.File, timeout time.Duration) (*os.Process, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	fds := make([]uintptr, len(files))
+	for i := range files {
+		fds[i] = uintptr(firstExtraFd + i)
+	}
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files[:len(files):len(files)], w)
+	cmd.Env = append(os.Environ(),
+		Env(names, fds),
+		envReadyFd+"="+strconv.Itoa(firstExtraFd+len(files)),
+	)
+
+	err = cmd.Start()
+	_ = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, err
+	}
+
+	var ready [1]byte
+	if _, err := io.ReadFull(r, ready[:]); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, fmt.Errorf("new process was not ready within %s", timeout)
+		}
+		return nil, fmt.Errorf("new process exited before it was ready: %s", cmd.ProcessState)
+	}
+
+	go func() {
+		_ = cmd.Wait()
+	}()
+
+	return cmd.Process, nil
+}
+
+// Ready tells the process that started this one by Restart that it is
+// accepting connections. It does nothing when the process was not started
+// by Restart.
+func Ready() error {
+	value, ok := os.LookupEnv(envReadyFd)
+	if !ok {
+		return nil
+	}
+	_ = os.Unsetenv(envReadyFd)
+
+	fd, err := strconv.ParseUint(value, 10, 0)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", envReadyFd, value)
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	defer func() {
+		_ = f.Close()
+	}()
+
+	_, err = f.Write([]byte{1})
+	return err
+}
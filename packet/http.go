@@ -48,11 +48,14 @@ var validMethod = map[string]struct{}{
 
 type HttpRequest struct {
 	raw     []byte
+	header  http.Header
 	method  string
 	domain  string
 	port    string
 	path    string
 	version string
+
+	serverName string
 }
 
 // ReadHttpRequest reads an HTTP request from the provided io.Reader.
@@ -65,6 +68,21 @@ func ReadHttpRequest(rdr io.Reader) (*HttpRequest, error) {
 	return p, nil
 }
 
+// NewConnectRequest creates a CONNECT request to domain and port for clients
+// that do not speak HTTP, such as SOCKS5 or transparently redirected ones.
+func NewConnectRequest(domain, port string) *HttpRequest {
+	hostPort := net.JoinHostPort(domain, port)
+	return &HttpRequest{
+		raw:     []byte("CONNECT " + hostPort + " HTTP/1.1\r\nHost: " + hostPort + "\r\n\r\n"),
+		header:  make(http.Header),
+		method:  "CONNECT",
+		domain:  domain,
+		port:    port,
+		path:    "/",
+		version: "HTTP/1.1",
+	}
+}
+
 func (p *HttpRequest) Raw() []byte {
 	return p.raw
 }
@@ -80,10 +98,30 @@ func (p *HttpRequest) Port() string {
 	return p.port
 }
 
+// ServerName returns the host name the client asked the server for, which is
+// the domain unless SetServerName was called.
+func (p *HttpRequest) ServerName() string {
+	if p.serverName != "" {
+		return p.serverName
+	}
+	return p.domain
+}
+
+// SetServerName sets the host name the client asked the server for, for
+// requests whose domain is an address, such as transparently redirected ones.
+func (p *HttpRequest) SetServerName(name string) {
+	p.serverName = name
+}
+
 func (p *HttpRequest) Version() string {
 	return p.version
 }
 
+// Header returns the first value of the given request header.
+func (p *HttpRequest) Header(name string) string {
+	return p.header.Get(name)
+}
+
 // IsValidMethod checks if the HTTP method is valid.
 func (p *HttpRequest) IsValidMethod() bool {
 	if _, exists := validMethod[p.Method()]; exists {
@@ -118,7 +156,7 @@ func (p *HttpRequest) Tidy() {
 
 	crlf := []byte("\r\n")
 	for _, line := range headers {
-		if strings.HasPrefix(line, "Proxy-Connection:") {
+		if isHopByHopProxyHeader(line) {
 			continue // skip this header
 		}
 		buf.WriteString(line)
@@ -130,6 +168,16 @@ func (p *HttpRequest) Tidy() {
 	p.raw = buf.Bytes()
 }
 
+// isHopByHopProxyHeader checks if the header line is meant for the proxy and
+// must not be forwarded to the server.
+func isHopByHopProxyHeader(line string) bool {
+	name, _, ok := strings.Cut(line, ":")
+	if !ok {
+		return false
+	}
+	return strings.EqualFold(name, "Proxy-Connection") || strings.EqualFold(name, "Proxy-Authorization")
+}
+
 // parse reads an HTTP request from the provided io.Reader and returns an HttpRequest struct.
 func parse(rdr io.Reader) (*HttpRequest, error) {
 	sb := strings.Builder{}
@@ -148,6 +196,7 @@ func parse(rdr io.Reader) (*HttpRequest, error) {
 		p.port = ""
 	}
 
+	p.header = request.Header
 	p.method = request.Method
 	p.version = request.Proto
 	p.path = request.URL.Path
@@ -77,3 +77,91 @@ func (m *TLSMessage) IsClientHello() bool {
 	}
 	return m.Raw[5] == 0x01
 }
+
+// extServerName is the type of the server_name extension (RFC 6066 Section 3).
+const extServerName = 0x0000
+
+// ServerName returns the host name of the server name indication in a Client
+// Hello message, or "" if there is none or the message is cut short.
+func (m *TLSMessage) ServerName() string {
+	if !m.IsClientHello() {
+		return ""
+	}
+
+	// Skip the handshake header, client version and random
+	b := m.RawPayload
+	if len(b) < 4+2+32 {
+		return ""
+	}
+	b = b[4+2+32:]
+
+	// Skip the session id, cipher suites and compression methods
+	var ok bool
+	if b, ok = skipVector(b, 1); !ok {
+		return ""
+	}
+	if b, ok = skipVector(b, 2); !ok {
+		return ""
+	}
+	if b, ok = skipVector(b, 1); !ok {
+		return ""
+	}
+
+	exts, ok := vector(b, 2)
+	if !ok {
+		return ""
+	}
+	for len(exts) >= 4 {
+		extType := binary.BigEndian.Uint16(exts[:2])
+		data, ok := vector(exts[2:], 2)
+		if !ok {
+			return ""
+		}
+		exts = exts[4+len(data):]
+		if extType != extServerName {
+			continue
+		}
+
+		names, ok := vector(data, 2)
+		if !ok {
+			return ""
+		}
+		for len(names) >= 3 {
+			name, ok := vector(names[1:], 2)
+			if !ok {
+				return ""
+			}
+			if names[0] == 0 { // host_name
+				return string(name)
+			}
+			names = names[3+len(name):]
+		}
+		return ""
+	}
+	return ""
+}
+
+// vector returns the contents of a TLS vector with a length prefix of
+// lenSize bytes at the start of b.
+func vector(b []byte, lenSize int) ([]byte, bool) {
+	if len(b) < lenSize {
+		return nil, false
+	}
+	n := 0
+	for _, c := range b[:lenSize] {
+		n = n<<8 | int(c)
+	}
+	if len(b) < lenSize+n {
+		return nil, false
+	}
+	return b[lenSize : lenSize+n], true
+}
+
+// skipVector returns what follows the TLS vector at the start of b.
+func skipVector(b []byte, lenSize int) ([]byte, bool) {
+	v, ok := vector(b, lenSize)
+	if !ok {
+		return nil, false
+	}
+	return b[lenSize+len(v):], true
+}
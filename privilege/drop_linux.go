@@ -0,0 +1,135 @@
+package privilege
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// retainedCaps are the capabilities kept after dropping privileges, so that
+// raw sockets and transparent proxying keep working.
+var retainedCaps = []uintptr{unix.CAP_NET_RAW, unix.CAP_NET_ADMIN}
+
+// Drop switches to cred, keeping only the retained capabilities, and
+// re-executes the binary with env, passing files on to the new image.
+//
+// Capabilities are per thread on linux, so they are changed on a locked
+// thread which then calls execve; the new image starts with the credentials
+// of that thread. The capabilities are raised as ambient capabilities so
+// that they survive the exec as an unprivileged user. Drop only returns on
+// error, after which the process must exit.
+func Drop(cred Credential, files []*os.File, env []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if _, err := unix.FcntlInt(f.Fd(), unix.F_SETFD, 0); err != nil {
+			return fmt.Errorf("passing on %s: %w", f.Name(), err)
+		}
+	}
+
+	// Never unlocked, as the thread is replaced by the exec or the process exits
+	runtime.LockOSThread()
+
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("keeping capabilities: %w", err)
+	}
+	if err := unix.Setgroups([]int{cred.Gid}); err != nil {
+		return fmt.Errorf("setting groups: %w", err)
+	}
+	if err := unix.Setresgid(cred.Gid, cred.Gid, cred.Gid); err != nil {
+		return fmt.Errorf("setting gid %d: %w", cred.Gid, err)
+	}
+	if err := unix.Setresuid(cred.Uid, cred.Uid, cred.Uid); err != nil {
+		return fmt.Errorf("setting uid %d: %w", cred.Uid, err)
+	}
+
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	for _, c := range retainedCaps {
+		bit := uint32(1) << (c % 32)
+		data[c/32].Effective |= bit
+		data[c/32].Permitted |= bit
+		data[c/32].Inheritable |= bit
+	}
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("retaining capabilities: %w", err)
+	}
+
+	for _, c := range retainedCaps {
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, c, 0, 0); err != nil {
+			return fmt.Errorf("raising ambient capability %d: %w", c, err)
+		}
+	}
+
+	return syscall.Exec(exe, os.Args, env)
+}
+
+// Permission bits checked by CheckReadable, for others.
+const (
+	permRead   fs.FileMode = 0o4
+	permSearch fs.FileMode = 0o1
+)
+
+// CheckReadable checks that cred can read the file at path, by the
+// permission bits of the file and the directories leading to it. ACLs are
+// not taken into account, and supplementary groups are not, as Drop drops
+// them.
+func CheckReadable(cred Credential, path string) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	resolved, err = filepath.Abs(resolved)
+	if err != nil {
+		return err
+	}
+
+	for dir := filepath.Dir(resolved); ; dir = filepath.Dir(dir) {
+		if err := checkPerm(cred, dir, permSearch); err != nil {
+			return err
+		}
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return checkPerm(cred, resolved, permRead)
+}
+
+// checkPerm checks that cred has perm on the file at path.
+func checkPerm(cred Credential, path string, perm fs.FileMode) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if !permits(info.Mode(), int(st.Uid), int(st.Gid), cred, perm) {
+		return &fs.PathError{Op: "access", Path: path, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+// permits reports whether cred has perm on a file with the given mode and
+// owner. Root is allowed everything.
+func permits(mode fs.FileMode, uid, gid int, cred Credential, perm fs.FileMode) bool {
+	switch {
+	case cred.Uid == 0:
+		return true
+	case cred.Uid == uid:
+		return mode&(perm<<6) != 0
+	case cred.Gid == gid:
+		return mode&(perm<<3) != 0
+	default:
+		return mode&perm != 0
+	}
+}
@@ -0,0 +1,81 @@
+package privilege
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPermits(t *testing.T) {
+	cred := Credential{Uid: 1000, Gid: 1000}
+
+	tests := []struct {
+		name     string
+		mode     fs.FileMode
+		uid, gid int
+		cred     Credential
+		perm     fs.FileMode
+		want     bool
+	}{
+		{name: "owner", mode: 0o400, uid: 1000, gid: 0, cred: cred, perm: permRead, want: true},
+		{name: "owner without bit", mode: 0o044, uid: 1000, gid: 1000, cred: cred, perm: permRead},
+		{name: "group", mode: 0o040, uid: 0, gid: 1000, cred: cred, perm: permRead, want: true},
+		{name: "group without bit", mode: 0o404, uid: 0, gid: 1000, cred: cred, perm: permRead},
+		{name: "other", mode: 0o004, uid: 0, gid: 0, cred: cred, perm: permRead, want: true},
+		{name: "root only", mode: 0o600, uid: 0, gid: 0, cred: cred, perm: permRead},
+		{name: "search", mode: 0o711, uid: 0, gid: 0, cred: cred, perm: permSearch, want: true},
+		{name: "no search", mode: 0o744, uid: 0, gid: 0, cred: cred, perm: permSearch},
+		{name: "root", mode: 0, uid: 1000, gid: 1000, cred: Credential{}, perm: permRead, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := permits(tt.mode, tt.uid, tt.gid, tt.cred, tt.perm); got != tt.want {
+				t.Errorf("permits = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckReadable(t *testing.T) {
+	// A user that owns none of the files, so that only the bits for others
+	// apply
+	cred := Credential{Uid: 4000000, Gid: 4000000}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// t.TempDir creates a directory in a private one
+	for _, d := range []string{filepath.Dir(dir), dir} {
+		if err := os.Chmod(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CheckReadable(cred, path); err != nil {
+		t.Skipf("the temporary directory is not readable by others: %s", err)
+	}
+
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckReadable(cred, path); err == nil {
+		t.Error("a file only its owner can read is readable")
+	}
+
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckReadable(cred, path); err == nil {
+		t.Error("a file in a directory only its owner can search is readable")
+	}
+
+	if err := CheckReadable(cred, filepath.Join(dir, "missing")); err == nil {
+		t.Error("a missing file is readable")
+	}
+}
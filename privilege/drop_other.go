@@ -0,0 +1,18 @@
+//go:build !linux
+
+package privilege
+
+import (
+	"errors"
+	"os"
+)
+
+// Drop is only supported on linux.
+func Drop(Credential, []*os.File, []string) error {
+	return errors.New("dropping privileges is only supported on linux")
+}
+
+// CheckReadable does nothing, as privileges cannot be dropped.
+func CheckReadable(Credential, string) error {
+	return nil
+}
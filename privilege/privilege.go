@@ -0,0 +1,135 @@
+package privilege
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Credential is the user and group the process runs as. Name and Home are
+// those of the user's entry in the user database, if it has one.
+type Credential struct {
+	Uid  int
+	Gid  int
+	Name string
+	Home string
+}
+
+// userEnv are the environment variables that point to the user or their
+// directories.
+var userEnv = []string{"HOME", "USER", "LOGNAME", "XDG_CONFIG_HOME", "XDG_CACHE_HOME", "XDG_STATE_HOME", "XDG_RUNTIME_DIR"}
+
+// Lookup resolves the given user and group names or ids. An empty user
+// keeps the current one, and an empty group selects the user's primary
+// group.
+func Lookup(userName, groupName string) (Credential, error) {
+	cred := Credential{Uid: os.Getuid(), Gid: os.Getgid()}
+
+	if userName != "" {
+		var err error
+		if cred, err = lookupUser(userName); err != nil {
+			return Credential{}, err
+		}
+	}
+
+	if groupName != "" {
+		gid, err := LookupGroup(groupName)
+		if err != nil {
+			return Credential{}, err
+		}
+		cred.Gid = gid
+	}
+
+	if cred.Gid < 0 {
+		return Credential{}, fmt.Errorf("user %s has no primary group; give a group as well", userName)
+	}
+
+	return cred, nil
+}
+
+// Current reports whether the process already runs with cred.
+func (c Credential) Current() bool {
+	return os.Getuid() == c.Uid && os.Geteuid() == c.Uid &&
+		os.Getgid() == c.Gid && os.Getegid() == c.Gid
+}
+
+// Environ returns env for a process running as c. Unless c keeps the current
+// user, the variables pointing to the current user and their directories are
+// replaced with HOME, USER and LOGNAME of c, or removed if c has no entry in
+// the user database, so that the process does not write to the directories
+// of the previous user.
+func (c Credential) Environ(env []string) []string {
+	if c.Uid == os.Getuid() {
+		return env
+	}
+
+	out := make([]string, 0, len(env)+3)
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		if !slices.Contains(userEnv, key) {
+			out = append(out, kv)
+		}
+	}
+
+	if c.Home != "" {
+		out = append(out, "HOME="+c.Home)
+	}
+	if c.Name != "" {
+		out = append(out, "USER="+c.Name, "LOGNAME="+c.Name)
+	}
+	return out
+}
+
+// LookupUser returns the uid and the primary gid of a user name or id. The
+// gid is -1 for a numeric id that has no entry in the user database.
+func LookupUser(name string) (int, int, error) {
+	cred, err := lookupUser(name)
+	return cred.Uid, cred.Gid, err
+}
+
+// lookupUser returns the credential of a user name or id with the user's
+// primary group. The gid is -1 for a numeric id that has no entry in the user
+// database.
+func lookupUser(name string) (Credential, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		uid, convErr := strconv.Atoi(name)
+		if convErr != nil {
+			return Credential{}, err
+		}
+		if u, err = user.LookupId(name); err != nil {
+			return Credential{Uid: uid, Gid: -1}, nil
+		}
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return Credential{}, fmt.Errorf("user %s has a non-numeric uid %q", name, u.Uid)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return Credential{}, fmt.Errorf("user %s has a non-numeric gid %q", name, u.Gid)
+	}
+	return Credential{Uid: uid, Gid: gid, Name: u.Username, Home: u.HomeDir}, nil
+}
+
+// LookupGroup returns the gid of a group name or id.
+func LookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, fmt.Errorf("group %s has a non-numeric gid %q", name, g.Gid)
+	}
+	return gid, nil
+}
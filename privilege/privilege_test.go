@@ -0,0 +1,84 @@
+package privilege
+
+import (
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	uid, _ := strconv.Atoi(current.Uid)
+	gid, _ := strconv.Atoi(current.Gid)
+
+	tests := []struct {
+		name      string
+		user      string
+		group     string
+		want      Credential
+		wantError bool
+	}{
+		{name: "user name", user: current.Username, want: Credential{Uid: uid, Gid: gid, Name: current.Username, Home: current.HomeDir}},
+		{name: "numeric user", user: current.Uid, want: Credential{Uid: uid, Gid: gid, Name: current.Username, Home: current.HomeDir}},
+		{name: "user and numeric group", user: current.Username, group: "4000000", want: Credential{Uid: uid, Gid: 4000000, Name: current.Username, Home: current.HomeDir}},
+		{name: "group only", group: "4000000", want: Credential{Uid: os.Getuid(), Gid: 4000000}},
+		{name: "unknown numeric user with group", user: "4000000", group: "4000001", want: Credential{Uid: 4000000, Gid: 4000001}},
+		{name: "unknown numeric user", user: "4000000", wantError: true},
+		{name: "unknown user", user: "spoofdpi-no-such-user", wantError: true},
+		{name: "unknown group", group: "spoofdpi-no-such-group", wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cred, err := Lookup(tt.user, tt.group)
+			if tt.wantError {
+				if err == nil {
+					t.Errorf("Lookup = %+v, want an error", cred)
+				}
+				return
+			}
+			if err != nil || cred != tt.want {
+				t.Errorf("Lookup = %+v, %v, want %+v", cred, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	env := []string{"PATH=/usr/bin", "HOME=/root", "USER=root", "XDG_STATE_HOME=/root/.local/state", "SPOOFDPI_PORT=8080"}
+
+	tests := []struct {
+		name string
+		cred Credential
+		want []string
+	}{
+		{
+			name: "other user",
+			cred: Credential{Uid: os.Getuid() + 1, Name: "spoofdpi", Home: "/var/lib/spoofdpi"},
+			want: []string{"PATH=/usr/bin", "SPOOFDPI_PORT=8080", "HOME=/var/lib/spoofdpi", "USER=spoofdpi", "LOGNAME=spoofdpi"},
+		},
+		{
+			name: "user without entry",
+			cred: Credential{Uid: os.Getuid() + 1},
+			want: []string{"PATH=/usr/bin", "SPOOFDPI_PORT=8080"},
+		},
+		{
+			name: "current user",
+			cred: Credential{Uid: os.Getuid(), Name: "other", Home: "/home/other"},
+			want: env,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cred.Environ(env); !slices.Equal(got, tt.want) {
+				t.Errorf("Environ = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
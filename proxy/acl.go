@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+)
+
+// clientAllowed checks the client address against the deny and allow lists.
+// Denied ranges take precedence, and when an allow list is given the client
+// must match one of its ranges. Clients on Unix sockets have no IP address
+// and are left to the file permissions of the socket.
+func (s *settings) clientAllowed(addr net.Addr) bool {
+	if len(s.allowClients) == 0 && len(s.denyClients) == 0 {
+		return true
+	}
+
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return true
+	}
+
+	ip, ok := addrIP(addr)
+	if !ok {
+		return false
+	}
+
+	if containsAddr(s.denyClients, ip) {
+		return false
+	}
+
+	return len(s.allowClients) == 0 || containsAddr(s.allowClients, ip)
+}
+
+// addrIP returns the IP of a network address, with IPv4-mapped IPv6
+// addresses converted to plain IPv4.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	return ip.Unmap(), ok
+}
+
+// containsAddr reports whether any of the prefixes contains ip.
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
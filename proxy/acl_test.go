@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bariiss/SpoofDPI/util"
+)
+
+func TestClientAllowed(t *testing.T) {
+	prefixes := func(values ...string) []netip.Prefix {
+		var out []netip.Prefix
+		for _, v := range values {
+			out = append(out, netip.MustParsePrefix(v))
+		}
+		return out
+	}
+	tcp := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000}
+	}
+
+	lists := &settings{
+		allowClients: prefixes("192.168.0.0/16", "2001:db8::/32"),
+		denyClients:  prefixes("192.168.1.0/24", "2001:db8:bad::/48"),
+	}
+	denyOnly := &settings{denyClients: prefixes("10.0.0.0/8")}
+
+	tests := []struct {
+		name     string
+		settings *settings
+		addr     net.Addr
+		want     bool
+	}{
+		{name: "no lists", settings: &settings{}, addr: tcp("203.0.113.1"), want: true},
+		{name: "allowed", settings: lists, addr: tcp("192.168.2.1"), want: true},
+		{name: "not allowed", settings: lists, addr: tcp("10.0.0.1")},
+		{name: "deny over allow", settings: lists, addr: tcp("192.168.1.1")},
+		{name: "ipv6 allowed", settings: lists, addr: tcp("2001:db8::1"), want: true},
+		{name: "ipv6 deny over allow", settings: lists, addr: tcp("2001:db8:bad::1")},
+		{name: "mapped allowed", settings: lists, addr: tcp("::ffff:192.168.2.1"), want: true},
+		{name: "mapped denied", settings: lists, addr: tcp("::ffff:192.168.1.1")},
+		{name: "deny only", settings: denyOnly, addr: tcp("10.1.2.3")},
+		{name: "deny only other", settings: denyOnly, addr: tcp("192.0.2.1"), want: true},
+		{name: "unix socket", settings: lists, addr: &net.UnixAddr{Name: "/run/spoofdpi.sock", Net: "unix"}, want: true},
+		{name: "unknown address", settings: lists, addr: &net.UDPAddr{IP: net.ParseIP("192.168.2.1")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.settings.clientAllowed(tt.addr); got != tt.want {
+				t.Errorf("clientAllowed(%s) = %t, want %t", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortAllowed(t *testing.T) {
+	s := &settings{allowedPorts: []util.PortRange{{Low: 443, High: 443}, {Low: 8000, High: 8100}}}
+
+	tests := []struct {
+		port int
+		want bool
+	}{
+		{port: 443, want: true},
+		{port: 8000, want: true},
+		{port: 8050, want: true},
+		{port: 8100, want: true},
+		{port: 80},
+		{port: 7999},
+		{port: 8101},
+		{port: 0},
+		{port: -443},
+		{port: 65536 + 443},
+	}
+
+	for _, tt := range tests {
+		if got := s.portAllowed(tt.port); got != tt.want {
+			t.Errorf("portAllowed(%d) = %t, want %t", tt.port, got, tt.want)
+		}
+	}
+
+	if (&settings{}).portAllowed(443) {
+		t.Error("a port was allowed without any allowed ports")
+	}
+}
@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+const basicPrefix = "Basic "
+
+// Realm is sent in the Proxy-Authenticate challenge.
+const Realm = "SpoofDPI"
+
+// ParseBasic parses the credentials of a "Basic" Proxy-Authorization header.
+func ParseBasic(header string) (user, password string, ok bool) {
+	if len(header) < len(basicPrefix) || !strings.EqualFold(header[:len(basicPrefix)], basicPrefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(basicPrefix):]))
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(decoded), ":")
+}
+
+// Challenge returns the value of the Proxy-Authenticate header.
+func Challenge() string {
+	return `Basic realm="` + Realm + `"`
+}
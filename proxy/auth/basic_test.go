@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestParseBasic(t *testing.T) {
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	tests := []struct {
+		header         string
+		user, password string
+		ok             bool
+	}{
+		{header: "Basic " + encode("alice:secret"), user: "alice", password: "secret", ok: true},
+		{header: "basic " + encode("alice:secret"), user: "alice", password: "secret", ok: true},
+		{header: "Basic " + encode("alice:se:cret"), user: "alice", password: "se:cret", ok: true},
+		{header: "Basic " + encode("alice:"), user: "alice", password: "", ok: true},
+		{header: "Basic " + encode("alice"), user: "alice"},
+		{header: "Basic not-base64!"},
+		{header: "Bearer " + encode("alice:secret")},
+		{header: "Basic"},
+		{header: ""},
+	}
+
+	for _, tt := range tests {
+		user, password, ok := ParseBasic(tt.header)
+		if user != tt.user || password != tt.password || ok != tt.ok {
+			t.Errorf("ParseBasic(%q) = %q, %q, %t, want %q, %q, %t",
+				tt.header, user, password, ok, tt.user, tt.password, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const shaPrefix = "{SHA}"
+
+const (
+	// maxVerified bounds the number of credentials remembered as verified.
+	maxVerified = 256
+	// verifiedTTL is how long verified credentials are remembered.
+	verifiedTTL = 5 * time.Minute
+)
+
+// verifiedKey keys the digests of verified credentials, so that they cannot
+// be brute-forced faster than bcrypt without it. It never leaves the process.
+var verifiedKey = func() []byte {
+	key := make([]byte, sha256.Size)
+	_, _ = rand.Read(key)
+	return key
+}()
+
+// Htpasswd holds the users of an Apache htpasswd file. Only bcrypt
+// ("$2y$", "$2a$", "$2b$") and SHA-1 ("{SHA}") entries are supported.
+type Htpasswd struct {
+	users map[string]string
+
+	// dummy is a bcrypt hash of the file, compared against for unknown users
+	// and wrong SHA-1 passwords so that they take as long as wrong bcrypt
+	// passwords. It is empty if the file holds only SHA-1 entries.
+	dummy string
+
+	// verified remembers credentials that already passed a bcrypt check, as
+	// bcrypt is deliberately too slow to run on every new connection.
+	verified verifiedCache
+}
+
+// LoadHtpasswd reads the users from the htpasswd file at path.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening htpasswd file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	h := &Htpasswd{users: make(map[string]string)}
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("htpasswd file %s:%d: expected 'user:hash'", path, lineNum)
+		}
+		if !isBcrypt(hash) && !strings.HasPrefix(hash, shaPrefix) {
+			return nil, fmt.Errorf("htpasswd file %s:%d: unsupported hash for user %q; use bcrypt or SHA", path, lineNum, user)
+		}
+
+		h.users[user] = hash
+		if h.dummy == "" && isBcrypt(hash) {
+			h.dummy = hash
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading htpasswd file: %w", err)
+	}
+
+	return h, nil
+}
+
+// Verify reports whether password is valid for user.
+func (h *Htpasswd) Verify(user, password string) bool {
+	hash, ok := h.users[user]
+	if ok && isBcrypt(hash) {
+		return h.verifyBcrypt(user, hash, password)
+	}
+
+	// Wrong SHA-1 passwords and unknown users cost a bcrypt check too, so
+	// that timing does not tell which users exist or use the weaker scheme
+	if ok && verifySHA(hash, password) {
+		return true
+	}
+	if h.dummy != "" {
+		_ = bcrypt.CompareHashAndPassword([]byte(h.dummy), []byte(password))
+	} else if !ok {
+		_ = verifySHA(shaPrefix, password)
+	}
+	return false
+}
+
+// verifySHA checks password against a "{SHA}" hash in constant time.
+func verifySHA(hash, password string) bool {
+	sum := sha1.Sum([]byte(password))
+	expected := shaPrefix + base64.StdEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+}
+
+// verifyBcrypt checks password against a bcrypt hash, skipping the check for
+// credentials that were verified recently.
+func (h *Htpasswd) verifyBcrypt(user, hash, password string) bool {
+	mac := hmac.New(sha256.New, verifiedKey)
+	mac.Write([]byte(user + "\x00" + hash + "\x00" + password))
+	var key [sha256.Size]byte
+	mac.Sum(key[:0])
+
+	if h.verified.contains(key) {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+
+	h.verified.add(key)
+	return true
+}
+
+// verifiedCache is a set of credential digests. It holds up to maxVerified
+// of them for verifiedTTL each, evicting the least recently used first.
+type verifiedCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     list.List
+}
+
+// verifiedEntry is a digest in the verifiedCache and when it expires.
+type verifiedEntry struct {
+	key     [sha256.Size]byte
+	expires time.Time
+}
+
+// contains reports whether key was added and has not expired.
+func (c *verifiedCache) contains(key [sha256.Size]byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(elem.Value.(*verifiedEntry).expires) {
+		c.remove(elem)
+		return false
+	}
+	c.lru.MoveToFront(elem)
+	return true
+}
+
+// add adds key, evicting the least recently used keys beyond maxVerified.
+func (c *verifiedCache) add(key [sha256.Size]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[[sha256.Size]byte]*list.Element)
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+
+	c.entries[key] = c.lru.PushFront(&verifiedEntry{key: key, expires: time.Now().Add(verifiedTTL)})
+	for c.lru.Len() > maxVerified {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops an entry. The lock must be held.
+func (c *verifiedCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*verifiedEntry).key)
+}
+
+// isBcrypt reports whether hash is a bcrypt hash.
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2y$") ||
+		strings.HasPrefix(hash, "$2a$") ||
+		strings.HasPrefix(hash, "$2b$")
+}
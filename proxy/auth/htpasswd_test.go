@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeHtpasswd writes an htpasswd file with the given lines and returns its
+// path.
+func writeHtpasswd(t *testing.T, lines ...string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeHtpasswd(t,
+		"# users",
+		"",
+		"alice:"+string(hash),
+		"bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+	)
+	h, err := LoadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.users) != 2 {
+		t.Errorf("loaded %d users, want 2", len(h.users))
+	}
+	if h.dummy != string(hash) {
+		t.Errorf("dummy hash = %q, want the bcrypt hash of the file", h.dummy)
+	}
+
+	tests := []struct {
+		user, password string
+		want           bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "secret", true}, // remembered as verified
+		{"alice", "wrong", false},
+		{"bob", "secret", true},
+		{"bob", "wrong", false},
+		{"carol", "secret", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := h.Verify(tt.user, tt.password); got != tt.want {
+			t.Errorf("Verify(%q, %q) = %t, want %t", tt.user, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestHtpasswdSHAOnly(t *testing.T) {
+	h, err := LoadHtpasswd(writeHtpasswd(t, "bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.dummy != "" {
+		t.Errorf("dummy hash = %q for a file without bcrypt entries, want none", h.dummy)
+	}
+
+	tests := []struct {
+		user, password string
+		want           bool
+	}{
+		{"bob", "secret", true},
+		{"bob", "wrong", false},
+		{"carol", "secret", false},
+	}
+	for _, tt := range tests {
+		if got := h.Verify(tt.user, tt.password); got != tt.want {
+			t.Errorf("Verify(%q, %q) = %t, want %t", tt.user, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestLoadHtpasswdErrors(t *testing.T) {
+	tests := map[string]string{
+		"missing hash": "alice",
+		"empty user":   ":{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"md5 hash":     "alice:$apr1$lZL6V/ci$eIMz/iKDkbtys/uU7LEK00",
+		"plain text":   "alice:secret",
+	}
+
+	for name, line := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadHtpasswd(writeHtpasswd(t, line)); err == nil {
+				t.Errorf("LoadHtpasswd(%q) succeeded, want an error", line)
+			}
+		})
+	}
+
+	if _, err := LoadHtpasswd(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("LoadHtpasswd of a missing file succeeded, want an error")
+	}
+}
+
+func TestVerifiedCache(t *testing.T) {
+	var c verifiedCache
+
+	key := func(i int) [sha256.Size]byte {
+		return sha256.Sum256([]byte{byte(i), byte(i >> 8)})
+	}
+
+	for i := range maxVerified + 10 {
+		c.add(key(i))
+	}
+	if c.lru.Len() != maxVerified || len(c.entries) != maxVerified {
+		t.Fatalf("cache holds %d entries, want %d", c.lru.Len(), maxVerified)
+	}
+	if c.contains(key(0)) {
+		t.Error("least recently used key was not evicted")
+	}
+	if !c.contains(key(maxVerified + 9)) {
+		t.Error("most recent key is missing")
+	}
+
+	elem := c.entries[key(maxVerified+9)]
+	elem.Value.(*verifiedEntry).expires = elem.Value.(*verifiedEntry).expires.Add(-2 * verifiedTTL)
+	if c.contains(key(maxVerified + 9)) {
+		t.Error("expired key is still verified")
+	}
+	if _, ok := c.entries[key(maxVerified+9)]; ok {
+		t.Error("expired key was not removed")
+	}
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/bariiss/SpoofDPI/packet"
+	"github.com/bariiss/SpoofDPI/proxy/auth"
+	"github.com/bariiss/SpoofDPI/util"
+	"github.com/bariiss/SpoofDPI/util/log"
+)
+
+// frontend speaks the client side protocol of a listener. Every protocol
+// ends up with a request to a destination, so the rest of the proxy does not
+// need to know how the client asked for it.
+type frontend interface {
+	// request reads and authenticates the client's request and returns the
+	// connection to serve it on, which replays anything read ahead of it.
+	// When it reports false, it has already answered the client and closed
+	// conn.
+	request(ctx context.Context, conn net.Conn, s *settings) (context.Context, net.Conn, *packet.HttpRequest, bool)
+
+	// reject refuses the request with the closest match to the given HTTP
+	// status code and closes conn. pkt is nil if no request was read yet.
+	reject(conn net.Conn, pkt *packet.HttpRequest, status int)
+
+	// established tells the client that the tunnel to the server is open.
+	established(lConn net.Conn, pkt *packet.HttpRequest) error
+
+	// relaysPlain reports whether tunnels that do not start with a TLS
+	// handshake are relayed as is instead of being closed.
+	relaysPlain() bool
+}
+
+// newFrontend returns the frontend for the given listener protocol.
+func newFrontend(proto string) frontend {
+	switch proto {
+	case util.ProtoSOCKS5:
+		return socks5Frontend{}
+	case util.ProtoTransparent:
+		return transparentFrontend{}
+	default:
+		return httpFrontend{}
+	}
+}
+
+// httpFrontend serves HTTP proxy clients, which either send CONNECT for a
+// tunnel or a plain request with an absolute URL.
+type httpFrontend struct{}
+
+func (httpFrontend) request(ctx context.Context, conn net.Conn, s *settings) (context.Context, net.Conn, *packet.HttpRequest, bool) {
+	logger := log.GetCtxLogger(ctx)
+
+	pkt, err := packet.ReadHttpRequest(conn)
+	if err != nil {
+		logger.Debug().Msgf("error while parsing request: %s", err)
+		_ = conn.Close()
+		return ctx, nil, nil, false
+	}
+
+	pkt.Tidy()
+
+	logger.Debug().Msgf("request from %s\n\n%s", conn.RemoteAddr(), string(pkt.Raw()))
+
+	ctx, ok := s.authenticate(ctx, pkt)
+	if !ok {
+		logger = log.GetCtxLogger(ctx)
+		logger.Debug().Msgf("proxy authentication required for client %s", clientHost(conn))
+		writeStatusAndClose(conn, pkt.Version(), "407 Proxy Authentication Required",
+			"Proxy-Authenticate: "+auth.Challenge())
+		return ctx, nil, nil, false
+	}
+
+	if !pkt.IsValidMethod() {
+		logger.Debug().Msgf("unsupported method: %s", pkt.Method())
+		_ = conn.Close()
+		return ctx, nil, nil, false
+	}
+
+	return ctx, conn, pkt, true
+}
+
+func (httpFrontend) reject(conn net.Conn, pkt *packet.HttpRequest, status int) {
+	version := "HTTP/1.1"
+	if pkt != nil {
+		version = pkt.Version()
+	}
+	writeStatusAndClose(conn, version, strconv.Itoa(status)+" "+http.StatusText(status))
+}
+
+func (httpFrontend) established(lConn net.Conn, pkt *packet.HttpRequest) error {
+	_, err := lConn.Write([]byte(pkt.Version() + " 200 Connection Established\r\n\r\n"))
+	return err
+}
+
+// relaysPlain is false, as CONNECT tunnels of HTTP proxy clients are meant
+// for TLS only.
+func (httpFrontend) relaysPlain() bool {
+	return false
+}
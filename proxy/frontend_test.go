@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bariiss/SpoofDPI/proxy/auth"
+	"github.com/bariiss/SpoofDPI/util"
+)
+
+// newAuthSettings returns settings requiring the user alice with the
+// password secret.
+func newAuthSettings(t *testing.T) *settings {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte("alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := auth.LoadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &settings{users: users}
+}
+
+func TestHttpFrontendAuthentication(t *testing.T) {
+	credentials := func(s string) string {
+		return "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(s)) + "\r\n"
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{name: "missing credentials"},
+		{name: "wrong password", header: credentials("alice:wrong")},
+		{name: "unknown user", header: credentials("bob:secret")},
+		{name: "other scheme", header: "Proxy-Authorization: Bearer token\r\n"},
+		{name: "valid credentials", header: credentials("alice:secret"), ok: true},
+	}
+
+	s := newAuthSettings(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer func() {
+				_ = client.Close()
+			}()
+
+			go func() {
+				_, _ = client.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n" + tt.header + "\r\n"))
+			}()
+
+			type result struct {
+				ctx context.Context
+				ok  bool
+			}
+			done := make(chan result, 1)
+			go func() {
+				ctx, _, _, ok := httpFrontend{}.request(context.Background(), server, s)
+				done <- result{ctx, ok}
+			}()
+
+			if tt.ok {
+				r := <-done
+				if !r.ok {
+					t.Fatal("request was refused")
+				}
+				if user, _ := util.GetUserFromCtx(r.ctx); user != "alice" {
+					t.Errorf("user = %q, want alice", user)
+				}
+				return
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusProxyAuthRequired {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusProxyAuthRequired)
+			}
+			if got := resp.Header.Get("Proxy-Authenticate"); got != auth.Challenge() {
+				t.Errorf("Proxy-Authenticate = %q, want %q", got, auth.Challenge())
+			}
+			if r := <-done; r.ok {
+				t.Error("request was accepted")
+			}
+		})
+	}
+}
@@ -5,8 +5,8 @@ import (
 	"time"
 )
 
-// setConnectionTimeout sets the read deadline for the given TCP connection.
-func setConnectionTimeout(conn *net.TCPConn, timeout int) error {
+// setConnectionTimeout sets the read deadline for the given connection.
+func setConnectionTimeout(conn net.Conn, timeout int) error {
 	if timeout > 0 {
 		return conn.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(timeout)))
 	}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"strconv"
+	"sync"
 
 	"github.com/bariiss/SpoofDPI/packet"
 	"github.com/bariiss/SpoofDPI/util"
@@ -28,7 +29,7 @@ func NewHttpHandler(timeout int) *HttpHandler {
 }
 
 // Serve handles the HTTP request by establishing a connection to the requested server.
-func (h *HttpHandler) Serve(ctx context.Context, lConn *net.TCPConn, pkt *packet.HttpRequest, ip string) {
+func (h *HttpHandler) Serve(ctx context.Context, lConn net.Conn, pkt *packet.HttpRequest, ip string) {
 	ctx = util.GetCtxWithScope(ctx, h.protocol)
 	logger := log.GetCtxLogger(ctx)
 
@@ -54,18 +55,27 @@ func (h *HttpHandler) Serve(ctx context.Context, lConn *net.TCPConn, pkt *packet
 
 	logger.Debug().Msgf("new connection to the server %s -> %s", rConn.LocalAddr(), pkt.Domain())
 
-	go h.deliverResponse(ctx, rConn, lConn, pkt.Domain(), lConn.RemoteAddr().String())
-	go h.deliverRequest(ctx, lConn, rConn, lConn.RemoteAddr().String(), pkt.Domain())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		h.deliverResponse(ctx, rConn, lConn, pkt.Domain(), lConn.RemoteAddr().String())
+	}()
+	go func() {
+		defer wg.Done()
+		h.deliverRequest(ctx, lConn, rConn, lConn.RemoteAddr().String(), pkt.Domain())
+	}()
 
 	_, err = rConn.Write(pkt.Raw())
 	if err != nil {
 		logger.Debug().Msgf("error sending request to %s: %s", pkt.Domain(), err)
-		return
 	}
+
+	wg.Wait()
 }
 
 // deliverRequest reads HTTP requests from the client and forwards them to the server.
-func (h *HttpHandler) deliverRequest(ctx context.Context, from *net.TCPConn, to *net.TCPConn, fd string, td string) {
+func (h *HttpHandler) deliverRequest(ctx context.Context, from net.Conn, to net.Conn, fd string, td string) {
 	ctx = util.GetCtxWithScope(ctx, h.protocol)
 	logger := log.GetCtxLogger(ctx)
 
@@ -104,7 +114,7 @@ func (h *HttpHandler) deliverRequest(ctx context.Context, from *net.TCPConn, to
 }
 
 // deliverResponse reads HTTP responses from the server and forwards them to the client.
-func (h *HttpHandler) deliverResponse(ctx context.Context, from *net.TCPConn, to *net.TCPConn, fd string, td string) {
+func (h *HttpHandler) deliverResponse(ctx context.Context, from net.Conn, to net.Conn, fd string, td string) {
 	ctx = util.GetCtxWithScope(ctx, h.protocol)
 	logger := log.GetCtxLogger(ctx)
 
@@ -1,17 +1,23 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"github.com/rs/zerolog"
+	"io"
 	"net"
 	"regexp"
 	"strconv"
+	"sync"
 
 	"github.com/bariiss/SpoofDPI/packet"
 	"github.com/bariiss/SpoofDPI/util"
 	"github.com/bariiss/SpoofDPI/util/log"
 )
 
+// EstablishedFunc tells the client that the tunnel to the server is open.
+type EstablishedFunc func(lConn net.Conn, initPkt *packet.HttpRequest) error
+
 type HttpsHandler struct {
 	bufferSize      int
 	protocol        string
@@ -20,14 +26,21 @@ type HttpsHandler struct {
 	windowsize      int
 	exploit         bool
 	allowedPatterns []*regexp.Regexp
+	established     EstablishedFunc
+	relayPlain      bool
 }
 
 // NewHttpsHandler creates a new HttpsHandler instance with the given timeout, window size, allowed patterns, and exploit flag.
+// established answers the client once the server is connected. Tunnels that
+// do not start with a TLS client hello are relayed as is if relayPlain is
+// set, and closed otherwise.
 func NewHttpsHandler(
 	timeout int,
 	windowSize int,
 	allowedPatterns []*regexp.Regexp,
 	exploit bool,
+	established EstablishedFunc,
+	relayPlain bool,
 ) *HttpsHandler {
 	return &HttpsHandler{
 		bufferSize:      1024,
@@ -37,13 +50,15 @@ func NewHttpsHandler(
 		windowsize:      windowSize,
 		allowedPatterns: allowedPatterns,
 		exploit:         exploit,
+		established:     established,
+		relayPlain:      relayPlain,
 	}
 }
 
 // Serve handles the HTTPS request by establishing a connection to the requested server.
 func (h *HttpsHandler) Serve(
 	ctx context.Context,
-	lConn *net.TCPConn,
+	lConn net.Conn,
 	initPkt *packet.HttpRequest,
 	ip string,
 ) {
@@ -68,58 +83,134 @@ func (h *HttpsHandler) Serve(
 
 	logger.Debug().Msgf("new connection to server %s -> %s", rConn.LocalAddr(), initPkt.Domain())
 
-	// Send "200 Connection Established"
-	resp := []byte(initPkt.Version() + " 200 Connection Established\r\n\r\n")
-	if _, err := lConn.Write(resp); err != nil {
+	if err := h.established(lConn, initPkt); err != nil {
 		_ = rConn.Close()
-		logger.Debug().Msgf("failed to send 200 to %s: %s", lConn.RemoteAddr(), err)
+		_ = lConn.Close()
+		logger.Debug().Msgf("failed to send established reply to %s: %s", lConn.RemoteAddr(), err)
 		return
 	}
 
 	logger.Debug().Msgf("sent connection established to %s", lConn.RemoteAddr())
 
+	// Relay the server side right away, as some protocols let the server speak first
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.communicate(ctx, rConn, lConn, initPkt.Domain(), lConn.RemoteAddr().String())
+	}()
+	defer wg.Wait()
+
+	// Peek at the first byte to tell a TLS handshake from any other protocol
+	var first [1]byte
+	if _, err := io.ReadFull(lConn, first[:]); err != nil {
+		_ = rConn.Close()
+		_ = lConn.Close()
+		logger.Debug().Msgf("failed to read from %s: %s", lConn.RemoteAddr(), err)
+		return
+	}
+
+	if first[0] != byte(packet.TLSHandshake) {
+		h.relayNonTLS(ctx, lConn, rConn, first[:], initPkt.Domain(), &wg)
+		return
+	}
+
 	// Read ClientHello
-	m, err := packet.ReadTLSMessage(lConn)
+	m, err := packet.ReadTLSMessage(io.MultiReader(bytes.NewReader(first[:]), lConn))
 	if err != nil {
 		_ = rConn.Close()
+		_ = lConn.Close()
 		logger.Debug().Msgf("failed to read TLS message from %s: %s", lConn.RemoteAddr(), err)
 		return
 	}
 	if !m.IsClientHello() {
-		_ = rConn.Close()
-		logger.Debug().Msgf("non-client hello from %s", lConn.RemoteAddr())
+		h.relayNonTLS(ctx, lConn, rConn, m.Raw, initPkt.Domain(), &wg)
 		return
 	}
 
 	clientHello := m.Raw
 	logger.Debug().Msgf("client sent hello %d bytes", len(clientHello))
 
-	// Start communication pipes
-	go h.communicate(ctx, rConn, lConn, initPkt.Domain(), lConn.RemoteAddr().String())
-	go h.communicate(ctx, lConn, rConn, lConn.RemoteAddr().String(), initPkt.Domain())
+	h.sendClientHello(ctx, rConn, clientHello, initPkt.Domain())
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.communicate(ctx, lConn, rConn, lConn.RemoteAddr().String(), initPkt.Domain())
+	}()
+}
+
+// relayNonTLS relays a tunnel that does not start with a client hello, of
+// which data was read already, or closes it if only TLS is relayed.
+func (h *HttpsHandler) relayNonTLS(
+	ctx context.Context,
+	lConn, rConn net.Conn,
+	data []byte,
+	domain string,
+	wg *sync.WaitGroup,
+) {
+	logger := log.GetCtxLogger(ctx)
+
+	if !h.relayPlain {
+		_ = rConn.Close()
+		_ = lConn.Close()
+		logger.Debug().Msgf("non-client hello from %s", lConn.RemoteAddr())
+		return
+	}
+
+	logger.Debug().Msgf("non-tls traffic from %s, relaying as is", lConn.RemoteAddr())
+	h.relayFirst(ctx, lConn, rConn, data, domain, wg)
+}
+
+// relayFirst writes the data already read from the client to the server and
+// relays the rest of the client side.
+func (h *HttpsHandler) relayFirst(
+	ctx context.Context,
+	lConn, rConn net.Conn,
+	data []byte,
+	domain string,
+	wg *sync.WaitGroup,
+) {
+	logger := log.GetCtxLogger(ctx)
+
+	if _, err := rConn.Write(data); err != nil {
+		_ = rConn.Close()
+		_ = lConn.Close()
+		logger.Debug().Msgf("error writing to %s: %s", domain, err)
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.communicate(ctx, lConn, rConn, lConn.RemoteAddr().String(), domain)
+	}()
+}
+
+// sendClientHello writes the client hello to the server, in chunks when the
+// exploit is enabled.
+func (h *HttpsHandler) sendClientHello(ctx context.Context, rConn net.Conn, clientHello []byte, domain string) {
+	logger := log.GetCtxLogger(ctx)
 
-	// Send ClientHello (chunked or plain)
 	if h.exploit {
-		logger.Debug().Msgf("writing chunked client hello to %s", initPkt.Domain())
+		logger.Debug().Msgf("writing chunked client hello to %s", domain)
 		chunks := splitInChunks(ctx, clientHello, h.windowsize)
 		if _, err := writeChunks(rConn, chunks); err != nil {
-			logger.Debug().Msgf("error writing chunked hello to %s: %s", initPkt.Domain(), err)
-			return
+			logger.Debug().Msgf("error writing chunked hello to %s: %s", domain, err)
 		}
 		return
 	}
 
-	logger.Debug().Msgf("writing plain client hello to %s", initPkt.Domain())
+	logger.Debug().Msgf("writing plain client hello to %s", domain)
 	if _, err := rConn.Write(clientHello); err != nil {
-		logger.Debug().Msgf("error writing plain hello to %s: %s", initPkt.Domain(), err)
-		return
+		logger.Debug().Msgf("error writing plain hello to %s: %s", domain, err)
 	}
 }
 
 // communicate handles the communication between the client and server.
 func (h *HttpsHandler) communicate(
 	ctx context.Context,
-	from, to *net.TCPConn,
+	from, to net.Conn,
 	fd, td string,
 ) {
 	ctx = util.GetCtxWithScope(ctx, h.protocol)
@@ -172,7 +263,7 @@ func splitInChunks(ctx context.Context, data []byte, size int) [][]byte {
 }
 
 // writeChunks writes the given byte slices to the connection.
-func writeChunks(conn *net.TCPConn, c [][]byte) (n int, err error) {
+func writeChunks(conn net.Conn, c [][]byte) (n int, err error) {
 	total := 0
 	for i := 0; i < len(c); i++ {
 		b, err := conn.Write(c[i])
@@ -186,7 +277,7 @@ func writeChunks(conn *net.TCPConn, c [][]byte) (n int, err error) {
 	return total, nil
 }
 
-func (h *HttpsHandler) closeBoth(from, to *net.TCPConn, fd, td string, logger zerolog.Logger) {
+func (h *HttpsHandler) closeBoth(from, to net.Conn, fd, td string, logger zerolog.Logger) {
 	if err := from.Close(); err != nil {
 		logger.Debug().Msgf("error closing from (%s): %s", fd, err)
 	}
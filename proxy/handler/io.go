@@ -6,9 +6,9 @@ import (
 	"net"
 )
 
-// ReadBytes reads bytes from the TCP connection into the provided destination buffer.
+// ReadBytes reads bytes from the connection into the provided destination buffer.
 // It returns a slice of the data read and any error encountered.
-func ReadBytes(conn *net.TCPConn, dest []byte) ([]byte, error) {
+func ReadBytes(conn net.Conn, dest []byte) ([]byte, error) {
 	n, err := conn.Read(dest)
 	if err != nil {
 		var opError *net.OpError
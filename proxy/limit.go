@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bariiss/SpoofDPI/util"
+)
+
+// limiter bounds the number of concurrent connections overall, per client
+// address and per destination, and the rate of upstream dials. A zero limit
+// means unlimited. When a limit is reached, callers wait up to maxWait for a
+// slot to be released before giving up. The limits can be changed at any
+// time, while the counts of the connections already running are kept.
+type limiter struct {
+	mu           sync.Mutex
+	maxConns     int
+	maxPerClient int
+	maxPerDest   int
+	maxWait      time.Duration
+	released     chan struct{}
+	total        int
+	perClient    map[string]int
+	perDest      map[string]int
+
+	dials dialRate
+}
+
+// newLimiter creates a limiter with the limits from the given configuration.
+func newLimiter(config *util.Config) *limiter {
+	l := &limiter{
+		released:  make(chan struct{}),
+		perClient: make(map[string]int),
+		perDest:   make(map[string]int),
+	}
+	l.update(config)
+	return l
+}
+
+// update replaces the limits with the ones from the given configuration.
+// Connections beyond lowered limits are not closed, but new ones wait until
+// enough of them are done.
+func (l *limiter) update(config *util.Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.maxConns = config.MaxConns
+	l.maxPerClient = config.MaxConnsPerClient
+	l.maxPerDest = config.MaxConnsPerDest
+	l.maxWait = time.Duration(config.LimitWait) * time.Millisecond
+	l.dials.setRate(config.MaxDialsPerSec)
+
+	// Waiting callers may fit in raised limits
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// acquireConn takes a global slot for a new connection. It is called before
+// the connection is handed to its own goroutine, so that waiting for a slot
+// holds off accepting more connections. The returned release func must be
+// called once the connection is done.
+func (l *limiter) acquireConn(ctx context.Context) (func(), bool) {
+	ok := l.acquire(ctx, func() bool {
+		if l.maxConns > 0 && l.total >= l.maxConns {
+			return false
+		}
+		l.total++
+		return true
+	})
+	if !ok {
+		return nil, false
+	}
+
+	return func() {
+		l.release(func() {
+			l.total--
+		})
+	}, true
+}
+
+// acquireClient takes a per-client slot for a new connection.
+// The returned release func must be called once the connection is done.
+func (l *limiter) acquireClient(ctx context.Context, client string) (func(), bool) {
+	ok := l.acquire(ctx, func() bool {
+		if l.maxPerClient > 0 && l.perClient[client] >= l.maxPerClient {
+			return false
+		}
+		l.perClient[client]++
+		return true
+	})
+	if !ok {
+		return nil, false
+	}
+
+	return func() {
+		l.release(func() {
+			decrement(l.perClient, client)
+		})
+	}, true
+}
+
+// acquireDest takes a per-destination slot for a connection to dest.
+// The returned release func must be called once the connection is done.
+func (l *limiter) acquireDest(ctx context.Context, dest string) (func(), bool) {
+	ok := l.acquire(ctx, func() bool {
+		if l.maxPerDest > 0 && l.perDest[dest] >= l.maxPerDest {
+			return false
+		}
+		l.perDest[dest]++
+		return true
+	})
+	if !ok {
+		return nil, false
+	}
+
+	return func() {
+		l.release(func() {
+			decrement(l.perDest, dest)
+		})
+	}, true
+}
+
+// waitDial blocks until an upstream dial is allowed by the dial rate limit,
+// and reports false if that would take longer than maxWait.
+func (l *limiter) waitDial(ctx context.Context) bool {
+	l.mu.Lock()
+	maxWait := l.maxWait
+	l.mu.Unlock()
+	return l.dials.wait(ctx, maxWait)
+}
+
+// acquire calls take under the lock until it succeeds, waiting for released
+// slots in between, and gives up after maxWait or when ctx is done.
+func (l *limiter) acquire(ctx context.Context, take func() bool) bool {
+	var deadline <-chan time.Time
+
+	for {
+		l.mu.Lock()
+		if take() {
+			l.mu.Unlock()
+			return true
+		}
+		released, maxWait := l.released, l.maxWait
+		l.mu.Unlock()
+
+		if maxWait <= 0 {
+			return false
+		}
+		if deadline == nil {
+			timer := time.NewTimer(maxWait)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+
+		select {
+		case <-released:
+		case <-deadline:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// release calls free under the lock and wakes up every waiting acquire.
+func (l *limiter) release(free func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	free()
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// decrement lowers the counter for key and drops it once it reaches zero.
+func decrement(counts map[string]int, key string) {
+	if counts[key] <= 1 {
+		delete(counts, key)
+		return
+	}
+	counts[key]--
+}
+
+// dialRate spaces out dials evenly so that at most one happens per interval.
+// A zero interval allows any number of dials.
+type dialRate struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// setRate allows perSec dials per second, or any number if perSec is 0.
+func (d *dialRate) setRate(perSec int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.interval = 0
+	if perSec > 0 {
+		d.interval = time.Second / time.Duration(perSec)
+	}
+}
+
+// wait reserves the next dial slot and sleeps until it is due. It reports
+// false without reserving if the slot is further away than maxWait.
+func (d *dialRate) wait(ctx context.Context, maxWait time.Duration) bool {
+	d.mu.Lock()
+	if d.interval == 0 {
+		d.mu.Unlock()
+		return true
+	}
+	now := time.Now()
+	if d.next.Before(now) {
+		d.next = now
+	}
+	delay := d.next.Sub(now)
+	if delay > maxWait {
+		d.mu.Unlock()
+		return false
+	}
+	d.next = d.next.Add(d.interval)
+	d.mu.Unlock()
+
+	if delay == 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bariiss/SpoofDPI/util"
+)
+
+func TestLimiterSlots(t *testing.T) {
+	l := newLimiter(&util.Config{MaxConns: 2, MaxConnsPerClient: 1, MaxConnsPerDest: 1})
+	ctx := context.Background()
+
+	release1, ok := l.acquireConn(ctx)
+	if !ok {
+		t.Fatal("first connection was refused")
+	}
+	release2, ok := l.acquireConn(ctx)
+	if !ok {
+		t.Fatal("second connection was refused")
+	}
+	if _, ok := l.acquireConn(ctx); ok {
+		t.Error("connection beyond -max-conns was accepted")
+	}
+	release1()
+	release3, ok := l.acquireConn(ctx)
+	if !ok {
+		t.Error("connection was refused after a slot was released")
+	}
+	release2()
+	release3()
+
+	releaseA, ok := l.acquireClient(ctx, "192.0.2.1")
+	if !ok {
+		t.Fatal("first connection of a client was refused")
+	}
+	if _, ok := l.acquireClient(ctx, "192.0.2.1"); ok {
+		t.Error("connection beyond -max-conns-per-client was accepted")
+	}
+	releaseB, ok := l.acquireClient(ctx, "192.0.2.2")
+	if !ok {
+		t.Error("connection of another client was refused")
+	}
+
+	releaseDest, ok := l.acquireDest(ctx, "example.com")
+	if !ok {
+		t.Fatal("first connection to a destination was refused")
+	}
+	if _, ok := l.acquireDest(ctx, "example.com"); ok {
+		t.Error("connection beyond -max-conns-per-dest was accepted")
+	}
+	releaseOther, ok := l.acquireDest(ctx, "example.org")
+	if !ok {
+		t.Error("connection to another destination was refused")
+	}
+
+	releaseA()
+	releaseB()
+	releaseDest()
+	releaseOther()
+	if l.total != 0 || len(l.perClient) != 0 || len(l.perDest) != 0 {
+		t.Errorf("counts left after all releases: total %d, clients %v, destinations %v", l.total, l.perClient, l.perDest)
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	l := newLimiter(&util.Config{})
+	for range 100 {
+		if _, ok := l.acquireConn(context.Background()); !ok {
+			t.Fatal("connection was refused without a limit")
+		}
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	t.Run("slot released", func(t *testing.T) {
+		l := newLimiter(&util.Config{MaxConns: 1, LimitWait: 5000})
+		release, _ := l.acquireConn(context.Background())
+		time.AfterFunc(20*time.Millisecond, release)
+
+		if _, ok := l.acquireConn(context.Background()); !ok {
+			t.Error("waiting connection was refused after a slot was released")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		l := newLimiter(&util.Config{MaxConns: 1, LimitWait: 50})
+		_, _ = l.acquireConn(context.Background())
+
+		start := time.Now()
+		if _, ok := l.acquireConn(context.Background()); ok {
+			t.Error("connection was accepted although no slot was released")
+		}
+		if waited := time.Since(start); waited < 50*time.Millisecond {
+			t.Errorf("gave up after %s, want -limit-wait", waited)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		l := newLimiter(&util.Config{MaxConns: 1, LimitWait: 5000})
+		_, _ = l.acquireConn(context.Background())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if _, ok := l.acquireConn(ctx); ok {
+			t.Error("connection was accepted after its context was done")
+		}
+	})
+}
+
+func TestLimiterContention(t *testing.T) {
+	const maxConns = 3
+	l := newLimiter(&util.Config{MaxConns: maxConns, MaxConnsPerClient: 2, LimitWait: 5000})
+
+	var (
+		wg       sync.WaitGroup
+		running  atomic.Int32
+		peak     atomic.Int32
+		refused  atomic.Int32
+		perAddr  [2]atomic.Int32
+		addrPeak atomic.Int32
+	)
+	for i := range 30 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := [2]string{"192.0.2.1", "192.0.2.2"}[i%2]
+
+			releaseConn, ok := l.acquireConn(context.Background())
+			if !ok {
+				refused.Add(1)
+				return
+			}
+			defer releaseConn()
+			releaseClient, ok := l.acquireClient(context.Background(), client)
+			if !ok {
+				refused.Add(1)
+				return
+			}
+			defer releaseClient()
+
+			storeMax(&peak, running.Add(1))
+			defer running.Add(-1)
+			storeMax(&addrPeak, perAddr[i%2].Add(1))
+			defer perAddr[i%2].Add(-1)
+
+			time.Sleep(time.Millisecond)
+		}()
+	}
+	wg.Wait()
+
+	if n := refused.Load(); n != 0 {
+		t.Errorf("%d connections were refused while waiting", n)
+	}
+	if p := peak.Load(); p > maxConns {
+		t.Errorf("%d connections ran at once, want at most %d", p, maxConns)
+	}
+	if p := addrPeak.Load(); p > 2 {
+		t.Errorf("%d connections of a client ran at once, want at most 2", p)
+	}
+	if l.total != 0 || len(l.perClient) != 0 {
+		t.Errorf("counts left after all releases: total %d, clients %v", l.total, l.perClient)
+	}
+}
+
+// storeMax raises v to n if n is larger.
+func storeMax(v *atomic.Int32, n int32) {
+	for p := v.Load(); n > p && !v.CompareAndSwap(p, n); p = v.Load() {
+	}
+}
+
+func TestLimiterUpdate(t *testing.T) {
+	t.Run("lowered", func(t *testing.T) {
+		l := newLimiter(&util.Config{MaxConns: 3})
+		var releases []func()
+		for range 3 {
+			release, _ := l.acquireConn(context.Background())
+			releases = append(releases, release)
+		}
+
+		// The running connections are kept, but no new one fits until
+		// enough of them are done
+		l.update(&util.Config{MaxConns: 1})
+		releases[0]()
+		if _, ok := l.acquireConn(context.Background()); ok {
+			t.Error("connection was accepted beyond the lowered limit")
+		}
+		releases[1]()
+		releases[2]()
+		if _, ok := l.acquireConn(context.Background()); !ok {
+			t.Error("connection was refused below the lowered limit")
+		}
+	})
+
+	t.Run("raised", func(t *testing.T) {
+		l := newLimiter(&util.Config{MaxConns: 1, LimitWait: 5000})
+		_, _ = l.acquireConn(context.Background())
+
+		// Waiting connections fit in the raised limit right away
+		time.AfterFunc(20*time.Millisecond, func() {
+			l.update(&util.Config{MaxConns: 2, LimitWait: 5000})
+		})
+		start := time.Now()
+		if _, ok := l.acquireConn(context.Background()); !ok {
+			t.Error("waiting connection was refused after the limit was raised")
+		}
+		if waited := time.Since(start); waited > 2*time.Second {
+			t.Errorf("waited %s for the raised limit", waited)
+		}
+	})
+}
+
+func TestLimiterWaitDial(t *testing.T) {
+	t.Run("spacing", func(t *testing.T) {
+		l := newLimiter(&util.Config{MaxDialsPerSec: 20, LimitWait: 5000})
+
+		start := time.Now()
+		for range 4 {
+			if !l.waitDial(context.Background()) {
+				t.Fatal("dial was refused while waiting")
+			}
+		}
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+			t.Errorf("4 dials took %s, want them spaced 50ms apart", elapsed)
+		}
+	})
+
+	t.Run("no wait", func(t *testing.T) {
+		l := newLimiter(&util.Config{MaxDialsPerSec: 1})
+		if !l.waitDial(context.Background()) {
+			t.Fatal("first dial was refused")
+		}
+		if l.waitDial(context.Background()) {
+			t.Error("second dial within a second was allowed")
+		}
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		l := newLimiter(&util.Config{})
+		for range 100 {
+			if !l.waitDial(context.Background()) {
+				t.Fatal("dial was refused without a rate limit")
+			}
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		l := newLimiter(&util.Config{MaxDialsPerSec: 1, LimitWait: 5000})
+		_ = l.waitDial(context.Background())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if l.waitDial(ctx) {
+			t.Error("dial was allowed after its context was done")
+		}
+	})
+}
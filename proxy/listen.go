@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/bariiss/SpoofDPI/privilege"
+	"github.com/bariiss/SpoofDPI/util"
+)
+
+// activeListener is an open listener and the configuration it is served with.
+type activeListener struct {
+	l      net.Listener
+	config util.ListenerConfig
+}
+
+// Inherit makes the proxy serve listeners that were opened by someone else,
+// e.g. passed by systemd socket activation. Each one replaces the configured
+// listener with the same address, and the rest are served as http listeners.
+// The default listener is not opened when there are inherited ones. It must
+// be called before Start.
+func (pxy *Proxy) Inherit(listeners []net.Listener) {
+	pxy.inherited = append(pxy.inherited, listeners...)
+}
+
+// Listen opens the listeners without serving them yet, so that the process
+// can drop its privileges in between. Start calls it if it was not called
+// before.
+func (pxy *Proxy) Listen() error {
+	active, err := pxy.openListeners()
+	if err != nil {
+		return err
+	}
+	pxy.active = active
+	return nil
+}
+
+// Files returns duplicates of the open listeners' file descriptors, to pass
+// them on to a new process.
+func (pxy *Proxy) Files() ([]*os.File, error) {
+	files := make([]*os.File, 0, len(pxy.active))
+	for _, al := range pxy.active {
+		var (
+			f   *os.File
+			err error
+		)
+		switch l := al.l.(type) {
+		case *net.TCPListener:
+			f, err = l.File()
+		case *net.UnixListener:
+			f, err = l.File()
+		default:
+			err = fmt.Errorf("unsupported listener type %T", l)
+		}
+		if err != nil {
+			for _, f := range files {
+				_ = f.Close()
+			}
+			return nil, fmt.Errorf("listener %s: %w", al.config, err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// HandedOver tells the proxy that a new process took over the listeners of
+// Files. Unix sockets are then no longer removed when their listener is
+// closed, as the new process keeps serving them.
+func (pxy *Proxy) HandedOver() {
+	for _, al := range pxy.active {
+		if l, ok := al.l.(*net.UnixListener); ok {
+			l.SetUnlinkOnClose(false)
+		}
+	}
+}
+
+// openListeners opens the configured listeners, using inherited ones where
+// possible. On error, all listeners are closed again.
+func (pxy *Proxy) openListeners() ([]activeListener, error) {
+	inherited := slices.Clone(pxy.inherited)
+	active := make([]activeListener, 0, len(pxy.listeners)+len(inherited))
+
+	closeAll := func() {
+		for _, al := range active {
+			_ = al.l.Close()
+		}
+		for _, l := range inherited {
+			_ = l.Close()
+		}
+	}
+
+	for _, lc := range pxy.listeners {
+		i := slices.IndexFunc(inherited, func(l net.Listener) bool {
+			return sameAddr(l, lc)
+		})
+		if i >= 0 {
+			active = append(active, activeListener{l: inherited[i], config: lc})
+			inherited = slices.Delete(inherited, i, i+1)
+			continue
+		}
+
+		if len(pxy.inherited) > 0 && pxy.defaultListener {
+			continue
+		}
+
+		l, err := listen(lc)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("error creating listener %s: %w", lc, err)
+		}
+		active = append(active, activeListener{l: l, config: lc})
+	}
+
+	for _, l := range inherited {
+		lc := util.ListenerConfig{
+			Proto:   util.ProtoHTTP,
+			Network: l.Addr().Network(),
+			Addr:    l.Addr().String(),
+		}
+		active = append(active, activeListener{l: l, config: lc})
+	}
+
+	return active, nil
+}
+
+// sameAddr reports whether l listens on the address configured by lc.
+// Unspecified addresses such as 0.0.0.0 and [::] are considered the same,
+// as a dual-stack socket serves both.
+func sameAddr(l net.Listener, lc util.ListenerConfig) bool {
+	switch addr := l.Addr().(type) {
+	case *net.UnixAddr:
+		return lc.Network == util.NetworkUnix && addr.Name == lc.Addr
+	case *net.TCPAddr:
+		if lc.Network != util.NetworkTCP {
+			return false
+		}
+		want, err := net.ResolveTCPAddr("tcp", lc.Addr)
+		if err != nil || want.Port != addr.Port {
+			return false
+		}
+		return want.IP.Equal(addr.IP) || (isUnspecified(want.IP) && isUnspecified(addr.IP))
+	}
+	return false
+}
+
+// isUnspecified reports whether ip is empty or an unspecified address.
+func isUnspecified(ip net.IP) bool {
+	return len(ip) == 0 || ip.IsUnspecified()
+}
+
+// listen opens the listener described by lc.
+func listen(lc util.ListenerConfig) (net.Listener, error) {
+	if lc.Network != util.NetworkUnix {
+		return net.Listen("tcp", lc.Addr)
+	}
+	return listenUnix(lc)
+}
+
+// listenUnix opens a Unix socket listener and applies the configured file
+// mode and owner to the socket. A socket file left behind by a previous run
+// is replaced, unless another process is still serving on it.
+func listenUnix(lc util.ListenerConfig) (net.Listener, error) {
+	if fi, err := os.Lstat(lc.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", lc.Addr); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("socket %s is in use", lc.Addr)
+		}
+		if err := os.Remove(lc.Addr); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", lc.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if lc.Mode != 0 {
+		if err := os.Chmod(lc.Addr, lc.Mode); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+
+	if lc.Owner != "" {
+		uid, gid, err := lookupOwner(lc.Owner)
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+		if err := os.Chown(lc.Addr, uid, gid); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// lookupOwner resolves an owner of the form "user[:group]", where both parts
+// are names or numeric ids. A missing part is returned as -1, which leaves it
+// unchanged on chown.
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName, _ := strings.Cut(owner, ":")
+
+	uid, gid := -1, -1
+	if userName != "" {
+		id, _, err := privilege.LookupUser(userName)
+		if err != nil {
+			return 0, 0, err
+		}
+		uid = id
+	}
+
+	if groupName != "" {
+		id, err := privilege.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid = id
+	}
+
+	return uid, gid, nil
+}
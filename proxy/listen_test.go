@@ -0,0 +1,39 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandedOverUnixSocket(t *testing.T) {
+	for _, handedOver := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "proxy.sock")
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pxy := &Proxy{active: []activeListener{{l: l}}}
+		files, err := pxy.Files()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			_ = f.Close()
+		}
+		if handedOver {
+			pxy.HandedOver()
+		}
+		_ = l.Close()
+
+		// An abandoned restart leaves no socket file behind
+		_, err = os.Stat(path)
+		if exists := err == nil; exists != handedOver {
+			t.Errorf("handed over %t: socket file exists %t", handedOver, exists)
+		}
+	}
+}
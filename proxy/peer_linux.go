@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// unixPeer identifies a Unix socket client by the credentials of its
+// process, e.g. "unix:pid=1234,uid=1000".
+func unixPeer(conn *net.UnixConn) string {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return unixConnID(conn)
+	}
+
+	var (
+		cred    *unix.Ucred
+		credErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return unixConnID(conn)
+	}
+	return fmt.Sprintf("unix:pid=%d,uid=%d", cred.Pid, cred.Uid)
+}
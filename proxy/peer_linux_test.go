@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClientHostUnix(t *testing.T) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "spoofdpi.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = l.Close()
+	}()
+
+	client, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	want := fmt.Sprintf("unix:pid=%d,uid=%d", os.Getpid(), os.Getuid())
+	if got := clientHost(conn); got != want {
+		t.Errorf("clientHost() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package proxy
+
+import "net"
+
+// unixPeer identifies a Unix socket client by its connection, as peer
+// credentials are only read on linux.
+func unixPeer(conn *net.UnixConn) string {
+	return unixConnID(conn)
+}
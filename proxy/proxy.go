@@ -2,151 +2,383 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
-	"os"
-	"regexp"
+	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/bariiss/SpoofDPI/dns"
+	"github.com/bariiss/SpoofDPI/dns/resolver"
 	"github.com/bariiss/SpoofDPI/packet"
 	"github.com/bariiss/SpoofDPI/proxy/handler"
 	"github.com/bariiss/SpoofDPI/util"
 	"github.com/bariiss/SpoofDPI/util/log"
+	"github.com/miekg/dns"
 )
 
 const scopeProxy = "PROXY"
 
 type Proxy struct {
-	addr           string
-	port           int
-	timeout        int
-	resolver       *dns.Dns
-	windowSize     int
-	enableDoh      bool
-	allowedPattern []*regexp.Regexp
+	listeners       []util.ListenerConfig
+	defaultListener bool
+	inherited       []net.Listener
+	active          []activeListener
+	ready           chan struct{}
+	gracePeriod     time.Duration
+	settings        atomic.Pointer[settings]
+	conns           connSet
+	limiter         *limiter
+	stats           stats
+	poisoned        *resolver.PoisonCounter
 }
 
 type Handler interface {
-	Serve(ctx context.Context, lConn *net.TCPConn, pkt *packet.HttpRequest, ip string)
+	// Serve relays the connection and returns once both directions are closed.
+	Serve(ctx context.Context, lConn net.Conn, pkt *packet.HttpRequest, ip string)
 }
 
-func New(config *util.Config) *Proxy {
-	return &Proxy{
-		addr:           config.Addr,
-		port:           config.Port,
-		timeout:        config.Timeout,
-		windowSize:     config.WindowSize,
-		enableDoh:      config.EnableDoh,
-		allowedPattern: config.AllowedPatterns,
-		resolver:       dns.NewDns(config),
+// New creates a new Proxy with the given configuration.
+func New(config *util.Config) (*Proxy, error) {
+	poisoned := resolver.NewPoisonCounter()
+	s, err := newSettings(config, nil, poisoned)
+	if err != nil {
+		return nil, err
+	}
+
+	pxy := &Proxy{
+		listeners:       config.Listeners,
+		defaultListener: config.IsDefaultListener(),
+		ready:           make(chan struct{}),
+		gracePeriod:     time.Duration(config.GracePeriod) * time.Second,
+		limiter:         newLimiter(config),
+		poisoned:        poisoned,
 	}
+	pxy.settings.Store(s)
+	return pxy, nil
 }
 
-// Start starts the proxy server and listens for incoming connections.
-func (pxy *Proxy) Start(ctx context.Context) {
+// Reload atomically replaces the rules, patterns, users, dns settings and
+// connection limits with the ones from config. New connections use them
+// right away while existing connections keep running with the settings they
+// started with. If config is invalid, the current settings are kept.
+func (pxy *Proxy) Reload(ctx context.Context, config *util.Config) error {
 	ctx = util.GetCtxWithScope(ctx, scopeProxy)
 	logger := log.GetCtxLogger(ctx)
 
-	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(pxy.addr), Port: pxy.port})
+	s, err := newSettings(config, pxy.settings.Load(), pxy.poisoned)
 	if err != nil {
-		logger.Fatal().Msgf("error creating listener: %s", err)
-		os.Exit(1)
+		return err
 	}
 
-	if pxy.timeout > 0 {
-		logger.Info().Msgf("connection timeout is set to %d ms", pxy.timeout)
+	for _, l := range pxy.listeners {
+		if _, ok := s.profiles[l.Profile]; l.Profile != "" && !ok {
+			return fmt.Errorf("listener %s: profile %q is missing from the new config", l, l.Profile)
+		}
 	}
 
-	logger.Info().Msgf("created a listener on port %d", pxy.port)
-	if len(pxy.allowedPattern) > 0 {
-		logger.Info().Msgf("number of white-listed pattern: %d", len(pxy.allowedPattern))
+	if !slices.Equal(config.Listeners, pxy.listeners) {
+		logger.Warn().Msgf("listener changes to %v require a restart", config.Listeners)
 	}
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			logger.Fatal().Msgf("error accepting connection: %s", err)
-			continue
+	s.resolver.Reload(ctx, config)
+	pxy.settings.Store(s)
+	pxy.limiter.update(config)
+	logger.Info().Msgf("settings reloaded; number of white-listed pattern: %d", len(config.AllowedPatterns))
+	return nil
+}
+
+// Start starts the proxy server and serves incoming connections on every
+// listener until ctx is done. It then stops accepting, waits up to the grace
+// period for active connections to finish and force-closes the rest.
+func (pxy *Proxy) Start(ctx context.Context) error {
+	ctx = util.GetCtxWithScope(ctx, scopeProxy)
+	logger := log.GetCtxLogger(ctx)
+
+	if pxy.active == nil {
+		if err := pxy.Listen(); err != nil {
+			return err
+		}
+	}
+
+	s := pxy.settings.Load()
+	if s.timeout > 0 {
+		logger.Info().Msgf("connection timeout is set to %d ms", s.timeout)
+	}
+
+	if len(s.allowedPattern) > 0 {
+		logger.Info().Msgf("number of white-listed pattern: %d", len(s.allowedPattern))
+	}
+
+	var wg sync.WaitGroup
+	for _, al := range pxy.active {
+		l, lc := al.l, al.config
+		logger.Info().Msgf("created a %s listener on %s", lc.Proto, l.Addr())
+		if lc.Proto == util.ProtoTransparent && s.users != nil {
+			logger.Warn().Msgf("clients of the transparent listener on %s cannot authenticate; restrict them with -allow-client", l.Addr())
 		}
 
 		go func() {
-			ctx := util.GetCtxWithTraceId(ctx)
-			logger := log.GetCtxLogger(ctx)
-
-			pkt, err := packet.ReadHttpRequest(conn)
-			if err != nil {
-				logger.Debug().Msgf("error while parsing request: %s", err)
-				err := conn.Close()
-				if err != nil {
-					return
-				}
-				return
+			<-ctx.Done()
+			if err := l.Close(); err != nil {
+				logger.Debug().Msgf("error closing listener: %s", err)
 			}
+		}()
 
-			pkt.Tidy()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pxy.serve(ctx, l, lc)
+		}()
+	}
+	close(pxy.ready)
+	wg.Wait()
 
-			logger.Debug().Msgf("request from %s\n\n%s", conn.RemoteAddr(), string(pkt.Raw()))
+	pxy.drain(ctx)
+	return nil
+}
 
-			if !pkt.IsValidMethod() {
-				logger.Debug().Msgf("unsupported method: %s", pkt.Method())
-				err := conn.Close()
-				if err != nil {
-					return
-				}
-				return
-			}
+// serve accepts connections until the listener is closed. Other accept
+// errors, such as running out of file descriptors, are retried with an
+// exponential backoff instead of stopping the proxy.
+func (pxy *Proxy) serve(ctx context.Context, l net.Listener, lc util.ListenerConfig) {
+	fe := newFrontend(lc.Proto)
+	logger := log.GetCtxLogger(ctx)
 
-			matched := pxy.patternMatches([]byte(pkt.Domain()))
-			useSystemDns := !matched
-
-			ip, err := pxy.resolver.ResolveHost(ctx, pkt.Domain(), pxy.enableDoh, useSystemDns)
-			if err != nil {
-				logger.Debug().Msgf("error while dns lookup: %s %s", pkt.Domain(), err)
-				_, _ = conn.Write([]byte(pkt.Version() + " 502 Bad Gateway\r\n\r\n"))
-				err := conn.Close()
-				if err != nil {
-					return
-				}
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
 				return
 			}
 
-			// Avoid recursively querying self
-			if pkt.Port() == strconv.Itoa(pxy.port) && isLoopedRequest(ctx, net.ParseIP(ip)) {
-				logger.Error().Msg("looped request has been detected. aborting.")
-				err := conn.Close()
-				if err != nil {
-					return
-				}
-				return
+			pxy.stats.acceptErrors.Add(1)
+			delay = nextAcceptDelay(delay)
+			if isTemporaryAcceptError(err) {
+				logger.Warn().Msgf("error accepting connection: %s; retrying in %s", err, delay)
+			} else {
+				logger.Error().Msgf("error accepting connection: %s; retrying in %s", err, delay)
 			}
 
-			var h Handler
-			if pkt.IsConnectMethod() {
-				h = handler.NewHttpsHandler(pxy.timeout, pxy.windowSize, pxy.allowedPattern, matched)
-			} else {
-				h = handler.NewHttpHandler(pxy.timeout)
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
 			}
+			continue
+		}
+		delay = 0
 
-			h.Serve(ctx, conn.(*net.TCPConn), pkt, ip)
+		pxy.stats.accepted.Add(1)
+		if !pxy.settings.Load().clientAllowed(conn.RemoteAddr()) {
+			pxy.stats.denied.Add(1)
+			logger.Info().Msgf("connection from %s denied by client acl", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+
+		// Waiting for a global slot here leaves the connections beyond the
+		// limit in the listen backlog instead of holding a goroutine each
+		releaseConn, ok := pxy.limiter.acquireConn(ctx)
+		if !ok {
+			pxy.stats.limited.Add(1)
+			logger.Debug().Msgf("connection limit reached, refusing %s", conn.RemoteAddr())
+			go fe.reject(conn, nil, http.StatusServiceUnavailable)
+			continue
+		}
+
+		pxy.conns.add(conn)
+		go func() {
+			defer pxy.conns.done(conn)
+			defer releaseConn()
+			pxy.handleConn(ctx, conn, fe, lc.Profile)
 		}()
 	}
 }
 
-// patternMatches checks if the given bytes match any of the allowed patterns.
-func (pxy *Proxy) patternMatches(bytes []byte) bool {
-	if pxy.allowedPattern == nil {
-		return true
+// drain waits up to the grace period for active connections to finish and
+// then force-closes the remaining ones.
+func (pxy *Proxy) drain(ctx context.Context) {
+	logger := log.GetCtxLogger(ctx)
+
+	active := pxy.conns.len()
+	if active == 0 {
+		return
 	}
 
-	for _, pattern := range pxy.allowedPattern {
-		if pattern.Match(bytes) {
-			return true
+	logger.Info().Msgf("waiting up to %s for %d active connections to finish", pxy.gracePeriod, active)
+	if pxy.conns.wait(pxy.gracePeriod) {
+		return
+	}
+
+	logger.Info().Msgf("grace period is over, closing %d connections", pxy.conns.len())
+	pxy.conns.closeAll()
+	pxy.conns.wait(pxy.gracePeriod)
+}
+
+// handleConn reads the first request from the client through the listener's
+// frontend and hands the connection over to the matching handler.
+func (pxy *Proxy) handleConn(ctx context.Context, conn net.Conn, fe frontend, profile string) {
+	ctx = util.GetCtxWithTraceId(ctx)
+	logger := log.GetCtxLogger(ctx)
+	s := pxy.settings.Load()
+
+	client := clientHost(conn)
+	releaseClient, ok := pxy.limiter.acquireClient(ctx, client)
+	if !ok {
+		pxy.stats.limited.Add(1)
+		logger.Debug().Msgf("connection limit reached for client %s", client)
+		fe.reject(conn, nil, http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseClient()
+
+	ctx, conn, pkt, ok := fe.request(ctx, conn, s)
+	if !ok {
+		return
+	}
+	logger = log.GetCtxLogger(ctx)
+
+	if pkt.IsConnectMethod() && !s.portAllowed(connectPort(pkt)) {
+		pxy.stats.forbidden.Add(1)
+		logger.Warn().Msgf("tunnel to port %d of %s is not allowed, refused for client %s", connectPort(pkt), pkt.Domain(), client)
+		fe.reject(conn, pkt, http.StatusForbidden)
+		return
+	}
+
+	releaseDest, ok := pxy.limiter.acquireDest(ctx, pkt.Domain())
+	if !ok {
+		pxy.stats.limited.Add(1)
+		logger.Debug().Msgf("connection limit reached for destination %s", pkt.Domain())
+		fe.reject(conn, pkt, http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseDest()
+
+	matched := s.patternMatches(profile, []byte(pkt.ServerName()))
+
+	ip, err := s.resolver.ResolveHost(ctx, pkt.Domain(), matched)
+	if err != nil {
+		logger.Debug().Msgf("error while dns lookup: %s %s", pkt.Domain(), err)
+		fe.reject(conn, pkt, http.StatusBadGateway)
+		return
+	}
+
+	if !s.destinationAllowed(ip) {
+		pxy.stats.forbidden.Add(1)
+		logger.Warn().Msgf("destination %s (%s) is in a forbidden range, refused for client %s", pkt.Domain(), ip, client)
+		fe.reject(conn, pkt, http.StatusForbidden)
+		return
+	}
+
+	// Avoid recursively querying self
+	if pxy.isListenPort(pkt.Port()) && isLoopedRequest(ctx, net.ParseIP(ip)) {
+		logger.Error().Msg("looped request has been detected. aborting.")
+		err := conn.Close()
+		if err != nil {
+			return
 		}
+		return
+	}
+
+	if !pxy.limiter.waitDial(ctx) {
+		pxy.stats.limited.Add(1)
+		logger.Debug().Msgf("dial rate limit reached for %s", pkt.Domain())
+		fe.reject(conn, pkt, http.StatusServiceUnavailable)
+		return
+	}
+
+	var h Handler
+	if pkt.IsConnectMethod() {
+		h = handler.NewHttpsHandler(s.timeout, s.windowSize, s.patterns(profile), matched, fe.established, fe.relaysPlain())
+	} else {
+		h = handler.NewHttpHandler(s.timeout)
+	}
+
+	h.Serve(ctx, conn, pkt, ip)
+}
+
+// ExchangeDNS answers a query of the local dns server with the resolver
+// selected like for proxied connections, by the dns rules and whether the
+// name matches the patterns. The query must have exactly one question.
+func (pxy *Proxy) ExchangeDNS(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if len(msg.Question) != 1 {
+		return nil, fmt.Errorf("query has %d questions, want 1", len(msg.Question))
 	}
 
+	s := pxy.settings.Load()
+	name := strings.TrimSuffix(msg.Question[0].Name, ".")
+	matched := s.patternMatches("", []byte(name))
+	return s.resolver.Exchange(ctx, msg, matched)
+}
+
+// Ready returns a channel that is closed once all listeners are open.
+func (pxy *Proxy) Ready() <-chan struct{} {
+	return pxy.ready
+}
+
+// isListenPort reports whether port is the port of any of the listeners.
+func (pxy *Proxy) isListenPort(port string) bool {
+	for _, al := range pxy.active {
+		if _, p, err := net.SplitHostPort(al.config.Addr); err == nil && p == port {
+			return true
+		}
+	}
 	return false
 }
 
+// writeStatusAndClose answers the client with an empty response with the
+// given status line and header lines, and closes the connection.
+func writeStatusAndClose(conn net.Conn, version, status string, headers ...string) {
+	var sb strings.Builder
+	sb.WriteString(version + " " + status + "\r\n")
+	for _, header := range headers {
+		sb.WriteString(header + "\r\n")
+	}
+	sb.WriteString("\r\n")
+
+	_, _ = conn.Write([]byte(sb.String()))
+	_ = conn.Close()
+}
+
+// connectPort returns the destination port of a CONNECT request, which
+// defaults to 443 when not given, or 0 if it is invalid.
+func connectPort(pkt *packet.HttpRequest) int {
+	if pkt.Port() == "" {
+		return 443
+	}
+
+	port, err := strconv.Atoi(pkt.Port())
+	if err != nil {
+		return 0
+	}
+	return port
+}
+
+// clientHost returns the host part of the client's remote address. Clients
+// on Unix sockets have no address and are told apart by their process.
+func clientHost(conn net.Conn) string {
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		return unixPeer(unixConn)
+	}
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// unixConnID identifies a Unix socket client by its connection, when its
+// process cannot be told.
+func unixConnID(conn *net.UnixConn) string {
+	return fmt.Sprintf("unix:%p", conn)
+}
+
 // isLoopedRequest checks if the given IP address is a loop back address or matches any of the local addresses.
 func isLoopedRequest(ctx context.Context, ip net.IP) bool {
 	if ip.IsLoopback() {
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"net/netip"
+	"regexp"
+
+	"github.com/bariiss/SpoofDPI/dns"
+	"github.com/bariiss/SpoofDPI/dns/resolver"
+	"github.com/bariiss/SpoofDPI/packet"
+	"github.com/bariiss/SpoofDPI/proxy/auth"
+	"github.com/bariiss/SpoofDPI/util"
+	"github.com/bariiss/SpoofDPI/util/log"
+)
+
+// settings holds the part of the configuration that can be replaced at
+// runtime. Each connection uses the snapshot that was current when it was
+// accepted, so a reload never affects established tunnels.
+type settings struct {
+	timeout        int
+	resolver       *dns.Dns
+	windowSize     int
+	allowedPattern []*regexp.Regexp
+	profiles       map[string][]*regexp.Regexp
+	users          *auth.Htpasswd
+	allowClients   []netip.Prefix
+	denyClients    []netip.Prefix
+
+	forbiddenRanges     []netip.Prefix
+	forbiddenExceptions []netip.Prefix
+	allowedPorts        []util.PortRange
+}
+
+// newSettings creates the runtime settings from the given configuration.
+// The dns resolver of prev, if any, is kept and has to be reloaded once the
+// settings are in use; otherwise a new one counts poisoned dns answers in
+// poisoned.
+func newSettings(config *util.Config, prev *settings, poisoned *resolver.PoisonCounter) (*settings, error) {
+	s := &settings{
+		timeout:        config.Timeout,
+		windowSize:     config.WindowSize,
+		allowedPattern: config.AllowedPatterns,
+		profiles:       config.Profiles,
+		allowClients:   config.AllowClients,
+		denyClients:    config.DenyClients,
+	}
+
+	if prev != nil {
+		s.resolver = prev.resolver
+	} else {
+		s.resolver = dns.NewDns(config, poisoned)
+	}
+
+	if config.ForbidPrivate {
+		s.forbiddenRanges = append(s.forbiddenRanges, privateRanges...)
+	}
+	s.forbiddenRanges = append(s.forbiddenRanges, config.ForbiddenRanges...)
+	s.forbiddenExceptions = config.ForbiddenExceptions
+	s.allowedPorts = config.AllowedPorts
+
+	if config.Htpasswd != "" {
+		users, err := auth.LoadHtpasswd(config.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		s.users = users
+	}
+
+	return s, nil
+}
+
+// patterns returns the allowed patterns of the given profile, or the global
+// ones if profile is empty.
+func (s *settings) patterns(profile string) []*regexp.Regexp {
+	if profile == "" {
+		return s.allowedPattern
+	}
+	return s.profiles[profile]
+}
+
+// patternMatches checks if the given bytes match any of the allowed patterns
+// of the given profile.
+func (s *settings) patternMatches(profile string, bytes []byte) bool {
+	patterns := s.patterns(profile)
+	if patterns == nil {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if pattern.Match(bytes) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authenticate checks the Proxy-Authorization header of the request when
+// authentication is enabled, and returns a context carrying the user name.
+func (s *settings) authenticate(ctx context.Context, pkt *packet.HttpRequest) (context.Context, bool) {
+	if s.users == nil {
+		return ctx, true
+	}
+
+	header := pkt.Header("Proxy-Authorization")
+	if header == "" {
+		return ctx, false
+	}
+
+	user, password, ok := auth.ParseBasic(header)
+	if !ok || !s.users.Verify(user, password) {
+		logger := log.GetCtxLogger(ctx)
+		logger.Warn().Msgf("invalid proxy credentials for user %q", user)
+		return ctx, false
+	}
+
+	return util.GetCtxWithUser(ctx, user), true
+}
+
+// portAllowed checks if a CONNECT tunnel to the given port is allowed.
+func (s *settings) portAllowed(port int) bool {
+	for _, r := range s.allowedPorts {
+		if port > 0 && port <= 65535 && r.Contains(uint16(port)) {
+			return true
+		}
+	}
+	return false
+}
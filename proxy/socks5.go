@@ -0,0 +1,320 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/bariiss/SpoofDPI/packet"
+	"github.com/bariiss/SpoofDPI/util"
+	"github.com/bariiss/SpoofDPI/util/log"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xff
+
+	socks5UserPassVersion = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5Succeeded           = 0x00
+	socks5GeneralFailure      = 0x01
+	socks5NotAllowed          = 0x02
+	socks5HostUnreachable     = 0x04
+	socks5ConnRefused         = 0x05
+	socks5CmdNotSupported     = 0x07
+	socks5AddrTypeUnsupported = 0x08
+)
+
+// socks5RejectTimeout limits the handshake done only to refuse a client.
+const socks5RejectTimeout = 2 * time.Second
+
+// socks5ReplyError is returned for requests that should be answered with a
+// reply code before closing the connection.
+type socks5ReplyError struct {
+	rep byte
+	err error
+}
+
+func (e *socks5ReplyError) Error() string {
+	return e.err.Error()
+}
+
+// socks5Frontend serves SOCKS5 clients. Only the CONNECT command is
+// supported. When proxy authentication is enabled, clients must log in with
+// username and password (RFC 1929) using the htpasswd users.
+type socks5Frontend struct{}
+
+func (socks5Frontend) request(ctx context.Context, conn net.Conn, s *settings) (context.Context, net.Conn, *packet.HttpRequest, bool) {
+	ctx, ok := socks5Handshake(ctx, conn, s)
+	if !ok {
+		_ = conn.Close()
+		return ctx, nil, nil, false
+	}
+	logger := log.GetCtxLogger(ctx)
+
+	pkt, err := readSocks5Request(conn)
+	if err != nil {
+		logger.Debug().Msgf("error while parsing socks5 request: %s", err)
+
+		var replyErr *socks5ReplyError
+		if errors.As(err, &replyErr) {
+			_ = writeSocks5Reply(conn, replyErr.rep)
+		}
+		_ = conn.Close()
+		return ctx, nil, nil, false
+	}
+
+	logger.Debug().Msgf("socks5 request from %s to %s", conn.RemoteAddr(), net.JoinHostPort(pkt.Domain(), pkt.Port()))
+
+	return ctx, conn, pkt, true
+}
+
+func (socks5Frontend) reject(conn net.Conn, pkt *packet.HttpRequest, status int) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// A reply can only follow a request, so the client is let through the
+	// handshake first
+	if pkt == nil && !socks5RefusalHandshake(conn) {
+		return
+	}
+
+	rep := byte(socks5GeneralFailure)
+	switch status {
+	case http.StatusForbidden:
+		rep = socks5NotAllowed
+	case http.StatusBadGateway:
+		rep = socks5HostUnreachable
+	case http.StatusServiceUnavailable:
+		rep = socks5ConnRefused
+	}
+	_ = writeSocks5Reply(conn, rep)
+}
+
+func (socks5Frontend) established(lConn net.Conn, _ *packet.HttpRequest) error {
+	return writeSocks5Reply(lConn, socks5Succeeded)
+}
+
+// relaysPlain is true, as SOCKS5 clients connect through the proxy with any
+// protocol.
+func (socks5Frontend) relaysPlain() bool {
+	return true
+}
+
+// socks5Handshake negotiates the authentication method and, if required,
+// checks the client's username and password.
+func socks5Handshake(ctx context.Context, conn net.Conn, s *settings) (context.Context, bool) {
+	logger := log.GetCtxLogger(ctx)
+
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		logger.Debug().Msgf("error while reading socks5 greeting: %s", err)
+		return ctx, false
+	}
+	if header[0] != socks5Version {
+		logger.Debug().Msgf("unsupported socks version %d from %s", header[0], conn.RemoteAddr())
+		return ctx, false
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		logger.Debug().Msgf("error while reading socks5 greeting: %s", err)
+		return ctx, false
+	}
+
+	want := byte(socks5MethodNoAuth)
+	if s.users != nil {
+		want = socks5MethodUserPass
+	}
+
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		logger.Debug().Msgf("no acceptable socks5 auth method from client %s", clientHost(conn))
+		_, _ = conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return ctx, false
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+		return ctx, false
+	}
+
+	if want == socks5MethodNoAuth {
+		return ctx, true
+	}
+
+	user, password, err := readSocks5UserPass(conn)
+	if err != nil {
+		logger.Debug().Msgf("error while reading socks5 credentials: %s", err)
+		return ctx, false
+	}
+
+	if !s.users.Verify(user, password) {
+		logger.Warn().Msgf("invalid proxy credentials for user %q", user)
+		_, _ = conn.Write([]byte{socks5UserPassVersion, 0x01})
+		return ctx, false
+	}
+
+	if _, err := conn.Write([]byte{socks5UserPassVersion, 0x00}); err != nil {
+		return ctx, false
+	}
+
+	return util.GetCtxWithUser(ctx, user), true
+}
+
+// socks5RefusalHandshake takes a client that is refused anyway through the
+// handshake up to its request, so that it can be answered with a reply code.
+// Credentials are read but not checked, as nothing is relayed afterwards.
+func socks5RefusalHandshake(conn net.Conn) bool {
+	_ = conn.SetDeadline(time.Now().Add(socks5RejectTimeout))
+
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil || header[0] != socks5Version {
+		return false
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return false
+	}
+
+	method := byte(socks5MethodNoAcceptable)
+	switch {
+	case slices.Contains(methods, socks5MethodNoAuth):
+		method = socks5MethodNoAuth
+	case slices.Contains(methods, socks5MethodUserPass):
+		method = socks5MethodUserPass
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil || method == socks5MethodNoAcceptable {
+		return false
+	}
+
+	if method == socks5MethodUserPass {
+		if _, _, err := readSocks5UserPass(conn); err != nil {
+			return false
+		}
+		if _, err := conn.Write([]byte{socks5UserPassVersion, 0x00}); err != nil {
+			return false
+		}
+	}
+
+	_, err := readSocks5Request(conn)
+	var replyErr *socks5ReplyError
+	return err == nil || errors.As(err, &replyErr)
+}
+
+// readSocks5UserPass reads a username/password request (RFC 1929).
+func readSocks5UserPass(r io.Reader) (string, string, error) {
+	var version [1]byte
+	if _, err := io.ReadFull(r, version[:]); err != nil {
+		return "", "", err
+	}
+	if version[0] != socks5UserPassVersion {
+		return "", "", fmt.Errorf("unsupported auth version %d", version[0])
+	}
+
+	user, err := readSocks5String(r)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := readSocks5String(r)
+	if err != nil {
+		return "", "", err
+	}
+	return user, password, nil
+}
+
+// readSocks5String reads a string prefixed with its one byte length.
+func readSocks5String(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readSocks5Request reads a CONNECT request and turns it into the equivalent
+// HTTP CONNECT request.
+func readSocks5Request(r io.Reader) (*packet.HttpRequest, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	if header[1] != socks5CmdConnect {
+		return nil, &socks5ReplyError{
+			rep: socks5CmdNotSupported,
+			err: fmt.Errorf("unsupported command %d", header[1]),
+		}
+	}
+
+	var host string
+	switch header[3] {
+	case socks5AddrIPv4:
+		var ip [net.IPv4len]byte
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip[:]).String()
+	case socks5AddrIPv6:
+		var ip [net.IPv6len]byte
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip[:]).String()
+	case socks5AddrDomain:
+		domain, err := readSocks5String(r)
+		if err != nil {
+			return nil, err
+		}
+		host = domain
+	default:
+		return nil, &socks5ReplyError{
+			rep: socks5AddrTypeUnsupported,
+			err: fmt.Errorf("unsupported address type %d", header[3]),
+		}
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+
+	return packet.NewConnectRequest(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeSocks5Reply sends a reply with the given code. The bound address is
+// always reported as 0.0.0.0:0, which clients do not need for CONNECT.
+func writeSocks5Reply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socks5Version, rep, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
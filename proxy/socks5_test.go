@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bariiss/SpoofDPI/packet"
+)
+
+// socks5Result is what socks5Frontend.request returned.
+type socks5Result struct {
+	pkt *packet.HttpRequest
+	ok  bool
+}
+
+// startSocks5 serves a SOCKS5 request on one end of a pipe and returns the
+// other end and the result of the request.
+func startSocks5(t *testing.T, s *settings) (net.Conn, <-chan socks5Result) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	done := make(chan socks5Result, 1)
+	go func() {
+		_, _, pkt, ok := socks5Frontend{}.request(context.Background(), server, s)
+		done <- socks5Result{pkt, ok}
+	}()
+	return client, done
+}
+
+// send writes b to conn.
+func send(t *testing.T, conn net.Conn, b ...byte) {
+	t.Helper()
+	if _, err := conn.Write(b); err != nil {
+		t.Fatalf("writing %x: %s", b, err)
+	}
+}
+
+// expect reads len(want) bytes from conn and checks that they are want.
+func expect(t *testing.T, conn net.Conn, want ...byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("reading %x: %s", want, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+}
+
+// expectClosed checks that conn was closed without more data.
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("read %d more bytes, want the connection closed", n)
+	}
+}
+
+// reply returns a reply with the given code as written by writeSocks5Reply.
+func reply(rep byte) []byte {
+	return []byte{socks5Version, rep, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0}
+}
+
+func TestSocks5Request(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		host    string
+		port    string
+	}{
+		{
+			name:    "domain",
+			request: append([]byte{5, 1, 0, 3, 11}, append([]byte("example.com"), 0x01, 0xbb)...),
+			host:    "example.com",
+			port:    "443",
+		},
+		{
+			name:    "ipv4",
+			request: []byte{5, 1, 0, 1, 93, 184, 216, 34, 0x00, 0x50},
+			host:    "93.184.216.34",
+			port:    "80",
+		},
+		{
+			name:    "ipv6",
+			request: []byte{5, 1, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x20, 0xfb},
+			host:    "2001:db8::1",
+			port:    "8443",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, done := startSocks5(t, &settings{})
+
+			send(t, client, 5, 2, socks5MethodUserPass, socks5MethodNoAuth)
+			expect(t, client, 5, socks5MethodNoAuth)
+			send(t, client, tt.request...)
+
+			r := <-done
+			if !r.ok {
+				t.Fatal("request failed")
+			}
+			if !r.pkt.IsConnectMethod() || r.pkt.Domain() != tt.host || r.pkt.Port() != tt.port {
+				t.Errorf("request = %s %s:%s, want CONNECT %s:%s", r.pkt.Method(), r.pkt.Domain(), r.pkt.Port(), tt.host, tt.port)
+			}
+		})
+	}
+}
+
+func TestSocks5RequestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		rep     byte
+	}{
+		{name: "bind", request: []byte{5, 2, 0, 1}, rep: socks5CmdNotSupported},
+		{name: "udp associate", request: []byte{5, 3, 0, 1}, rep: socks5CmdNotSupported},
+		{name: "address type", request: []byte{5, 1, 0, 9}, rep: socks5AddrTypeUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, done := startSocks5(t, &settings{})
+
+			send(t, client, 5, 1, socks5MethodNoAuth)
+			expect(t, client, 5, socks5MethodNoAuth)
+			send(t, client, tt.request...)
+			expect(t, client, reply(tt.rep)...)
+			expectClosed(t, client)
+
+			if r := <-done; r.ok {
+				t.Error("request succeeded")
+			}
+		})
+	}
+
+	t.Run("socks4", func(t *testing.T) {
+		client, done := startSocks5(t, &settings{})
+		send(t, client, 4, 1)
+		expectClosed(t, client)
+		if r := <-done; r.ok {
+			t.Error("request succeeded")
+		}
+	})
+}
+
+func TestSocks5Authentication(t *testing.T) {
+	s := newAuthSettings(t)
+	userPass := func(user, password string) []byte {
+		b := []byte{socks5UserPassVersion, byte(len(user))}
+		b = append(b, user...)
+		b = append(b, byte(len(password)))
+		return append(b, password...)
+	}
+
+	t.Run("no acceptable method", func(t *testing.T) {
+		client, done := startSocks5(t, s)
+		send(t, client, 5, 1, socks5MethodNoAuth)
+		expect(t, client, 5, socks5MethodNoAcceptable)
+		expectClosed(t, client)
+		if r := <-done; r.ok {
+			t.Error("request succeeded")
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		client, done := startSocks5(t, s)
+		send(t, client, 5, 2, socks5MethodNoAuth, socks5MethodUserPass)
+		expect(t, client, 5, socks5MethodUserPass)
+		send(t, client, userPass("alice", "wrong")...)
+		expect(t, client, socks5UserPassVersion, 0x01)
+		expectClosed(t, client)
+		if r := <-done; r.ok {
+			t.Error("request succeeded")
+		}
+	})
+
+	t.Run("valid credentials", func(t *testing.T) {
+		client, done := startSocks5(t, s)
+		send(t, client, 5, 1, socks5MethodUserPass)
+		expect(t, client, 5, socks5MethodUserPass)
+		send(t, client, userPass("alice", "secret")...)
+		expect(t, client, socks5UserPassVersion, 0x00)
+		send(t, client, 5, 1, 0, 1, 127, 0, 0, 1, 0x01, 0xbb)
+		if r := <-done; !r.ok {
+			t.Error("request failed")
+		}
+	})
+}
+
+func TestSocks5Reject(t *testing.T) {
+	tests := []struct {
+		status int
+		rep    byte
+	}{
+		{http.StatusForbidden, socks5NotAllowed},
+		{http.StatusBadGateway, socks5HostUnreachable},
+		{http.StatusServiceUnavailable, socks5ConnRefused},
+		{http.StatusInternalServerError, socks5GeneralFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			client, server := net.Pipe()
+			defer func() {
+				_ = client.Close()
+			}()
+
+			go socks5Frontend{}.reject(server, packet.NewConnectRequest("example.com", "443"), tt.status)
+			expect(t, client, reply(tt.rep)...)
+			expectClosed(t, client)
+		})
+	}
+}
+
+func TestSocks5RejectBeforeHandshake(t *testing.T) {
+	t.Run("no auth", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer func() {
+			_ = client.Close()
+		}()
+
+		go socks5Frontend{}.reject(server, nil, http.StatusServiceUnavailable)
+		send(t, client, 5, 1, socks5MethodNoAuth)
+		expect(t, client, 5, socks5MethodNoAuth)
+		send(t, client, 5, 1, 0, 1, 127, 0, 0, 1, 0, 80)
+		expect(t, client, reply(socks5ConnRefused)...)
+		expectClosed(t, client)
+	})
+
+	t.Run("user pass", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer func() {
+			_ = client.Close()
+		}()
+
+		go socks5Frontend{}.reject(server, nil, http.StatusServiceUnavailable)
+		send(t, client, 5, 1, socks5MethodUserPass)
+		expect(t, client, 5, socks5MethodUserPass)
+		send(t, client, socks5UserPassVersion, 1, 'a', 1, 'b')
+		expect(t, client, socks5UserPassVersion, 0x00)
+		send(t, client, 5, 1, 0, 1, 127, 0, 0, 1, 0, 80)
+		expect(t, client, reply(socks5ConnRefused)...)
+		expectClosed(t, client)
+	})
+
+	t.Run("no acceptable method", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer func() {
+			_ = client.Close()
+		}()
+
+		go socks5Frontend{}.reject(server, nil, http.StatusServiceUnavailable)
+		send(t, client, 5, 1, 0x01)
+		expect(t, client, 5, socks5MethodNoAcceptable)
+		expectClosed(t, client)
+	})
+}
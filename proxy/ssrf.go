@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net/netip"
+)
+
+// privateRanges are the loopback, private, link-local and other special
+// purpose ranges refused when -forbid-private is given.
+var privateRanges = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+var (
+	// nat64Prefix is the well-known NAT64 prefix, whose addresses end with
+	// the IPv4 address they translate to.
+	nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+	// sixToFourPrefix is the 6to4 prefix, whose addresses carry the IPv4
+	// address of the relay right after it.
+	sixToFourPrefix = netip.MustParsePrefix("2002::/16")
+)
+
+// destinationAllowed checks the resolved destination address against the
+// forbidden ranges and their exceptions. It runs on the address that is
+// about to be dialed, so a DNS rebinding answer cannot slip through. The
+// IPv4 address embedded in a NAT64 or 6to4 address is checked as well.
+func (s *settings) destinationAllowed(ip string) bool {
+	if len(s.forbiddenRanges) == 0 {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	if containsAddr(s.forbiddenExceptions, addr) {
+		return true
+	}
+	if containsAddr(s.forbiddenRanges, addr) {
+		return false
+	}
+
+	if v4, ok := embeddedIPv4(addr); ok {
+		return containsAddr(s.forbiddenExceptions, v4) || !containsAddr(s.forbiddenRanges, v4)
+	}
+	return true
+}
+
+// embeddedIPv4 returns the IPv4 address a NAT64 or 6to4 address leads to.
+func embeddedIPv4(addr netip.Addr) (netip.Addr, bool) {
+	b := addr.As16()
+	switch {
+	case nat64Prefix.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[12:16])), true
+	case sixToFourPrefix.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[2:6])), true
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestDestinationAllowed(t *testing.T) {
+	s := &settings{
+		forbiddenRanges:     slices.Concat(privateRanges, []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}),
+		forbiddenExceptions: []netip.Prefix{netip.MustParsePrefix("192.168.1.10/32")},
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"100.64.0.1", false},
+		{"169.254.169.254", false},
+		{"172.31.255.255", false},
+		{"172.32.0.1", true},
+		{"192.168.0.1", false},
+		{"192.0.0.170", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"198.20.0.1", true},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:93.184.216.34", true},
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b::5db8:d822", true},
+		{"64:ff9b::cb00:7105", false},
+		{"64:ff9b::c0a8:10a", true},
+		{"2002:7f00:1::1", false},
+		{"2002:c0a8:101::1", false},
+		{"2002:5db8:d822::1", true},
+		{"203.0.113.5", false},
+		{"192.168.1.10", true},
+		{"::ffff:192.168.1.10", true},
+		{"192.168.1.11", false},
+		{"not-an-ip", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := s.destinationAllowed(tt.ip); got != tt.want {
+			t.Errorf("destinationAllowed(%q) = %t, want %t", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestDestinationAllowedWithoutRanges(t *testing.T) {
+	s := &settings{}
+	for _, ip := range []string{"127.0.0.1", "10.0.0.1", "not-an-ip"} {
+		if !s.destinationAllowed(ip) {
+			t.Errorf("destinationAllowed(%q) = false without forbidden ranges", ip)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = 1 * time.Second
+)
+
+type stats struct {
+	accepted     atomic.Uint64
+	acceptErrors atomic.Uint64
+	limited      atomic.Uint64
+	denied       atomic.Uint64
+	forbidden    atomic.Uint64
+}
+
+// Stats is a point-in-time snapshot of the proxy counters.
+type Stats struct {
+	Accepted     uint64 `json:"accepted"`
+	Active       int    `json:"active"`
+	AcceptErrors uint64 `json:"accept_errors"`
+	Limited      uint64 `json:"limited"`
+	Denied       uint64 `json:"denied"`
+	Forbidden    uint64 `json:"forbidden"`
+
+	// Poisoned counts the poisoned dns answers detected per domain.
+	Poisoned map[string]uint64 `json:"poisoned"`
+}
+
+// Stats returns a snapshot of the proxy counters.
+func (pxy *Proxy) Stats() Stats {
+	return Stats{
+		Accepted:     pxy.stats.accepted.Load(),
+		Active:       pxy.conns.len(),
+		AcceptErrors: pxy.stats.acceptErrors.Load(),
+		Limited:      pxy.stats.limited.Load(),
+		Denied:       pxy.stats.denied.Load(),
+		Forbidden:    pxy.stats.forbidden.Load(),
+		Poisoned:     pxy.poisoned.Snapshot(),
+	}
+}
+
+// nextAcceptDelay doubles the previous delay, starting at minAcceptDelay and
+// capped at maxAcceptDelay, the same way net/http's server does.
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return minAcceptDelay
+	}
+	return min(delay*2, maxAcceptDelay)
+}
+
+// isTemporaryAcceptError reports whether err is expected to go away on its
+// own, e.g. EMFILE when the file descriptor limit has been hit under load.
+func isTemporaryAcceptError(err error) bool {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno.Temporary() || errno == syscall.ENOBUFS || errno == syscall.ENOMEM
+	}
+
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNextAcceptDelay(t *testing.T) {
+	want := []time.Duration{
+		5 * time.Millisecond,
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		80 * time.Millisecond,
+		160 * time.Millisecond,
+		320 * time.Millisecond,
+		640 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+
+	var delay time.Duration
+	for i, w := range want {
+		delay = nextAcceptDelay(delay)
+		if delay != w {
+			t.Fatalf("delay %d = %s, want %s", i, delay, w)
+		}
+	}
+}
+
+func TestIsTemporaryAcceptError(t *testing.T) {
+	// acceptError wraps errno the way net.Listener.Accept returns it.
+	acceptError := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", errno)}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "EMFILE", err: acceptError(syscall.EMFILE), want: true},
+		{name: "ENFILE", err: acceptError(syscall.ENFILE), want: true},
+		{name: "ENOBUFS", err: acceptError(syscall.ENOBUFS), want: true},
+		{name: "ENOMEM", err: acceptError(syscall.ENOMEM), want: true},
+		{name: "EINTR", err: acceptError(syscall.EINTR), want: true},
+		{name: "bare errno", err: syscall.EMFILE, want: true},
+		{name: "EBADF", err: acceptError(syscall.EBADF)},
+		{name: "EINVAL", err: acceptError(syscall.EINVAL)},
+		{name: "closed listener", err: &net.OpError{Op: "accept", Net: "tcp", Err: net.ErrClosed}},
+		{name: "other error", err: errors.New("accept failed")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTemporaryAcceptError(tt.err); got != tt.want {
+				t.Errorf("isTemporaryAcceptError(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bariiss/SpoofDPI/packet"
+	"github.com/bariiss/SpoofDPI/util/log"
+)
+
+// sniffTimeout bounds the wait for the first bytes of a redirected
+// connection, as clients of protocols in which the server speaks first send
+// nothing until they are answered.
+const sniffTimeout = 2 * time.Second
+
+// transparentFrontend serves connections that were redirected to the proxy
+// by the firewall, e.g. with an iptables REDIRECT rule. The destination is
+// the original address of the connection, and patterns are matched against
+// the SNI of the client hello or the Host header of a plain HTTP request,
+// falling back to the destination IP. Clients cannot authenticate on such
+// listeners.
+type transparentFrontend struct{}
+
+func (transparentFrontend) request(ctx context.Context, conn net.Conn, _ *settings) (context.Context, net.Conn, *packet.HttpRequest, bool) {
+	logger := log.GetCtxLogger(ctx)
+
+	dst, err := originalDst(conn)
+	if err != nil {
+		logger.Debug().Msgf("error getting original destination of %s: %s", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return ctx, nil, nil, false
+	}
+
+	pkt := packet.NewConnectRequest(dst.Addr().String(), strconv.Itoa(int(dst.Port())))
+
+	br := bufio.NewReaderSize(conn, packet.TLSHeaderLen+int(packet.TLSMaxPayloadLen))
+	if name := sniffServerName(conn, br); name != "" {
+		pkt.SetServerName(name)
+	}
+
+	logger.Debug().Msgf("transparent connection from %s to %s (%s)", conn.RemoteAddr(), dst, pkt.ServerName())
+
+	return ctx, &sniffedConn{Conn: conn, r: br}, pkt, true
+}
+
+func (transparentFrontend) reject(conn net.Conn, _ *packet.HttpRequest, _ int) {
+	_ = conn.Close()
+}
+
+func (transparentFrontend) established(net.Conn, *packet.HttpRequest) error {
+	return nil
+}
+
+// relaysPlain is true, as any traffic the firewall redirects is relayed.
+func (transparentFrontend) relaysPlain() bool {
+	return true
+}
+
+// sniffServerName peeks at the first bytes the client sent through br and
+// returns the SNI of a client hello or the Host header of an HTTP request,
+// or "" if there is neither.
+func sniffServerName(conn net.Conn, br *bufio.Reader) string {
+	if err := conn.SetReadDeadline(time.Now().Add(sniffTimeout)); err != nil {
+		return ""
+	}
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+
+	first, err := br.Peek(1)
+	if err != nil {
+		return ""
+	}
+
+	if first[0] == byte(packet.TLSHandshake) {
+		header, err := br.Peek(packet.TLSHeaderLen)
+		if err != nil {
+			return ""
+		}
+		raw, err := br.Peek(packet.TLSHeaderLen + int(binary.BigEndian.Uint16(header[3:5])))
+		if err != nil {
+			return ""
+		}
+		m, err := packet.ReadTLSMessage(bytes.NewReader(raw))
+		if err != nil {
+			return ""
+		}
+		return m.ServerName()
+	}
+
+	// Only look at what arrived already, as the headers may never end
+	data, _ := br.Peek(br.Buffered())
+	return httpHost(data)
+}
+
+// httpHost returns the host of the Host header in the start of an HTTP
+// request, without the port.
+func httpHost(data []byte) string {
+	lines := strings.Split(string(data), "\r\n")
+	if len(lines) < 2 || len(strings.Fields(lines[0])) != 3 {
+		return ""
+	}
+
+	for _, line := range lines[1:] {
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(name, "Host") {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.Trim(host, "[]")
+	}
+	return ""
+}
+
+// sniffedConn replays the bytes peeked at by sniffServerName before reading
+// from the connection.
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
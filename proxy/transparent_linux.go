@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, which has the
+// same value as IP6T_SO_ORIGINAL_DST.
+const soOriginalDst = 80
+
+// originalDst returns the destination a redirected connection was made to
+// before netfilter rewrote it.
+func originalDst(conn net.Conn) (netip.AddrPort, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, errors.New("not a tcp connection")
+	}
+
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	local, _ := addrIP(conn.LocalAddr())
+	isIPv4 := local.Is4()
+
+	var (
+		dst    netip.AddrPort
+		optErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		if isIPv4 {
+			// struct sockaddr_in fits into the 16 bytes of an ipv6_mreq
+			var mreq *unix.IPv6Mreq
+			mreq, optErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+			if optErr != nil {
+				return
+			}
+			b := mreq.Multiaddr
+			dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[4:8])), binary.BigEndian.Uint16(b[2:4]))
+			return
+		}
+
+		// struct sockaddr_in6 fits into the ip6_mtuinfo
+		var info *unix.IPv6MTUInfo
+		info, optErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+		if optErr != nil {
+			return
+		}
+		// the port is stored in network byte order
+		var port [2]byte
+		binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+		dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr).Unmap(), binary.BigEndian.Uint16(port[:]))
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return dst, optErr
+}
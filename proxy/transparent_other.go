@@ -0,0 +1,15 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// originalDst is only supported on linux, where netfilter keeps the
+// original destination of redirected connections.
+func originalDst(net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("transparent proxying is only supported on linux")
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/bariiss/SpoofDPI/packet"
+)
+
+// sniff writes data to one end of a pipe, or starts a TLS handshake for
+// serverName if data is nil, and sniffs the server name at the other end.
+// It returns the name and what a read on the sniffed connection yields.
+func sniff(t *testing.T, data []byte, serverName string) (string, []byte) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer func() {
+		_ = server.Close()
+	}()
+
+	sent := make(chan []byte, 1)
+	go func() {
+		defer func() {
+			_ = client.Close()
+		}()
+		if data != nil {
+			_, _ = client.Write(data)
+			sent <- data
+			return
+		}
+
+		// Record what the TLS client writes, the handshake never completes
+		rec := &recordConn{Conn: client}
+		_ = tls.Client(rec, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		sent <- rec.written
+	}()
+
+	br := bufio.NewReaderSize(server, packet.TLSHeaderLen+int(packet.TLSMaxPayloadLen))
+	name := sniffServerName(server, br)
+
+	conn := &sniffedConn{Conn: server, r: br}
+	buf := make([]byte, br.Buffered())
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	_ = server.Close()
+	if want := <-sent; len(buf) != 0 && string(buf) != string(want[:len(buf)]) {
+		t.Error("sniffed connection does not replay the peeked bytes")
+	}
+	return name, buf
+}
+
+// recordConn keeps a copy of what is written to a connection.
+type recordConn struct {
+	net.Conn
+	written []byte
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.written = append(c.written, b...)
+	return c.Conn.Write(b)
+}
+
+func TestSniffServerName(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		serverName string
+		want       string
+	}{
+		{name: "client hello", serverName: "www.example.com", want: "www.example.com"},
+		{name: "client hello without sni", serverName: "192.0.2.1"},
+		{name: "http", data: []byte("GET / HTTP/1.1\r\nhost: www.example.com:80\r\n\r\n"), want: "www.example.com"},
+		{name: "http ipv6 host", data: []byte("GET / HTTP/1.1\r\nHost: [2001:db8::1]\r\n\r\n"), want: "2001:db8::1"},
+		{name: "http without host", data: []byte("GET / HTTP/1.0\r\nAccept: */*\r\n\r\n")},
+		{name: "other protocol", data: []byte("SSH-2.0-OpenSSH_9.6\r\n")},
+		{name: "cut short client hello", data: []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, replayed := sniff(t, tt.data, tt.serverName)
+			if name != tt.want {
+				t.Errorf("server name = %q, want %q", name, tt.want)
+			}
+			if len(replayed) == 0 {
+				t.Error("nothing was peeked at")
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package systemd
+
+// monotonicUsec is only needed by systemd, which runs on linux only.
+func monotonicUsec() (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,88 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notification states understood by systemd, see sd_notify(3).
+const (
+	StateReady     = "READY=1"
+	StateReloading = "RELOADING=1"
+	StateStopping  = "STOPPING=1"
+	StateWatchdog  = "WATCHDOG=1"
+)
+
+// Status returns a STATUS= notification with the given text.
+func Status(text string) string {
+	return "STATUS=" + text
+}
+
+// Reloading returns the notifications that tell systemd a reload started,
+// RELOADING=1 along with the MONOTONIC_USEC= timestamp Type=notify-reload
+// services must send. READY=1 tells it the reload is over.
+func Reloading() []string {
+	states := []string{StateReloading}
+	if usec, ok := monotonicUsec(); ok {
+		states = append(states, "MONOTONIC_USEC="+strconv.FormatInt(usec, 10))
+	}
+	return states
+}
+
+// Notify sends the given newline-separated states to the service manager.
+// It reports false without an error when NOTIFY_SOCKET is not set.
+func Notify(states ...string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+
+	// A leading '@' stands for an abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	var msg []byte
+	for i, state := range states {
+		if i > 0 {
+			msg = append(msg, '\n')
+		}
+		msg = append(msg, state...)
+	}
+
+	if _, err := conn.Write(msg); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval at which systemd expects WATCHDOG=1
+// notifications, or 0 when the watchdog is not enabled for this process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// MainPid returns a MAINPID= notification, which tells systemd that another
+// process became the main process of the service.
+func MainPid(pid int) string {
+	return "MAINPID=" + strconv.Itoa(pid)
+}
@@ -0,0 +1,131 @@
+//go:build linux
+
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenNotify binds a fake notify socket and points NOTIFY_SOCKET to it.
+func listenNotify(t *testing.T) *net.UnixConn {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// receive returns the states of the next notification on conn.
+func receive(t *testing.T, conn *net.UnixConn) []string {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(string(buf[:n]), "\n")
+}
+
+func TestNotify(t *testing.T) {
+	conn := listenNotify(t)
+
+	tests := []struct {
+		name   string
+		states []string
+	}{
+		{"ready", []string{StateReady, Status("accepting connections")}},
+		{"stopping", []string{StateStopping, Status("draining connections")}},
+		{"watchdog", []string{StateWatchdog}},
+		{"main pid", []string{MainPid(1234)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := Notify(tt.states...)
+			if !ok || err != nil {
+				t.Fatalf("Notify() = %t, %v", ok, err)
+			}
+			if got := receive(t, conn); strings.Join(got, "\n") != strings.Join(tt.states, "\n") {
+				t.Errorf("received %q, want %q", got, tt.states)
+			}
+		})
+	}
+
+	if got := MainPid(1234); got != "MAINPID=1234" {
+		t.Errorf("MainPid(1234) = %q", got)
+	}
+}
+
+func TestNotifyReloading(t *testing.T) {
+	conn := listenNotify(t)
+
+	if ok, err := Notify(Reloading()...); !ok || err != nil {
+		t.Fatalf("Notify() = %t, %v", ok, err)
+	}
+
+	got := receive(t, conn)
+	if len(got) != 2 || got[0] != StateReloading {
+		t.Fatalf("received %q, want RELOADING=1 and MONOTONIC_USEC=", got)
+	}
+	usec, ok := strings.CutPrefix(got[1], "MONOTONIC_USEC=")
+	if !ok {
+		t.Fatalf("received %q, want MONOTONIC_USEC=", got[1])
+	}
+	if v, err := strconv.ParseInt(usec, 10, 64); err != nil || v <= 0 {
+		t.Errorf("invalid MONOTONIC_USEC %q", usec)
+	}
+}
+
+func TestNotifyUnset(t *testing.T) {
+	conn := listenNotify(t)
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := os.Unsetenv("NOTIFY_SOCKET"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := Notify(StateReady); ok || err != nil {
+		t.Errorf("Notify() = %t, %v, want false without an error", ok, err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 4096)); err == nil {
+		t.Errorf("received %d bytes, want nothing", n)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"invalid", "", 0},
+		{"0", "", 0},
+		{"30000000", "", 30 * time.Second},
+		{"30000000", strconv.Itoa(os.Getpid()), 30 * time.Second},
+		{"30000000", strconv.Itoa(os.Getpid() + 1), 0},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("WATCHDOG_USEC", tt.usec)
+		t.Setenv("WATCHDOG_PID", tt.pid)
+		if got := WatchdogInterval(); got != tt.want {
+			t.Errorf("WatchdogInterval() with usec %q and pid %q = %s, want %s", tt.usec, tt.pid, got, tt.want)
+		}
+	}
+}
@@ -4,24 +4,92 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"os"
 	"strconv"
+	"strings"
 	"unsafe"
 )
 
+const envPrefix = "SPOOFDPI_"
+
+// lineLists are the options whose values may contain commas themselves, such
+// as regexes. Their environment variables hold one value per line instead of
+// a comma-separated list.
+var lineLists = map[string]bool{
+	"pattern":   true,
+	"dns-rule":  true,
+	"dns-group": true,
+}
+
+// Sources of a configuration value, in order of precedence.
+const (
+	SourceFlag    = "flag"
+	SourceEnv     = "env"
+	SourceConfig  = "config"
+	SourceDefault = "default"
+)
+
 type Args struct {
-	Addr           string
-	Port           uint16
-	DnsAddr        string
-	DnsPort        uint16
-	DnsIPv4Only    bool
-	EnableDoh      bool
-	Debug          bool
-	Silent         bool
-	SystemProxy    bool
-	Timeout        uint16
-	AllowedPattern StringArray
-	WindowSize     uint16
-	Version        bool
+	ConfigFile         string
+	Addr               string
+	Port               uint16
+	DnsAddr            string
+	DnsPort            uint16
+	DnsIPv4Only        bool
+	DnsUpstream        StringArray
+	DnsGroup           StringArray
+	DnsRule            StringArray
+	DnsDefaultResolver string
+	HostsFile          string
+	DnsBogusIP         StringArray
+	DnsPoisonWait      uint16
+	DnsStrategy        string
+	DnsCacheSize       uint32
+	DnsMinTTL          uint32
+	DnsMaxTTL          uint32
+	DnsStaleTTL        uint32
+	DnsPrefetch        bool
+	DnsListen          string
+	DohListen          string
+	EnableDoh          bool
+	DohURL             string
+	DohPost            bool
+	DohBootstrap       StringArray
+	EnableDot          bool
+	DotServerName      string
+	DotPin             StringArray
+	Debug              bool
+	Silent             bool
+	SystemProxy        bool
+	SystemProxyEnvFile string
+	Timeout            uint16
+	AllowedPattern     StringArray
+	PatternFile        string
+	AdminAddr          string
+	AdminAllowRemote   bool
+	Htpasswd           string
+	AllowClient        StringArray
+	DenyClient         StringArray
+	ForbidPrivate      bool
+	ForbiddenRange     StringArray
+	ForbiddenException StringArray
+	AllowedPort        StringArray
+	Listen             StringArray
+	Profile            StringArray
+	User               string
+	Group              string
+	GracePeriod        uint16
+	MaxConns           uint16
+	MaxConnsPerClient  uint16
+	MaxConnsPerDest    uint16
+	LimitWait          uint16
+	MaxDialsPerSec     uint16
+	WindowSize         uint16
+	Version            bool
+
+	// Sources maps each flag name to where its value came from.
+	Sources map[string]string
 }
 
 type StringArray []string
@@ -35,30 +103,224 @@ func (arr *StringArray) Set(value string) error {
 	return nil
 }
 
-// ParseArgs parses command line arguments and returns an Args struct.
+// ParseArgs parses command line arguments, environment variables and the
+// config file, and returns an Args struct.
 func ParseArgs() *Args {
+	args, err := parseArgs(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	return args
+}
+
+// ReloadArgs parses the original command line again against the current
+// environment and config file. Unlike ParseArgs it never exits the process.
+func ReloadArgs() (*Args, error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return parseArgs(fs, os.Args[1:])
+}
+
+// parseArgs defines the flags on fs and resolves every value with the
+// precedence flag > env > config file > default.
+func parseArgs(fs *flag.FlagSet, arguments []string) (*Args, error) {
 	args := new(Args)
 
-	flag.StringVar(&args.Addr, "addr", "127.0.0.1", "listen address")
-	uintNVar(&args.Port, "port", 8080, "port")
-	flag.StringVar(&args.DnsAddr, "dns-addr", "8.8.8.8", "dns address")
-	uintNVar(&args.DnsPort, "dns-port", 53, "port number for dns")
-	flag.BoolVar(&args.EnableDoh, "enable-doh", false, "enable 'dns-over-https'")
-	flag.BoolVar(&args.Debug, "debug", false, "enable debug output")
-	flag.BoolVar(&args.Silent, "silent", false, "do not show the banner and server information at start up")
-	flag.BoolVar(&args.SystemProxy, "system-proxy", true, "enable system-wide proxy")
-	uintNVar(&args.Timeout, "timeout", 0, "timeout in milliseconds; no timeout when not given")
-	uintNVar(&args.WindowSize, "window-size", 0, `chunk size, in number of bytes, for fragmented client hello,
+	fs.StringVar(&args.ConfigFile, "config", "", "path to a config file with one 'name = value' option per line")
+	fs.StringVar(&args.Addr, "addr", "127.0.0.1", "listen address")
+	uintNVar(fs, &args.Port, "port", 8080, "port")
+	fs.Var(&args.Listen, "listen", `listen endpoint '[proto://]host:port[?profile=name]' replacing -addr and -port,
+e.g. '[::1]:8080' or 'socks5://192.168.1.2:1080?profile=office';
+proto is one of http (default), socks5 or transparent; Unix sockets are given as
+'[proto+]unix:///path[?mode=0660&owner=user:group]'; can be specified multiple times`)
+	fs.Var(&args.Profile, "profile", "named rule profile 'name=pattern-file' that listeners can select; can be specified multiple times")
+	fs.StringVar(&args.DnsAddr, "dns-addr", "8.8.8.8", "dns address")
+	uintNVar(fs, &args.DnsPort, "dns-port", 53, "port number for dns")
+	fs.Var(&args.DnsUpstream, "dns-upstream", `dns server '[udp://]host[:port]', 'tls://host[:port][?name=server-name][&pin=digest]' or
+'https://host[:port]/path[#bootstrap=address]' replacing -dns-addr, -enable-doh and -enable-dot;
+pin and bootstrap work like -dot-pin and -doh-bootstrap and can be repeated;
+can be specified multiple times`)
+	fs.StringVar(&args.DnsStrategy, "dns-strategy", "failover", `how to query multiple -dns-upstream servers: 'failover' tries them in order,
+'race' queries all at once and 'round-robin' takes turns`)
+	fs.BoolVar(&args.EnableDoh, "enable-doh", false, "enable 'dns-over-https'")
+	fs.StringVar(&args.DohURL, "doh-url", "", `url of the 'dns-over-https' server, e.g. 'https://dns.nextdns.io/abc123';
+defaults to https://<dns-addr>/dns-query`)
+	fs.BoolVar(&args.DohPost, "doh-post", false, "send 'dns-over-https' queries as POST requests instead of GET requests")
+	fs.Var(&args.DohBootstrap, "doh-bootstrap", `address to connect to for the host of -doh-url instead of resolving it with the
+system resolver; can be specified multiple times`)
+	fs.BoolVar(&args.EnableDot, "enable-dot", false, "enable 'dns-over-tls'; the dns port defaults to 853")
+	fs.StringVar(&args.DotServerName, "dot-server-name", "", "name the dns-over-tls server is authenticated as and sent as sni; defaults to dns-addr")
+	fs.Var(&args.DotPin, "dot-pin", `base64 sha256 digest of the public key the dns-over-tls server must present,
+replacing certificate validation; can be specified multiple times`)
+	fs.BoolVar(&args.Debug, "debug", false, "enable debug output")
+	fs.BoolVar(&args.Silent, "silent", false, "do not show the banner and server information at start up")
+	fs.BoolVar(&args.SystemProxy, "system-proxy", true, "enable system-wide proxy")
+	fs.StringVar(&args.SystemProxyEnvFile, "system-proxy-env-file", "", `file to write http_proxy and https_proxy to while the system proxy is set
+on linux, e.g. $HOME/.config/environment.d/spoofdpi.conf; restored on exit`)
+	uintNVar(fs, &args.Timeout, "timeout", 0, "timeout in milliseconds; no timeout when not given")
+	uintNVar(fs, &args.WindowSize, "window-size", 0, `chunk size, in number of bytes, for fragmented client hello,
 try lower values if the default value doesn't bypass the DPI;
 when not given, the client hello packet will be sent in two parts:
 fragmentation for the first data packet and the rest`)
-	flag.BoolVar(&args.Version, "v", false, "print version and exit")
+	fs.StringVar(&args.Htpasswd, "htpasswd", "", "htpasswd file with bcrypt or SHA users; enables proxy authentication")
+	fs.Var(&args.AllowClient, "allow-client", "client address or CIDR range allowed to connect, e.g. '192.168.0.0/16'; can be specified multiple times")
+	fs.Var(&args.DenyClient, "deny-client", "client address or CIDR range refused before reading any request; can be specified multiple times")
+	fs.BoolVar(&args.ForbidPrivate, "forbid-private", false, "refuse tunnels to loopback, private and link-local destinations")
+	fs.Var(&args.ForbiddenRange, "forbidden-range", "destination CIDR range to refuse after dns resolution; can be specified multiple times")
+	fs.Var(&args.ForbiddenException, "forbidden-exception", "destination address or CIDR range allowed despite a forbidden range; can be specified multiple times")
+	fs.Var(&args.AllowedPort, "allowed-port", `destination port or port range allowed for CONNECT tunnels, e.g. '8443' or
+'8000-8100', replacing the default ports 443 and 80; '*' allows any port;
+can be specified multiple times`)
+	fs.StringVar(&args.User, "user", "", `user name or id to switch to once the listeners are open;
+on linux, CAP_NET_RAW and CAP_NET_ADMIN are kept as ambient capabilities`)
+	fs.StringVar(&args.Group, "group", "", "group name or id to switch to along with -user; defaults to the user's primary group")
+	uintNVar(fs, &args.GracePeriod, "grace-period", 10, "seconds to wait for active connections to finish on shutdown before closing them")
+	uintNVar(fs, &args.MaxConns, "max-conns", 0, "maximum number of concurrent connections; unlimited when not given")
+	uintNVar(fs, &args.MaxConnsPerClient, "max-conns-per-client", 0, "maximum number of concurrent connections per client address; unlimited when not given")
+	uintNVar(fs, &args.MaxConnsPerDest, "max-conns-per-dest", 0, "maximum number of concurrent connections per destination host; unlimited when not given")
+	uintNVar(fs, &args.MaxDialsPerSec, "max-dials-per-sec", 0, "maximum number of upstream connections opened per second; unlimited when not given")
+	uintNVar(fs, &args.LimitWait, "limit-wait", 0, `time in milliseconds to queue a connection when a limit is reached;
+when not given, the connection is refused with '503 Service Unavailable' right away`)
+	fs.BoolVar(&args.Version, "v", false, "print version and exit")
 
-	flag.Var(&args.AllowedPattern, "pattern", "regex to bypass DPI; can be specified multiple times")
-	flag.BoolVar(&args.DnsIPv4Only, "dns-ipv4-only", false, "resolve only version 4 addresses")
+	fs.Var(&args.AllowedPattern, "pattern", `regex to bypass DPI; can be specified multiple times, or given one per line
+in SPOOFDPI_PATTERN`)
+	fs.StringVar(&args.PatternFile, "pattern-file", "", "file with one regex to bypass DPI per line; reloaded on SIGHUP")
+	fs.BoolVar(&args.DnsIPv4Only, "dns-ipv4-only", false, "resolve only version 4 addresses")
+	uintNVar(fs, &args.DnsCacheSize, "dns-cache-size", 4096, "maximum number of dns answers kept in memory; 0 disables the cache")
+	uintNVar(fs, &args.DnsMinTTL, "dns-min-ttl", 0, "minimum time in seconds to cache a dns answer, raising shorter ttls")
+	uintNVar(fs, &args.DnsMaxTTL, "dns-max-ttl", 86400, "maximum time in seconds to cache a dns answer, lowering longer ttls")
+	uintNVar(fs, &args.DnsStaleTTL, "dns-stale-ttl", 86400, `time in seconds to keep expired dns answers to use when the dns server fails
+or is slow; 0 disables serving stale answers`)
+	fs.Var(&args.DnsGroup, "dns-group", `named group of dns servers 'name=upstream[,upstream...]', with upstreams as in
+-dns-upstream, queried with -dns-strategy; can be specified multiple times, or given
+one per line in SPOOFDPI_DNS_GROUP`)
+	fs.Var(&args.DnsRule, "dns-rule", `resolver for the names matching a regex, 'regex=resolver', where resolver is
+'system', 'upstream' or the name of a -dns-group; the first matching rule wins;
+can be specified multiple times, or given one per line in SPOOFDPI_DNS_RULE`)
+	fs.StringVar(&args.DnsDefaultResolver, "dns-default-resolver", "", `resolver for the names matching no -dns-rule; when not given, names matching
+the patterns use 'upstream' and the others 'system'`)
+	fs.StringVar(&args.HostsFile, "hosts-file", "", `file of dns overrides, 'address name [name...]' or 'name CNAME target' per line;
+reloaded on SIGHUP`)
+	fs.Var(&args.DnsBogusIP, "dns-bogus-ip", `address or CIDR range of fake answers, e.g. an ISP's block page, to discard
+from plain dns servers; can be specified multiple times`)
+	uintNVar(fs, &args.DnsPoisonWait, "dns-poison-wait", 0, `time in milliseconds to keep listening after the first udp answer of a plain
+dns server; a different second answer replaces the first, taken as injected`)
+	fs.BoolVar(&args.DnsPrefetch, "dns-prefetch", true, "refresh popular dns answers shortly before they expire")
+	fs.StringVar(&args.DnsListen, "dns-listen", "", `listen address of the local dns server on udp and tcp, e.g. '127.0.0.1:5353';
+disabled when not given`)
+	fs.StringVar(&args.DohListen, "doh-listen", "", `listen address of the local DoH endpoint at /dns-query, e.g. '127.0.0.1:8053',
+or 'admin' to serve it on the admin api; disabled when not given`)
+	fs.StringVar(&args.AdminAddr, "admin-addr", "", `listen address of the admin API, e.g. '127.0.0.1:8081'; only loopback addresses
+are accepted unless -admin-allow-remote is given; disabled when not given`)
+	fs.BoolVar(&args.AdminAllowRemote, "admin-allow-remote", false, `allow -admin-addr on non-loopback addresses, although the admin API has no
+authentication`)
 
-	flag.Parse()
-	return args
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	setByFlag := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setByFlag[f.Name] = true
+	})
+
+	if !setByFlag["config"] {
+		if path, ok := os.LookupEnv(envName("config")); ok {
+			args.ConfigFile = path
+		}
+	}
+
+	fileValues, err := readConfigFile(args.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range fileValues {
+		if fs.Lookup(name) == nil || name == "config" || name == "v" {
+			return nil, fmt.Errorf("config file %s: unknown option %q", args.ConfigFile, name)
+		}
+	}
+
+	args.Sources = make(map[string]string)
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		source, err := resolveFlag(f, setByFlag[f.Name], fileValues[f.Name])
+		if err != nil {
+			errs = append(errs, err)
+		}
+		args.Sources[f.Name] = source
+	})
+
+	// Set only now, as the values of any source replace the default ports
+	if args.Sources["allowed-port"] == SourceDefault {
+		args.AllowedPort = StringArray{"443", "80"}
+	}
+
+	return args, errors.Join(errs...)
+}
+
+// resolveFlag applies the environment or config file value to f unless it
+// was given on the command line, and reports which source won.
+func resolveFlag(f *flag.Flag, setByFlag bool, fileValues []string) (string, error) {
+	if setByFlag {
+		return SourceFlag, nil
+	}
+
+	if f.Name == "config" || f.Name == "v" {
+		return SourceDefault, nil
+	}
+
+	name := envName(f.Name)
+	if value, ok := os.LookupEnv(name); ok {
+		values := []string{value}
+		if _, isArray := f.Value.(*StringArray); isArray {
+			sep := ","
+			if lineLists[f.Name] {
+				sep = "\n"
+			}
+			values = splitList(value, sep)
+		}
+		for _, v := range values {
+			if err := f.Value.Set(v); err != nil {
+				return SourceEnv, fmt.Errorf("invalid value %q for %s: %w", value, name, err)
+			}
+		}
+		return SourceEnv, nil
+	}
+
+	if len(fileValues) > 0 {
+		if _, isArray := f.Value.(*StringArray); !isArray {
+			fileValues = fileValues[len(fileValues)-1:]
+		}
+		for _, v := range fileValues {
+			if err := f.Value.Set(v); err != nil {
+				return SourceConfig, fmt.Errorf("invalid value %q for %s in config file: %w", v, f.Name, err)
+			}
+		}
+		return SourceConfig, nil
+	}
+
+	return SourceDefault, nil
+}
+
+// envName returns the environment variable name for the given flag,
+// e.g. "dns-addr" becomes "SPOOFDPI_DNS_ADDR".
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// splitList splits a list separated by sep and drops empty elements.
+func splitList(value, sep string) []string {
+	var values []string
+	for _, v := range strings.Split(value, sep) {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
 }
 
 // Generic unsigned constraint
@@ -66,8 +328,8 @@ type unsigned interface {
 	~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
 }
 
-func uintNVar[T unsigned](p *T, name string, value T, usage string) {
-	flag.CommandLine.Var(newUintNValue(value, p), name, usage)
+func uintNVar[T unsigned](fs *flag.FlagSet, p *T, name string, value T, usage string) {
+	fs.Var(newUintNValue(value, p), name, usage)
 }
 
 type uintNValue[T unsigned] struct {
@@ -0,0 +1,173 @@
+package util
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// parseTestArgs parses arguments on a fresh flag set, with a config file of
+// the given content if it is not empty.
+func parseTestArgs(t *testing.T, config string, arguments ...string) *Args {
+	t.Helper()
+
+	if config != "" {
+		path := filepath.Join(t.TempDir(), "spoofdpi.conf")
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		arguments = append([]string{"-config", path}, arguments...)
+	}
+
+	fs := flag.NewFlagSet("spoofdpi", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	args, err := parseArgs(fs, arguments)
+	if err != nil {
+		t.Fatalf("parseArgs(%q): %s", arguments, err)
+	}
+	return args
+}
+
+func TestParseArgsPrecedence(t *testing.T) {
+	tests := []struct {
+		name       string
+		arguments  []string
+		env        string
+		config     string
+		wantPort   uint16
+		wantSource string
+	}{
+		{name: "default", wantPort: 8080, wantSource: SourceDefault},
+		{name: "config", config: "port = 1000", wantPort: 1000, wantSource: SourceConfig},
+		{name: "env over config", env: "2000", config: "port = 1000", wantPort: 2000, wantSource: SourceEnv},
+		{
+			name:       "flag over env and config",
+			arguments:  []string{"-port", "3000"},
+			env:        "2000",
+			config:     "port = 1000",
+			wantPort:   3000,
+			wantSource: SourceFlag,
+		},
+		{name: "last config value", config: "port = 1000\nport = 1001", wantPort: 1001, wantSource: SourceConfig},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("SPOOFDPI_PORT", tt.env)
+			}
+
+			args := parseTestArgs(t, tt.config, tt.arguments...)
+			if args.Port != tt.wantPort {
+				t.Errorf("port = %d, want %d", args.Port, tt.wantPort)
+			}
+			if got := args.Sources["port"]; got != tt.wantSource {
+				t.Errorf("source = %q, want %q", got, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestParseArgsLists(t *testing.T) {
+	t.Run("config repeats", func(t *testing.T) {
+		args := parseTestArgs(t, "pattern = youtube\npattern = \"discord\"")
+		if want := (StringArray{"youtube", "discord"}); !slices.Equal(args.AllowedPattern, want) {
+			t.Errorf("patterns = %q, want %q", args.AllowedPattern, want)
+		}
+	})
+
+	t.Run("env commas", func(t *testing.T) {
+		t.Setenv("SPOOFDPI_ALLOW_CLIENT", "10.0.0.0/8, 192.168.0.0/16,")
+		args := parseTestArgs(t, "")
+		if want := (StringArray{"10.0.0.0/8", "192.168.0.0/16"}); !slices.Equal(args.AllowClient, want) {
+			t.Errorf("clients = %q, want %q", args.AllowClient, want)
+		}
+	})
+
+	t.Run("env regexes", func(t *testing.T) {
+		t.Setenv("SPOOFDPI_PATTERN", "^ya?\\d{1,3}\\.com$\nyoutube")
+		args := parseTestArgs(t, "")
+		if want := (StringArray{`^ya?\d{1,3}\.com$`, "youtube"}); !slices.Equal(args.AllowedPattern, want) {
+			t.Errorf("patterns = %q, want %q", args.AllowedPattern, want)
+		}
+	})
+
+	t.Run("env groups", func(t *testing.T) {
+		t.Setenv("SPOOFDPI_DNS_GROUP", "a=1.1.1.1,8.8.8.8\nb=9.9.9.9")
+		args := parseTestArgs(t, "")
+		if want := (StringArray{"a=1.1.1.1,8.8.8.8", "b=9.9.9.9"}); !slices.Equal(args.DnsGroup, want) {
+			t.Errorf("groups = %q, want %q", args.DnsGroup, want)
+		}
+	})
+
+	t.Run("default ports", func(t *testing.T) {
+		args := parseTestArgs(t, "")
+		if want := (StringArray{"443", "80"}); !slices.Equal(args.AllowedPort, want) {
+			t.Errorf("ports = %q, want %q", args.AllowedPort, want)
+		}
+	})
+
+	t.Run("ports replace the default", func(t *testing.T) {
+		for _, args := range []*Args{
+			parseTestArgs(t, "", "-allowed-port", "8443"),
+			parseTestArgs(t, "allowed-port = 8443"),
+		} {
+			if want := (StringArray{"8443"}); !slices.Equal(args.AllowedPort, want) {
+				t.Errorf("ports = %q, want %q", args.AllowedPort, want)
+			}
+		}
+
+		t.Setenv("SPOOFDPI_ALLOWED_PORT", "8443,5222-5223")
+		args := parseTestArgs(t, "")
+		if want := (StringArray{"8443", "5222-5223"}); !slices.Equal(args.AllowedPort, want) {
+			t.Errorf("ports = %q, want %q", args.AllowedPort, want)
+		}
+	})
+
+	t.Run("flag replaces env", func(t *testing.T) {
+		t.Setenv("SPOOFDPI_PATTERN", "discord")
+		args := parseTestArgs(t, "", "-pattern", "youtube")
+		if want := (StringArray{"youtube"}); !slices.Equal(args.AllowedPattern, want) {
+			t.Errorf("patterns = %q, want %q", args.AllowedPattern, want)
+		}
+	})
+}
+
+func TestParseArgsErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		config string
+	}{
+		{name: "unknown config option", config: "no-such-option = 1"},
+		{name: "config without value", config: "port"},
+		{name: "invalid config value", config: "port = http"},
+		{name: "invalid env value", env: map[string]string{"SPOOFDPI_PORT": "70000"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			var arguments []string
+			if tt.config != "" {
+				path := filepath.Join(t.TempDir(), "spoofdpi.conf")
+				if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				arguments = []string{"-config", path}
+			}
+
+			fs := flag.NewFlagSet("spoofdpi", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			if _, err := parseArgs(fs, arguments); err == nil {
+				t.Error("parseArgs succeeded, want an error")
+			}
+		})
+	}
+}
@@ -1,26 +1,88 @@
 package util
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/pterm/pterm"
 	"github.com/pterm/pterm/putils"
 )
 
+// DohOnAdmin is the -doh-listen value that serves the DoH endpoint on the
+// admin api.
+const DohOnAdmin = "admin"
+
+// dotPort is the dns port used with -enable-dot unless -dns-port is given.
+const dotPort = 853
+
 type Config struct {
-	Addr            string
-	Port            int
-	DnsAddr         string
-	DnsPort         int
-	DnsIPv4Only     bool
-	EnableDoh       bool
-	Debug           bool
-	Silent          bool
-	SystemProxy     bool
-	Timeout         int
-	WindowSize      int
-	AllowedPatterns []*regexp.Regexp
+	Addr                string
+	Port                int
+	DnsAddr             string
+	DnsPort             int
+	DnsIPv4Only         bool
+	DnsUpstreams        []UpstreamConfig
+	DnsStrategy         string
+	DnsGroups           map[string][]UpstreamConfig
+	DnsRules            []DnsRule
+	DnsDefaultResolver  string
+	HostsFile           string
+	Hosts               Hosts
+	DnsBogusIPs         []netip.Prefix
+	DnsPoisonWait       int
+	DnsCacheSize        int
+	DnsMinTTL           int
+	DnsMaxTTL           int
+	DnsStaleTTL         int
+	DnsPrefetch         bool
+	DnsListen           string
+	DohListen           string
+	EnableDoh           bool
+	DohURL              string
+	DohPost             bool
+	DohBootstrap        []netip.Addr
+	EnableDot           bool
+	DotServerName       string
+	DotPins             [][]byte
+	Debug               bool
+	Silent              bool
+	SystemProxy         bool
+	SystemProxyEnvFile  string
+	Timeout             int
+	WindowSize          int
+	AllowedPatterns     []*regexp.Regexp
+	PatternFile         string
+	AdminAddr           string
+	Htpasswd            string
+	AllowClients        []netip.Prefix
+	DenyClients         []netip.Prefix
+	ForbidPrivate       bool
+	ForbiddenRanges     []netip.Prefix
+	ForbiddenExceptions []netip.Prefix
+	AllowedPorts        []PortRange
+	Listeners           []ListenerConfig
+	Profiles            map[string][]*regexp.Regexp
+	User                string
+	Group               string
+	GracePeriod         int
+	MaxConns            int
+	MaxConnsPerClient   int
+	MaxConnsPerDest     int
+	MaxDialsPerSec      int
+	LimitWait           int
+	Sources             map[string]string
+
+	// Files are the paths of the files read on load and reload: the config,
+	// pattern, profile, hosts and htpasswd files.
+	Files []string
 }
 
 var config *Config
@@ -34,30 +96,429 @@ func GetConfig() *Config {
 }
 
 // Load populates the Config struct with values from the Args struct.
-func (c *Config) Load(args *Args) {
+func (c *Config) Load(args *Args) error {
+	patterns := args.AllowedPattern
+	if args.PatternFile != "" {
+		filePatterns, err := readPatternFile(args.PatternFile)
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns[:len(patterns):len(patterns)], filePatterns...)
+	}
+
+	allowedPatterns, err := parseAllowedPattern(patterns)
+	if err != nil {
+		return err
+	}
+
+	if err := checkAdminAddr(args.AdminAddr, args.AdminAllowRemote); err != nil {
+		return err
+	}
+
+	allowClients, err := parsePrefixes(args.AllowClient)
+	if err != nil {
+		return fmt.Errorf("allow-client: %w", err)
+	}
+
+	denyClients, err := parsePrefixes(args.DenyClient)
+	if err != nil {
+		return fmt.Errorf("deny-client: %w", err)
+	}
+
+	forbiddenRanges, err := parsePrefixes(args.ForbiddenRange)
+	if err != nil {
+		return fmt.Errorf("forbidden-range: %w", err)
+	}
+
+	forbiddenExceptions, err := parsePrefixes(args.ForbiddenException)
+	if err != nil {
+		return fmt.Errorf("forbidden-exception: %w", err)
+	}
+
+	allowedPorts, err := parsePortRanges(args.AllowedPort)
+	if err != nil {
+		return fmt.Errorf("allowed-port: %w", err)
+	}
+
+	if args.DnsMaxTTL > 0 && args.DnsMinTTL > args.DnsMaxTTL {
+		return fmt.Errorf("dns-min-ttl: %d is greater than dns-max-ttl %d", args.DnsMinTTL, args.DnsMaxTTL)
+	}
+
+	dnsUpstreams, err := parseUpstreams(args.DnsUpstream)
+	if err != nil {
+		return fmt.Errorf("dns-upstream: %w", err)
+	}
+
+	dnsGroups, err := parseDnsGroups(args.DnsGroup)
+	if err != nil {
+		return fmt.Errorf("dns-group: %w", err)
+	}
+
+	dnsRules, err := parseDnsRules(args.DnsRule, dnsGroups)
+	if err != nil {
+		return fmt.Errorf("dns-rule: %w", err)
+	}
+
+	if args.DnsDefaultResolver != "" {
+		if err := checkResolver(args.DnsDefaultResolver, dnsGroups); err != nil {
+			return fmt.Errorf("dns-default-resolver: %w", err)
+		}
+	}
+
+	var hosts Hosts
+	if args.HostsFile != "" {
+		hosts, err = readHostsFile(args.HostsFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	dnsBogusIPs, err := parsePrefixes(args.DnsBogusIP)
+	if err != nil {
+		return fmt.Errorf("dns-bogus-ip: %w", err)
+	}
+
+	if err := checkStrategy(args.DnsStrategy); err != nil {
+		return fmt.Errorf("dns-strategy: %w", err)
+	}
+
+	if args.EnableDoh && args.EnableDot {
+		return errors.New("enable-dot: cannot be combined with enable-doh")
+	}
+
+	if args.DohURL != "" {
+		if err := checkDohURL(args.DohURL); err != nil {
+			return fmt.Errorf("doh-url: %w", err)
+		}
+	}
+
+	dohBootstrap, err := parseAddrs(args.DohBootstrap)
+	if err != nil {
+		return fmt.Errorf("doh-bootstrap: %w", err)
+	}
+
+	dotPins, err := parsePins(args.DotPin)
+	if err != nil {
+		return fmt.Errorf("dot-pin: %w", err)
+	}
+
+	dnsPort := int(args.DnsPort)
+	if args.EnableDot && args.Sources["dns-port"] == SourceDefault {
+		dnsPort = dotPort
+	}
+
+	if args.DohListen == DohOnAdmin && args.AdminAddr == "" {
+		return fmt.Errorf("doh-listen: %q requires admin-addr", DohOnAdmin)
+	}
+
+	listeners, err := parseListeners(args.Listen)
+	if err != nil {
+		return err
+	}
+	if len(listeners) == 0 {
+		listeners = []ListenerConfig{{
+			Proto:   ProtoHTTP,
+			Network: NetworkTCP,
+			Addr:    net.JoinHostPort(args.Addr, strconv.Itoa(int(args.Port))),
+		}}
+	}
+
+	profiles, err := loadProfiles(args.Profile)
+	if err != nil {
+		return err
+	}
+	for _, l := range listeners {
+		if _, ok := profiles[l.Profile]; l.Profile != "" && !ok {
+			return fmt.Errorf("listener %s: unknown profile %q", l, l.Profile)
+		}
+	}
+
 	c.Addr = args.Addr
 	c.Port = int(args.Port)
 	c.DnsAddr = args.DnsAddr
-	c.DnsPort = int(args.DnsPort)
+	c.DnsPort = dnsPort
 	c.DnsIPv4Only = args.DnsIPv4Only
+	c.DnsUpstreams = dnsUpstreams
+	c.DnsStrategy = args.DnsStrategy
+	c.DnsGroups = dnsGroups
+	c.DnsRules = dnsRules
+	c.DnsDefaultResolver = args.DnsDefaultResolver
+	c.HostsFile = args.HostsFile
+	c.Hosts = hosts
+	c.DnsBogusIPs = dnsBogusIPs
+	c.DnsPoisonWait = int(args.DnsPoisonWait)
+	c.DnsCacheSize = int(args.DnsCacheSize)
+	c.DnsMinTTL = int(args.DnsMinTTL)
+	c.DnsMaxTTL = int(args.DnsMaxTTL)
+	c.DnsStaleTTL = int(args.DnsStaleTTL)
+	c.DnsPrefetch = args.DnsPrefetch
+	c.DnsListen = args.DnsListen
+	c.DohListen = args.DohListen
 	c.Debug = args.Debug
 	c.EnableDoh = args.EnableDoh
+	c.DohURL = args.DohURL
+	c.DohPost = args.DohPost
+	c.DohBootstrap = dohBootstrap
+	c.EnableDot = args.EnableDot
+	c.DotServerName = args.DotServerName
+	c.DotPins = dotPins
 	c.Silent = args.Silent
 	c.SystemProxy = args.SystemProxy
+	c.SystemProxyEnvFile = args.SystemProxyEnvFile
 	c.Timeout = int(args.Timeout)
-	c.AllowedPatterns = parseAllowedPattern(args.AllowedPattern)
+	c.AllowedPatterns = allowedPatterns
+	c.PatternFile = args.PatternFile
 	c.WindowSize = int(args.WindowSize)
+	c.AdminAddr = args.AdminAddr
+	c.Htpasswd = args.Htpasswd
+	c.AllowClients = allowClients
+	c.DenyClients = denyClients
+	c.ForbidPrivate = args.ForbidPrivate
+	c.ForbiddenRanges = forbiddenRanges
+	c.ForbiddenExceptions = forbiddenExceptions
+	c.AllowedPorts = allowedPorts
+	c.Listeners = listeners
+	c.Profiles = profiles
+	c.User = args.User
+	c.Group = args.Group
+	c.GracePeriod = int(args.GracePeriod)
+	c.MaxConns = int(args.MaxConns)
+	c.MaxConnsPerClient = int(args.MaxConnsPerClient)
+	c.MaxConnsPerDest = int(args.MaxConnsPerDest)
+	c.MaxDialsPerSec = int(args.MaxDialsPerSec)
+	c.LimitWait = int(args.LimitWait)
+	c.Sources = args.Sources
+	c.Files = configFiles(args)
+	return nil
+}
+
+// ReloadConfig re-reads the command line, environment and config file into
+// a new Config. The returned Config is only valid if err is nil.
+func ReloadConfig() (*Config, error) {
+	args, err := ReloadArgs()
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(Config)
+	if err := c.Load(args); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// checkAdminAddr refuses admin api addresses that are not loopback ones
+// unless allowRemote is set, as anyone reaching the api could reload the
+// config and read the stats.
+func checkAdminAddr(addr string, allowRemote bool) error {
+	if addr == "" || allowRemote {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("admin-addr: %w", err)
+	}
+	if strings.EqualFold(host, "localhost") {
+		return nil
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && ip.Unmap().IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("admin-addr: %s is not a loopback address and the admin api has no authentication; "+
+		"give -admin-allow-remote to serve it there anyway", addr)
 }
 
 // parseAllowedPattern compiles the allowed patterns into regular expressions.
-func parseAllowedPattern(patterns StringArray) []*regexp.Regexp {
-	var allowedPatterns []*regexp.Regexp
+func parseAllowedPattern(patterns StringArray) ([]*regexp.Regexp, error) {
+	var (
+		allowedPatterns []*regexp.Regexp
+		errs            []error
+	)
 
 	for _, pattern := range patterns {
-		allowedPatterns = append(allowedPatterns, regexp.MustCompile(pattern))
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid pattern %q: %w", pattern, err))
+			continue
+		}
+		allowedPatterns = append(allowedPatterns, re)
+	}
+
+	return allowedPatterns, errors.Join(errs...)
+}
+
+// parsePrefixes parses CIDR ranges such as "192.168.0.0/16". A single
+// address is taken as a range containing only that address.
+func parsePrefixes(values StringArray) ([]netip.Prefix, error) {
+	var (
+		prefixes []netip.Prefix
+		errs     []error
+	)
+
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid address %q: %w", value, err))
+				continue
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid range %q: %w", value, err))
+			continue
+		}
+		prefixes = append(prefixes, prefix.Masked())
 	}
 
-	return allowedPatterns
+	return prefixes, errors.Join(errs...)
+}
+
+// configFiles returns the paths of the files read on load and reload.
+func configFiles(args *Args) []string {
+	var files []string
+	for _, path := range []string{args.ConfigFile, args.PatternFile, args.HostsFile, args.Htpasswd} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	for _, value := range args.Profile {
+		if _, path, ok := strings.Cut(value, "="); ok {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// checkDohURL checks that value is an https url with a host.
+func checkDohURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid url %q; expected 'https://host[:port][/path]'", value)
+	}
+	return nil
+}
+
+// parseAddrs parses ip addresses such as "1.1.1.1" or "2606:4700::1111".
+func parseAddrs(values StringArray) ([]netip.Addr, error) {
+	var (
+		addrs []netip.Addr
+		errs  []error
+	)
+
+	for _, value := range values {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid address %q: %w", value, err))
+			continue
+		}
+		addrs = append(addrs, addr.Unmap())
+	}
+
+	return addrs, errors.Join(errs...)
+}
+
+// parsePins decodes the base64 sha256 digests of public keys, as printed by
+// 'openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64'.
+func parsePins(values StringArray) ([][]byte, error) {
+	var (
+		pins [][]byte
+		errs []error
+	)
+
+	for _, value := range values {
+		pin, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(pin) != sha256.Size {
+			errs = append(errs, fmt.Errorf("invalid pin %q; expected a base64 sha256 digest", value))
+			continue
+		}
+		pins = append(pins, pin)
+	}
+
+	return pins, errors.Join(errs...)
+}
+
+// loadProfiles reads the pattern file of each "name=pattern-file" profile.
+func loadProfiles(values StringArray) (map[string][]*regexp.Regexp, error) {
+	profiles := make(map[string][]*regexp.Regexp)
+
+	for _, value := range values {
+		name, path, ok := strings.Cut(value, "=")
+		if !ok || name == "" || path == "" {
+			return nil, fmt.Errorf("invalid profile %q; expected 'name=pattern-file'", value)
+		}
+
+		patterns, err := readPatternFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+
+		compiled, err := parseAllowedPattern(patterns)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+		profiles[name] = compiled
+	}
+
+	return profiles, nil
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Low  uint16
+	High uint16
+}
+
+// Contains reports whether port is within the range.
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.Low && port <= r.High
+}
+
+// String returns the range as "low-high", or a single port.
+func (r PortRange) String() string {
+	if r.Low == r.High {
+		return strconv.Itoa(int(r.Low))
+	}
+	return fmt.Sprintf("%d-%d", r.Low, r.High)
+}
+
+// parsePortRanges parses ports such as "443", ranges such as "8000-8100",
+// and "*" for any port.
+func parsePortRanges(values StringArray) ([]PortRange, error) {
+	var (
+		ranges []PortRange
+		errs   []error
+	)
+
+	for _, value := range values {
+		if value == "*" {
+			ranges = append(ranges, PortRange{Low: 1, High: 65535})
+			continue
+		}
+
+		lowStr, highStr, isRange := strings.Cut(value, "-")
+		if !isRange {
+			highStr = lowStr
+		}
+
+		low, errLow := strconv.ParseUint(lowStr, 10, 16)
+		high, errHigh := strconv.ParseUint(highStr, 10, 16)
+		if errLow != nil || errHigh != nil || low == 0 || low > high {
+			errs = append(errs, fmt.Errorf("invalid port or port range %q", value))
+			continue
+		}
+
+		ranges = append(ranges, PortRange{Low: uint16(low), High: uint16(high)})
+	}
+
+	return ranges, errors.Join(errs...)
 }
 
 // PrintColoredBanner prints a colored banner with the configuration details.
@@ -70,18 +531,57 @@ func PrintColoredBanner() {
 	}
 
 	err = pterm.DefaultBulletList.WithItems([]pterm.BulletListItem{
-		{Level: 0, Text: "ADDR    : " + fmt.Sprint(config.Addr)},
-		{Level: 0, Text: "PORT    : " + fmt.Sprint(config.Port)},
-		{Level: 0, Text: "DNS     : " + fmt.Sprint(config.DnsAddr)},
-		{Level: 0, Text: "DEBUG   : " + fmt.Sprint(config.Debug)},
-		{Level: 0, Text: "SILENT  : " + fmt.Sprint(config.Silent)},
-		{Level: 0, Text: "SYSTEM  : " + fmt.Sprint(config.SystemProxy)},
-		{Level: 0, Text: "TIMEOUT : " + fmt.Sprint(config.Timeout)},
-		{Level: 0, Text: "WINDOW  : " + fmt.Sprint(config.WindowSize)},
-		{Level: 0, Text: "DOH     : " + fmt.Sprint(config.EnableDoh)},
-		{Level: 0, Text: "DNSPORT : " + fmt.Sprint(config.DnsPort)},
-		{Level: 0, Text: "DNSV4   : " + fmt.Sprint(config.DnsIPv4Only)},
-		{Level: 0, Text: "ALLOWED : " + fmt.Sprint(config.AllowedPatterns)},
+		bannerItem("LISTEN", listenSourceFlag(), config.Listeners),
+		bannerItem("DNS", "dns-addr", config.DnsAddr),
+		bannerItem("UPSTRM", "dns-upstream", config.DnsUpstreams),
+		bannerItem("STRATEGY", "dns-strategy", config.DnsStrategy),
+		bannerItem("GROUPS", "dns-group", len(config.DnsGroups)),
+		bannerItem("RULES", "dns-rule", config.DnsRules),
+		bannerItem("DNSDEF", "dns-default-resolver", config.DnsDefaultResolver),
+		bannerItem("HOSTS", "hosts-file", config.HostsFile),
+		bannerItem("BOGUS", "dns-bogus-ip", config.DnsBogusIPs),
+		bannerItem("PSNWAIT", "dns-poison-wait", config.DnsPoisonWait),
+		bannerItem("DEBUG", "debug", config.Debug),
+		bannerItem("SILENT", "silent", config.Silent),
+		bannerItem("SYSTEM", "system-proxy", config.SystemProxy),
+		bannerItem("ENVFILE", "system-proxy-env-file", config.SystemProxyEnvFile),
+		bannerItem("TIMEOUT", "timeout", config.Timeout),
+		bannerItem("WINDOW", "window-size", config.WindowSize),
+		bannerItem("DOH", "enable-doh", config.EnableDoh),
+		bannerItem("DOHURL", "doh-url", config.DohURL),
+		bannerItem("DOHPOST", "doh-post", config.DohPost),
+		bannerItem("BOOTSTRP", "doh-bootstrap", config.DohBootstrap),
+		bannerItem("DOT", "enable-dot", config.EnableDot),
+		bannerItem("DOTNAME", "dot-server-name", config.DotServerName),
+		bannerItem("DOTPINS", "dot-pin", len(config.DotPins)),
+		bannerItem("DNSPORT", "dns-port", config.DnsPort),
+		bannerItem("DNSV4", "dns-ipv4-only", config.DnsIPv4Only),
+		bannerItem("DNSCACHE", "dns-cache-size", config.DnsCacheSize),
+		bannerItem("MINTTL", "dns-min-ttl", config.DnsMinTTL),
+		bannerItem("MAXTTL", "dns-max-ttl", config.DnsMaxTTL),
+		bannerItem("STALETTL", "dns-stale-ttl", config.DnsStaleTTL),
+		bannerItem("PREFETCH", "dns-prefetch", config.DnsPrefetch),
+		bannerItem("DNSSERVE", "dns-listen", config.DnsListen),
+		bannerItem("DOHSERVE", "doh-listen", config.DohListen),
+		bannerItem("ALLOWED", "pattern", config.AllowedPatterns),
+		bannerItem("PROFILES", "profile", len(config.Profiles)),
+		bannerItem("PATTERNS", "pattern-file", config.PatternFile),
+		bannerItem("ADMIN", "admin-addr", config.AdminAddr),
+		bannerItem("AUTH", "htpasswd", config.Htpasswd),
+		bannerItem("CLIENTS", "allow-client", config.AllowClients),
+		bannerItem("DENIED", "deny-client", config.DenyClients),
+		bannerItem("PRIVATE", "forbid-private", config.ForbidPrivate),
+		bannerItem("FORBID", "forbidden-range", config.ForbiddenRanges),
+		bannerItem("EXCEPT", "forbidden-exception", config.ForbiddenExceptions),
+		bannerItem("PORTS", "allowed-port", config.AllowedPorts),
+		bannerItem("USER", "user", config.User),
+		bannerItem("GROUP", "group", config.Group),
+		bannerItem("GRACE", "grace-period", config.GracePeriod),
+		bannerItem("MAXCONN", "max-conns", config.MaxConns),
+		bannerItem("PERCLNT", "max-conns-per-client", config.MaxConnsPerClient),
+		bannerItem("PERDEST", "max-conns-per-dest", config.MaxConnsPerDest),
+		bannerItem("DIALS/S", "max-dials-per-sec", config.MaxDialsPerSec),
+		bannerItem("LIMWAIT", "limit-wait", config.LimitWait),
 	}).Render()
 	if err != nil {
 		return
@@ -89,3 +589,35 @@ func PrintColoredBanner() {
 
 	pterm.DefaultBasicText.Println("Press 'CTRL + c' to exit.")
 }
+
+// IsDefaultListener reports whether the listeners are the built-in default,
+// i.e. none of -listen, -addr and -port was given.
+func (c *Config) IsDefaultListener() bool {
+	for _, name := range []string{"listen", "addr", "port"} {
+		if source, ok := c.Sources[name]; ok && source != SourceDefault {
+			return false
+		}
+	}
+	return true
+}
+
+// listenSourceFlag returns the flag the listeners were taken from, which is
+// -addr when -listen is not given.
+func listenSourceFlag() string {
+	if source, ok := config.Sources["listen"]; ok && source != SourceDefault {
+		return "listen"
+	}
+	return "addr"
+}
+
+// bannerItem formats a banner line with the value and where it came from.
+func bannerItem(label, flagName string, value any) pterm.BulletListItem {
+	source, ok := config.Sources[flagName]
+	if !ok {
+		source = SourceDefault
+	}
+	return pterm.BulletListItem{
+		Level: 0,
+		Text:  fmt.Sprintf("%-8s: %v (%s)", label, value, source),
+	}
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestCheckAdminAddr(t *testing.T) {
+	tests := []struct {
+		addr        string
+		allowRemote bool
+		ok          bool
+	}{
+		{addr: "", ok: true},
+		{addr: "127.0.0.1:8081", ok: true},
+		{addr: "127.1.2.3:8081", ok: true},
+		{addr: "[::1]:8081", ok: true},
+		{addr: "[::ffff:127.0.0.1]:8081", ok: true},
+		{addr: "localhost:8081", ok: true},
+		{addr: "0.0.0.0:8081"},
+		{addr: ":8081"},
+		{addr: "[::]:8081"},
+		{addr: "192.168.1.2:8081"},
+		{addr: "admin.example:8081"},
+		{addr: "127.0.0.1"},
+		{addr: "0.0.0.0:8081", allowRemote: true, ok: true},
+		{addr: "192.168.1.2:8081", allowRemote: true, ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if err := checkAdminAddr(tt.addr, tt.allowRemote); (err == nil) != tt.ok {
+				t.Errorf("checkAdminAddr(%q, %t) = %v, want ok %t", tt.addr, tt.allowRemote, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := parsePrefixes(StringArray{"192.168.1.7/16", "10.0.0.1", "::ffff:10.0.0.2", "2001:db8::1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []netip.Prefix{
+		netip.MustParsePrefix("192.168.0.0/16"),
+		netip.MustParsePrefix("10.0.0.1/32"),
+		netip.MustParsePrefix("10.0.0.2/32"),
+		netip.MustParsePrefix("2001:db8::1/128"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+	if !slices.Equal(prefixes, want) {
+		t.Errorf("prefixes = %v, want %v", prefixes, want)
+	}
+
+	for _, value := range []string{"192.168.0.0/33", "10.0.0", "example.com", "2001:db8::/129", ""} {
+		if _, err := parsePrefixes(StringArray{value}); err == nil {
+			t.Errorf("parsePrefixes(%q) succeeded", value)
+		}
+	}
+}
+
+func TestParsePortRanges(t *testing.T) {
+	ranges, err := parsePortRanges(StringArray{"443", "8000-8100", "5222-5222", "*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []PortRange{{Low: 443, High: 443}, {Low: 8000, High: 8100}, {Low: 5222, High: 5222}, {Low: 1, High: 65535}}
+	if !slices.Equal(ranges, want) {
+		t.Errorf("ranges = %v, want %v", ranges, want)
+	}
+
+	tests := []string{"0", "0-80", "8100-8000", "65536", "80-65536", "-80", "80-", "http", "80,443", "1-2-3", ""}
+	for _, value := range tests {
+		t.Run(value, func(t *testing.T) {
+			if ranges, err := parsePortRanges(StringArray{value}); err == nil {
+				t.Errorf("parsePortRanges(%q) = %v, want an error", value, ranges)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readConfigFile reads a config file made of "name = value" lines, where
+// name is a command line flag without the leading dash. Empty lines and
+// lines starting with '#' are ignored. Options that can be given multiple
+// times on the command line may be repeated.
+func readConfigFile(path string) (map[string][]string, error) {
+	values := make(map[string][]string)
+	if path == "" {
+		return values, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening config file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("config file %s:%d: expected 'name = value'", path, lineNum)
+		}
+
+		name = strings.TrimLeft(strings.TrimSpace(name), "-")
+		value = unquote(strings.TrimSpace(value))
+		values[name] = append(values[name], value)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	return values, nil
+}
+
+// unquote strips a single pair of surrounding double quotes, if any.
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// readPatternFile reads one regex per line from path. Empty lines and lines
+// starting with '#' are ignored.
+func readPatternFile(path string) (StringArray, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening pattern file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var patterns StringArray
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading pattern file: %w", err)
+	}
+
+	return patterns, nil
+}
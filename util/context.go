@@ -20,6 +20,20 @@ func GetScopeFromCtx(ctx context.Context) (string, bool) {
 	return scope, ok
 }
 
+type userCtxKey struct{}
+
+// GetCtxWithUser creates a new context with the authenticated user name.
+func GetCtxWithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userCtxKey{}, user)
+}
+
+// GetUserFromCtx retrieves the authenticated user name from the context.
+func GetUserFromCtx(ctx context.Context) (string, bool) {
+	val := ctx.Value(userCtxKey{})
+	user, ok := val.(string)
+	return user, ok
+}
+
 type traceIdCtxKey struct{}
 
 // GetCtxWithTraceId creates a new context with a generated trace ID.
@@ -0,0 +1,107 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Resolvers that are always available to dns rules.
+const (
+	// ResolverSystem is the system's resolver.
+	ResolverSystem = "system"
+	// ResolverUpstream is the resolver set up by -dns-addr, -enable-doh,
+	// -enable-dot or -dns-upstream.
+	ResolverUpstream = "upstream"
+)
+
+// DnsRule selects the resolver of the names matching Pattern.
+type DnsRule struct {
+	Pattern  *regexp.Regexp
+	Resolver string
+}
+
+// String returns the rule in the same form it is given on the command line.
+func (r DnsRule) String() string {
+	return r.Pattern.String() + "=" + r.Resolver
+}
+
+// parseDnsGroups parses named groups of upstream dns servers of the form
+// "name=upstream[,upstream...]", with upstreams as in parseUpstreams.
+func parseDnsGroups(values StringArray) (map[string][]UpstreamConfig, error) {
+	groups := make(map[string][]UpstreamConfig)
+
+	var errs []error
+	for _, value := range values {
+		name, list, ok := strings.Cut(value, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || list == "" {
+			errs = append(errs, fmt.Errorf("invalid group %q; expected 'name=upstream[,upstream...]'", value))
+			continue
+		}
+		if name == ResolverSystem || name == ResolverUpstream {
+			errs = append(errs, fmt.Errorf("invalid group %q; %q is reserved", value, name))
+			continue
+		}
+		if _, ok := groups[name]; ok {
+			errs = append(errs, fmt.Errorf("group %s is given twice", name))
+			continue
+		}
+
+		var specs StringArray
+		for _, spec := range strings.Split(list, ",") {
+			specs = append(specs, strings.TrimSpace(spec))
+		}
+		upstreams, err := parseUpstreams(specs)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("group %s: %w", name, err))
+			continue
+		}
+		groups[name] = upstreams
+	}
+
+	return groups, errors.Join(errs...)
+}
+
+// parseDnsRules parses rules of the form "regex=resolver", where resolver
+// is ResolverSystem, ResolverUpstream or the name of one of groups. As
+// regexes may contain '=' themselves, the resolver follows the last one.
+func parseDnsRules(values StringArray, groups map[string][]UpstreamConfig) ([]DnsRule, error) {
+	var (
+		rules []DnsRule
+		errs  []error
+	)
+
+	for _, value := range values {
+		i := strings.LastIndex(value, "=")
+		if i <= 0 {
+			errs = append(errs, fmt.Errorf("invalid rule %q; expected 'regex=resolver'", value))
+			continue
+		}
+
+		pattern, resolver := value[:i], strings.TrimSpace(value[i+1:])
+		if err := checkResolver(resolver, groups); err != nil {
+			errs = append(errs, fmt.Errorf("invalid rule %q: %w", value, err))
+			continue
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid rule %q: %w", value, err))
+			continue
+		}
+		rules = append(rules, DnsRule{Pattern: re, Resolver: resolver})
+	}
+
+	return rules, errors.Join(errs...)
+}
+
+// checkResolver checks that name is a resolver dns rules can select.
+func checkResolver(name string, groups map[string][]UpstreamConfig) error {
+	if _, ok := groups[name]; ok || name == ResolverSystem || name == ResolverUpstream {
+		return nil
+	}
+	return fmt.Errorf("unknown resolver %q; expected %s, %s or the name of a -dns-group",
+		name, ResolverSystem, ResolverUpstream)
+}
@@ -0,0 +1,124 @@
+package util
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseDnsGroups(t *testing.T) {
+	groups, err := parseDnsGroups(StringArray{
+		"filter = 94.140.14.14, tls://9.9.9.9?name=dns.quad9.net",
+		"doh=https://dns.google/dns-query",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]UpstreamConfig{
+		"filter": {
+			{Proto: UpstreamUDP, Addr: "94.140.14.14:53"},
+			{Proto: UpstreamTLS, Addr: "9.9.9.9:853", ServerName: "dns.quad9.net"},
+		},
+		"doh": {{Proto: UpstreamHTTPS, Addr: "https://dns.google/dns-query"}},
+	}
+	if len(groups) != len(want) {
+		t.Fatalf("groups = %v, want %v", groups, want)
+	}
+	for name, upstreams := range want {
+		if !reflect.DeepEqual(groups[name], upstreams) {
+			t.Errorf("group %s = %v, want %v", name, groups[name], upstreams)
+		}
+	}
+}
+
+func TestParseDnsGroupsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value StringArray
+		want  string
+	}{
+		{name: "no upstreams", value: StringArray{"filter="}, want: "expected 'name=upstream"},
+		{name: "no name", value: StringArray{"=1.1.1.1"}, want: "expected 'name=upstream"},
+		{name: "no separator", value: StringArray{"filter"}, want: "expected 'name=upstream"},
+		{name: "reserved system", value: StringArray{"system=1.1.1.1"}, want: "reserved"},
+		{name: "reserved upstream", value: StringArray{"upstream=1.1.1.1"}, want: "reserved"},
+		{name: "twice", value: StringArray{"a=1.1.1.1", "a=8.8.8.8"}, want: "given twice"},
+		{name: "invalid upstream", value: StringArray{"a=1.1.1.1,ftp://8.8.8.8"}, want: "group a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDnsGroups(tt.value)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseDnsGroups = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDnsRules(t *testing.T) {
+	groups := map[string][]UpstreamConfig{"filter": {{Proto: UpstreamUDP, Addr: "94.140.14.14:53"}}}
+
+	rules, err := parseDnsRules(StringArray{
+		`\.lan$=system`,
+		`^(a|b)=c\.example$=filter`,
+		`.*= upstream `,
+	}, groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{`\.lan$=system`, `^(a|b)=c\.example$=filter`, `.*=upstream`}
+	var got []string
+	for _, rule := range rules {
+		got = append(got, rule.String())
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("rules = %q, want %q", got, want)
+	}
+
+	// The resolver follows the last '=', so the regex keeps the others
+	if !rules[1].Pattern.MatchString("a=c.example") || rules[1].Pattern.MatchString("a") {
+		t.Errorf("regex %q does not include the '=' before the resolver", rules[1].Pattern)
+	}
+}
+
+func TestParseDnsRulesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "no separator", value: "example", want: "expected 'regex=resolver'"},
+		{name: "no regex", value: "=system", want: "expected 'regex=resolver'"},
+		{name: "unknown resolver", value: "example=other", want: "unknown resolver"},
+		{name: "no resolver", value: "example=", want: "unknown resolver"},
+		{name: "invalid regex", value: "(example=system", want: "missing closing )"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDnsRules(StringArray{tt.value}, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseDnsRules = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckResolver(t *testing.T) {
+	groups := map[string][]UpstreamConfig{"filter": nil}
+
+	for _, name := range []string{ResolverSystem, ResolverUpstream, "filter"} {
+		if err := checkResolver(name, groups); err != nil {
+			t.Errorf("checkResolver(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "other", "System"} {
+		if err := checkResolver(name, groups); err == nil {
+			t.Errorf("checkResolver(%q) succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package util
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// HostsEntry overrides the dns answers of a name, either with addresses or
+// with another name, the CNAME target, that is resolved instead.
+type HostsEntry struct {
+	Addrs []netip.Addr
+	CNAME string
+}
+
+// Hosts maps lower case names without the trailing dot to their overrides.
+// Names starting with "*." match every subdomain of the rest of the name.
+type Hosts map[string]HostsEntry
+
+// Lookup returns the override of name, looking for the name itself first
+// and then for wildcards of its parent domains, closest first.
+func (h Hosts) Lookup(name string) (HostsEntry, bool) {
+	if len(h) == 0 {
+		return HostsEntry{}, false
+	}
+
+	name = hostsName(name)
+	if entry, ok := h[name]; ok {
+		return entry, true
+	}
+
+	for {
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			return HostsEntry{}, false
+		}
+		if entry, ok := h["*."+parent]; ok {
+			return entry, true
+		}
+		name = parent
+	}
+}
+
+// readHostsFile reads the overrides in path. Lines are either hosts file
+// entries, "address name [name...]", pinning the names to the address, or
+// rewrites, "name CNAME target", resolving target instead of name. Names may
+// be wildcards such as "*.example.com". Empty lines and lines starting with
+// '#' are ignored.
+func readHostsFile(path string) (Hosts, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening hosts file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	hosts := make(Hosts)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := hosts.add(fields); err != nil {
+			return nil, fmt.Errorf("hosts file %s, line %d: %w", path, lineNo, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading hosts file: %w", err)
+	}
+
+	return hosts, nil
+}
+
+// add adds the override of a line split into fields.
+func (h Hosts) add(fields []string) error {
+	if len(fields) < 2 {
+		return errors.New("expected 'address name [name...]' or 'name CNAME target'")
+	}
+
+	if addr, err := netip.ParseAddr(fields[0]); err == nil {
+		for _, name := range fields[1:] {
+			name = hostsName(name)
+			entry := h[name]
+			if entry.CNAME != "" {
+				return fmt.Errorf("%s has both a CNAME and addresses", name)
+			}
+			entry.Addrs = append(entry.Addrs, addr.Unmap())
+			h[name] = entry
+		}
+		return nil
+	}
+
+	if len(fields) != 3 || !strings.EqualFold(fields[1], "CNAME") {
+		return fmt.Errorf("invalid address %q", fields[0])
+	}
+
+	name, target := hostsName(fields[0]), hostsName(fields[2])
+	if strings.HasPrefix(target, "*.") {
+		return fmt.Errorf("CNAME target %s cannot be a wildcard", target)
+	}
+	if entry, ok := h[name]; ok && entry.CNAME != "" {
+		return fmt.Errorf("%s has two CNAMEs", name)
+	} else if ok {
+		return fmt.Errorf("%s has both a CNAME and addresses", name)
+	}
+	h[name] = HostsEntry{CNAME: target}
+	return nil
+}
+
+// hostsName returns name in the form Hosts is keyed by.
+func hostsName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,114 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHostsLookup(t *testing.T) {
+	hosts := Hosts{
+		"example.com":       {CNAME: "exact.example"},
+		"*.example.com":     {CNAME: "wildcard.example"},
+		"*.cdn.example.com": {CNAME: "cdn.example"},
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "example.com", want: "exact.example"},
+		{name: "EXAMPLE.com.", want: "exact.example"},
+		{name: "www.example.com", want: "wildcard.example"},
+		{name: "a.b.example.com", want: "wildcard.example"},
+		{name: "edge.cdn.example.com", want: "cdn.example"},
+		{name: "cdn.example.com", want: "wildcard.example"},
+		{name: "example.org"},
+		{name: "notexample.com"},
+		{name: "com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, ok := hosts.Lookup(tt.name)
+			if ok != (tt.want != "") || entry.CNAME != tt.want {
+				t.Errorf("Lookup = %q, %t, want %q", entry.CNAME, ok, tt.want)
+			}
+		})
+	}
+
+	if _, ok := Hosts(nil).Lookup("example.com"); ok {
+		t.Error("empty hosts matched")
+	}
+}
+
+// writeHostsFile writes content to a hosts file and returns its path.
+func writeHostsFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadHostsFile(t *testing.T) {
+	path := writeHostsFile(t, `# overrides
+192.0.2.1   Pinned.Example. www.pinned.example
+2001:db8::1 pinned.example # second address
+
+::ffff:192.0.2.2 *.cdn.example
+blocked.example cname mirror.example.
+`)
+
+	hosts, err := readHostsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry := hosts["pinned.example"]; len(entry.Addrs) != 2 || entry.Addrs[1].String() != "2001:db8::1" {
+		t.Errorf("pinned.example = %v", entry)
+	}
+	if entry := hosts["www.pinned.example"]; len(entry.Addrs) != 1 {
+		t.Errorf("www.pinned.example = %v", entry)
+	}
+	if entry := hosts["*.cdn.example"]; len(entry.Addrs) != 1 || !entry.Addrs[0].Is4() {
+		t.Errorf("*.cdn.example = %v, want the unmapped IPv4 address", entry)
+	}
+	if entry := hosts["blocked.example"]; entry.CNAME != "mirror.example" {
+		t.Errorf("blocked.example = %v", entry)
+	}
+	if len(hosts) != 4 {
+		t.Errorf("hosts = %v, want 4 names", hosts)
+	}
+}
+
+func TestReadHostsFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		line    string
+	}{
+		{name: "single field", content: "192.0.2.1", line: "line 1"},
+		{name: "invalid address", content: "192.0.2 example.com", line: "line 1"},
+		{name: "cname without target", content: "a.example CNAME", line: "line 1"},
+		{name: "wildcard target", content: "a.example CNAME *.b.example", line: "line 1"},
+		{name: "two cnames", content: "a.example CNAME b.example\na.example CNAME c.example", line: "line 2"},
+		{name: "cname after address", content: "192.0.2.1 a.example\na.example CNAME b.example", line: "line 2"},
+		{name: "address after cname", content: "a.example CNAME b.example\n192.0.2.1 a.example", line: "line 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readHostsFile(writeHostsFile(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.line) {
+				t.Errorf("readHostsFile = %v, want an error on %s", err, tt.line)
+			}
+		})
+	}
+
+	if _, err := readHostsFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("reading a missing file succeeded")
+	}
+}
@@ -0,0 +1,438 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	linuxOS   = "linux"
+	proxyHost = "127.0.0.1"
+
+	// kdeUnset is returned by kreadconfig for keys that are not set.
+	kdeUnset      = "\x01spoofdpi-unset"
+	kdeProxyGroup = "Proxy Settings"
+	kdeConfigFile = "kioslaverc"
+)
+
+// ErrProxyStateNotSaved is returned once the system proxy is set without a
+// state directory to save the previous settings in. They are still restored
+// on exit, but not by the next run after a crash.
+var ErrProxyStateNotSaved = errors.New("no state directory to save the previous proxy settings in; they cannot be restored after a crash")
+
+// gnomeProxyKeys are the dconf keys of org.gnome.system.proxy that are changed.
+var gnomeProxyKeys = []string{
+	"/org/gnome/system/proxy/mode",
+	"/org/gnome/system/proxy/http/host",
+	"/org/gnome/system/proxy/http/port",
+	"/org/gnome/system/proxy/https/host",
+	"/org/gnome/system/proxy/https/port",
+}
+
+// kdeProxyKeys are the keys of the kioslaverc proxy group that are changed.
+var kdeProxyKeys = []string{"ProxyType", "httpProxy", "httpsProxy"}
+
+// CommandRunner runs a command and returns its standard output.
+type CommandRunner func(name string, args ...string) (string, error)
+
+// runCommand runs a command on the system.
+func runCommand(name string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %s", cmd.String(), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// savedProxySettings are the settings found before the proxy was set. A nil
+// value means that the key was not set. Nil maps mean that the desktop was
+// not found and is left alone.
+type savedProxySettings struct {
+	Gnome   map[string]*string `json:"gnome,omitempty"`
+	KDE     map[string]*string `json:"kde,omitempty"`
+	KDETool string             `json:"kde_tool,omitempty"`
+	EnvFile *savedFile         `json:"env_file,omitempty"`
+}
+
+// savedFile is the previous content of a file, nil if it did not exist.
+type savedFile struct {
+	Path    string      `json:"path"`
+	Content *string     `json:"content,omitempty"`
+	Mode    fs.FileMode `json:"mode,omitempty"`
+}
+
+// linuxProxy sets the proxy of the Linux desktop through GNOME's dconf
+// settings, KDE's kioslaverc and, if given, an environment file, and puts
+// back the previous settings exactly.
+//
+// The previous settings are kept in a state file until they are restored, so
+// that a process that takes over after a restart or crash restores the
+// original settings rather than those of its predecessor.
+type linuxProxy struct {
+	run       CommandRunner
+	stateFile string
+	envFile   string
+	saved     *savedProxySettings
+}
+
+// newLinuxProxy creates a linuxProxy that runs its commands with run.
+func newLinuxProxy(run CommandRunner, stateFile, envFile string) *linuxProxy {
+	return &linuxProxy{
+		run:       run,
+		stateFile: stateFile,
+		envFile:   envFile,
+	}
+}
+
+// set points the desktop proxy settings to the proxy on port. Without a
+// state file, the settings are set all the same and ErrProxyStateNotSaved is
+// returned.
+func (p *linuxProxy) set(port uint16) error {
+	saved, err := p.loadState()
+	if err != nil {
+		return err
+	}
+	if saved == nil {
+		if saved, err = p.current(); err != nil {
+			return err
+		}
+	}
+	if saved.Gnome == nil && saved.KDE == nil && saved.EnvFile == nil {
+		return nil
+	}
+
+	notSaved := p.saveState(saved)
+	if notSaved != nil && !errors.Is(notSaved, ErrProxyStateNotSaved) {
+		return notSaved
+	}
+	p.saved = saved
+
+	var errs []error
+	if saved.Gnome != nil {
+		errs = append(errs, p.setGnome(port))
+	}
+	if saved.KDE != nil {
+		errs = append(errs, p.setKDE(saved.KDETool, port))
+	}
+	if saved.EnvFile != nil {
+		errs = append(errs, p.writeEnvFile(port))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return notSaved
+}
+
+// unset restores the settings found before set.
+func (p *linuxProxy) unset() error {
+	saved := p.saved
+	if saved == nil {
+		return nil
+	}
+
+	var errs []error
+	for _, key := range gnomeProxyKeys {
+		if value, ok := saved.Gnome[key]; ok {
+			errs = append(errs, p.restoreGnome(key, value))
+		}
+	}
+	for _, key := range kdeProxyKeys {
+		if value, ok := saved.KDE[key]; ok {
+			errs = append(errs, p.restoreKDE(saved.KDETool, key, value))
+		}
+	}
+	if saved.KDE != nil {
+		p.reloadKDE()
+	}
+	if saved.EnvFile != nil {
+		errs = append(errs, restoreFile(saved.EnvFile))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	p.saved = nil
+	if p.stateFile == "" {
+		return nil
+	}
+	if err := os.Remove(p.stateFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// current reads the settings that are about to be changed.
+func (p *linuxProxy) current() (*savedProxySettings, error) {
+	saved := new(savedProxySettings)
+
+	if p.hasGnome() {
+		saved.Gnome = make(map[string]*string)
+		for _, key := range gnomeProxyKeys {
+			out, err := p.run("dconf", "read", key)
+			if err != nil {
+				return nil, err
+			}
+			saved.Gnome[key] = optional(strings.TrimSpace(out))
+		}
+	}
+
+	for _, version := range []string{"6", "5"} {
+		if _, err := p.readKDE(version, kdeProxyKeys[0]); err != nil {
+			continue
+		}
+
+		saved.KDETool = version
+		saved.KDE = make(map[string]*string)
+		for _, key := range kdeProxyKeys {
+			value, err := p.readKDE(version, key)
+			if err != nil {
+				return nil, err
+			}
+			saved.KDE[key] = value
+		}
+		break
+	}
+
+	if p.envFile != "" {
+		file, err := readFile(p.envFile)
+		if err != nil {
+			return nil, err
+		}
+		saved.EnvFile = file
+	}
+
+	return saved, nil
+}
+
+// hasGnome reports whether the GNOME proxy settings can be changed. dconf
+// can only write through a session bus, which headless servers do not have
+// even if it is installed.
+func (p *linuxProxy) hasGnome() bool {
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return false
+	}
+	_, err := p.run("dconf", "read", gnomeProxyKeys[0])
+	return err == nil
+}
+
+// setGnome sets the GNOME proxy to manual mode for http and https.
+func (p *linuxProxy) setGnome(port uint16) error {
+	values := map[string]string{
+		"/org/gnome/system/proxy/mode":       "'manual'",
+		"/org/gnome/system/proxy/http/host":  "'" + proxyHost + "'",
+		"/org/gnome/system/proxy/http/port":  strconv.Itoa(int(port)),
+		"/org/gnome/system/proxy/https/host": "'" + proxyHost + "'",
+		"/org/gnome/system/proxy/https/port": strconv.Itoa(int(port)),
+	}
+
+	for _, key := range gnomeProxyKeys {
+		if _, err := p.run("dconf", "write", key, values[key]); err != nil {
+			return fmt.Errorf("setting gnome proxy: %w", err)
+		}
+	}
+	return nil
+}
+
+// restoreGnome puts back the previous value of a dconf key, or resets it if
+// it was not set.
+func (p *linuxProxy) restoreGnome(key string, value *string) error {
+	var err error
+	if value == nil {
+		_, err = p.run("dconf", "reset", key)
+	} else {
+		_, err = p.run("dconf", "write", key, *value)
+	}
+	if err != nil {
+		return fmt.Errorf("restoring gnome proxy: %w", err)
+	}
+	return nil
+}
+
+// setKDE sets the KDE proxy to manual mode for http and https.
+func (p *linuxProxy) setKDE(version string, port uint16) error {
+	proxy := "http://" + proxyHost + " " + strconv.Itoa(int(port))
+	values := map[string]string{
+		"ProxyType":  "1",
+		"httpProxy":  proxy,
+		"httpsProxy": proxy,
+	}
+
+	for _, key := range kdeProxyKeys {
+		if _, err := p.run("kwriteconfig"+version, "--file", kdeConfigFile, "--group", kdeProxyGroup,
+			"--key", key, values[key]); err != nil {
+			return fmt.Errorf("setting kde proxy: %w", err)
+		}
+	}
+
+	p.reloadKDE()
+	return nil
+}
+
+// readKDE reads a key of the kioslaverc proxy group, which is nil if it is
+// not set.
+func (p *linuxProxy) readKDE(version, key string) (*string, error) {
+	out, err := p.run("kreadconfig"+version, "--file", kdeConfigFile, "--group", kdeProxyGroup,
+		"--key", key, "--default", kdeUnset)
+	if err != nil {
+		return nil, err
+	}
+
+	value := strings.TrimSuffix(out, "\n")
+	if value == kdeUnset {
+		return nil, nil
+	}
+	return &value, nil
+}
+
+// restoreKDE puts back the previous value of a kioslaverc key, or deletes it
+// if it was not set.
+func (p *linuxProxy) restoreKDE(version, key string, value *string) error {
+	args := []string{"--file", kdeConfigFile, "--group", kdeProxyGroup, "--key", key}
+	if value == nil {
+		args = append(args, "--delete")
+	} else {
+		args = append(args, *value)
+	}
+
+	if _, err := p.run("kwriteconfig"+version, args...); err != nil {
+		return fmt.Errorf("restoring kde proxy: %w", err)
+	}
+	return nil
+}
+
+// reloadKDE tells running KDE applications to re-read the proxy settings.
+// It fails when there is no session bus, which is fine.
+func (p *linuxProxy) reloadKDE() {
+	_, _ = p.run("dbus-send", "--type=signal", "/KIO/Scheduler",
+		"org.kde.KIO.Scheduler.reparseSlaveConfiguration", "string:")
+}
+
+// writeEnvFile writes the proxy environment variables to the env file.
+func (p *linuxProxy) writeEnvFile(port uint16) error {
+	proxy := "http://" + proxyHost + ":" + strconv.Itoa(int(port))
+
+	var sb strings.Builder
+	sb.WriteString("# Written by SpoofDPI while it runs as the system proxy\n")
+	for _, name := range []string{"http_proxy", "https_proxy", "HTTP_PROXY", "HTTPS_PROXY"} {
+		sb.WriteString(name + "=" + proxy + "\n")
+	}
+
+	if err := os.WriteFile(p.envFile, []byte(sb.String()), 0o644); err != nil {
+		return fmt.Errorf("writing proxy env file: %w", err)
+	}
+	return nil
+}
+
+// loadState reads the settings saved by a previous run that did not get to
+// restore them, or returns nil if there are none.
+func (p *linuxProxy) loadState() (*savedProxySettings, error) {
+	if p.stateFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(p.stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	saved := new(savedProxySettings)
+	if err := json.Unmarshal(data, saved); err != nil {
+		return nil, fmt.Errorf("reading saved proxy settings %s: %w", p.stateFile, err)
+	}
+	return saved, nil
+}
+
+// saveState writes the previous settings to the state file.
+func (p *linuxProxy) saveState(saved *savedProxySettings) error {
+	if p.stateFile == "" {
+		return ErrProxyStateNotSaved
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p.stateFile), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(p.stateFile, data, 0o600)
+}
+
+// readFile reads the content and mode of a file that may not exist.
+func readFile(path string) (*savedFile, error) {
+	file := &savedFile{Path: path}
+
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return file, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	content := string(data)
+	file.Content = &content
+	file.Mode = info.Mode().Perm()
+	return file, nil
+}
+
+// restoreFile puts back the previous content and mode of a file, or removes
+// it if it did not exist.
+func restoreFile(file *savedFile) error {
+	if file.Content == nil {
+		if err := os.Remove(file.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.WriteFile(file.Path, []byte(*file.Content), file.Mode); err != nil {
+		return err
+	}
+	return os.Chmod(file.Path, file.Mode)
+}
+
+// linuxProxyStateFile returns the path of the file that keeps the previous
+// proxy settings, in $XDG_STATE_HOME or ~/.local/state, or an empty string
+// if there is no home directory.
+func linuxProxyStateFile() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "spoofdpi", "system-proxy.json")
+}
+
+// optional returns nil for an empty string.
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,281 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeDesktop stands in for dconf, kreadconfig and kwriteconfig, keeping the
+// settings in memory and recording every command.
+type fakeDesktop struct {
+	gnome   bool
+	kdeTool string
+	dconf   map[string]string
+	kde     map[string]string
+	calls   []string
+}
+
+func newFakeDesktop(gnome bool, kdeTool string) *fakeDesktop {
+	return &fakeDesktop{
+		gnome:   gnome,
+		kdeTool: kdeTool,
+		dconf:   make(map[string]string),
+		kde:     make(map[string]string),
+	}
+}
+
+var errNotFound = errors.New("executable file not found")
+
+func (d *fakeDesktop) run(name string, args ...string) (string, error) {
+	d.calls = append(d.calls, strings.Join(append([]string{name}, args...), " "))
+
+	switch {
+	case name == "dconf" && d.gnome:
+		switch args[0] {
+		case "read":
+			if value, ok := d.dconf[args[1]]; ok {
+				return value + "\n", nil
+			}
+			return "", nil
+		case "write":
+			d.dconf[args[1]] = args[2]
+			return "", nil
+		case "reset":
+			delete(d.dconf, args[1])
+			return "", nil
+		}
+
+	case d.kdeTool != "" && name == "kreadconfig"+d.kdeTool:
+		// --file kioslaverc --group "Proxy Settings" --key key --default value
+		if value, ok := d.kde[args[5]]; ok {
+			return value + "\n", nil
+		}
+		return args[7] + "\n", nil
+
+	case d.kdeTool != "" && name == "kwriteconfig"+d.kdeTool:
+		// --file kioslaverc --group "Proxy Settings" --key key (value | --delete)
+		if args[6] == "--delete" {
+			delete(d.kde, args[5])
+		} else {
+			d.kde[args[5]] = args[6]
+		}
+		return "", nil
+
+	case name == "dbus-send":
+		return "", nil
+	}
+
+	return "", errNotFound
+}
+
+// called reports whether a command was run.
+func (d *fakeDesktop) called(command string) bool {
+	return slices.Contains(d.calls, command)
+}
+
+func TestLinuxProxySetUnset(t *testing.T) {
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path=/run/user/1000/bus")
+
+	desktop := newFakeDesktop(true, "6")
+	desktop.dconf["/org/gnome/system/proxy/mode"] = "'none'"
+	desktop.dconf["/org/gnome/system/proxy/http/port"] = "3128"
+	desktop.kde["ProxyType"] = "0"
+
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state", "spoofdpi", "system-proxy.json")
+	envFile := filepath.Join(dir, "spoofdpi.conf")
+	if err := os.WriteFile(envFile, []byte("FOO=bar\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	gnomeBefore, kdeBefore := maps.Clone(desktop.dconf), maps.Clone(desktop.kde)
+
+	p := newLinuxProxy(desktop.run, stateFile, envFile)
+	if err := p.set(8080); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+
+	wantGnome := map[string]string{
+		"/org/gnome/system/proxy/mode":       "'manual'",
+		"/org/gnome/system/proxy/http/host":  "'127.0.0.1'",
+		"/org/gnome/system/proxy/http/port":  "8080",
+		"/org/gnome/system/proxy/https/host": "'127.0.0.1'",
+		"/org/gnome/system/proxy/https/port": "8080",
+	}
+	if !maps.Equal(desktop.dconf, wantGnome) {
+		t.Errorf("gnome settings = %v, want %v", desktop.dconf, wantGnome)
+	}
+	for _, command := range []string{
+		"kwriteconfig6 --file kioslaverc --group Proxy Settings --key ProxyType 1",
+		"kwriteconfig6 --file kioslaverc --group Proxy Settings --key httpProxy http://127.0.0.1 8080",
+		"kwriteconfig6 --file kioslaverc --group Proxy Settings --key httpsProxy http://127.0.0.1 8080",
+		"dbus-send --type=signal /KIO/Scheduler org.kde.KIO.Scheduler.reparseSlaveConfiguration string:",
+	} {
+		if !desktop.called(command) {
+			t.Errorf("%q was not run", command)
+		}
+	}
+
+	env, err := os.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(env), "https_proxy=http://127.0.0.1:8080\n") {
+		t.Errorf("env file is %q", env)
+	}
+	if _, err := os.Stat(stateFile); err != nil {
+		t.Errorf("state file was not saved: %s", err)
+	}
+
+	if err := p.unset(); err != nil {
+		t.Fatalf("unset: %s", err)
+	}
+
+	if !maps.Equal(desktop.dconf, gnomeBefore) {
+		t.Errorf("gnome settings = %v, want %v", desktop.dconf, gnomeBefore)
+	}
+	if !maps.Equal(desktop.kde, kdeBefore) {
+		t.Errorf("kde settings = %v, want %v", desktop.kde, kdeBefore)
+	}
+	if !desktop.called("dconf reset /org/gnome/system/proxy/http/host") {
+		t.Error("unset dconf key was not reset")
+	}
+	if !desktop.called("kwriteconfig6 --file kioslaverc --group Proxy Settings --key httpProxy --delete") {
+		t.Error("unset kde key was not deleted")
+	}
+
+	env, err = os.ReadFile(envFile)
+	if err != nil || string(env) != "FOO=bar\n" {
+		t.Errorf("env file is %q, %v, want it restored", env, err)
+	}
+	if info, err := os.Stat(envFile); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("env file mode is not restored: %v", err)
+	}
+	if _, err := os.Stat(stateFile); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("state file was not removed: %v", err)
+	}
+}
+
+func TestLinuxProxyKDE5(t *testing.T) {
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "")
+
+	desktop := newFakeDesktop(true, "5")
+	p := newLinuxProxy(desktop.run, filepath.Join(t.TempDir(), "system-proxy.json"), "")
+	if err := p.set(1080); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+
+	// Without a session bus, dconf cannot write even if it is installed
+	if len(desktop.dconf) != 0 {
+		t.Errorf("gnome settings = %v, want them untouched", desktop.dconf)
+	}
+	want := map[string]string{
+		"ProxyType":  "1",
+		"httpProxy":  "http://127.0.0.1 1080",
+		"httpsProxy": "http://127.0.0.1 1080",
+	}
+	if !maps.Equal(desktop.kde, want) {
+		t.Errorf("kde settings = %v, want %v", desktop.kde, want)
+	}
+
+	if err := p.unset(); err != nil {
+		t.Fatalf("unset: %s", err)
+	}
+	if len(desktop.kde) != 0 {
+		t.Errorf("kde settings = %v, want them deleted", desktop.kde)
+	}
+}
+
+func TestLinuxProxyStaleState(t *testing.T) {
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path=/run/user/1000/bus")
+
+	// A previous run set the proxy and crashed before restoring it
+	original := "'auto'"
+	saved := &savedProxySettings{Gnome: map[string]*string{"/org/gnome/system/proxy/mode": &original}}
+	for _, key := range gnomeProxyKeys[1:] {
+		saved.Gnome[key] = nil
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateFile := filepath.Join(t.TempDir(), "system-proxy.json")
+	if err := os.WriteFile(stateFile, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	desktop := newFakeDesktop(true, "")
+	desktop.dconf["/org/gnome/system/proxy/mode"] = "'manual'"
+	desktop.dconf["/org/gnome/system/proxy/http/port"] = "9090"
+
+	p := newLinuxProxy(desktop.run, stateFile, "")
+	if err := p.set(8080); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if desktop.called("dconf read /org/gnome/system/proxy/http/port") {
+		t.Error("current settings were read despite the saved ones")
+	}
+
+	if err := p.unset(); err != nil {
+		t.Fatalf("unset: %s", err)
+	}
+	want := map[string]string{"/org/gnome/system/proxy/mode": "'auto'"}
+	if !maps.Equal(desktop.dconf, want) {
+		t.Errorf("gnome settings = %v, want the ones before the crash %v", desktop.dconf, want)
+	}
+}
+
+func TestLinuxProxyNoDesktop(t *testing.T) {
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path=/run/user/1000/bus")
+
+	desktop := newFakeDesktop(false, "")
+	stateFile := filepath.Join(t.TempDir(), "system-proxy.json")
+	p := newLinuxProxy(desktop.run, stateFile, "")
+
+	if err := p.set(8080); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	for _, call := range desktop.calls {
+		if strings.Contains(call, "write") || strings.HasPrefix(call, "dbus-send") {
+			t.Errorf("%q was run without a desktop", call)
+		}
+	}
+	if _, err := os.Stat(stateFile); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("state file was saved without a desktop: %v", err)
+	}
+
+	calls := len(desktop.calls)
+	if err := p.unset(); err != nil {
+		t.Fatalf("unset: %s", err)
+	}
+	if len(desktop.calls) != calls {
+		t.Errorf("unset ran %q without a desktop", desktop.calls[calls:])
+	}
+}
+
+func TestLinuxProxyNoStateDir(t *testing.T) {
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path=/run/user/1000/bus")
+
+	desktop := newFakeDesktop(true, "")
+	p := newLinuxProxy(desktop.run, "", "")
+
+	if err := p.set(8080); !errors.Is(err, ErrProxyStateNotSaved) {
+		t.Fatalf("set: %v, want ErrProxyStateNotSaved", err)
+	}
+	if desktop.dconf["/org/gnome/system/proxy/mode"] != "'manual'" {
+		t.Errorf("gnome settings = %v, want the proxy set", desktop.dconf)
+	}
+
+	if err := p.unset(); err != nil {
+		t.Fatalf("unset: %s", err)
+	}
+	if len(desktop.dconf) != 0 {
+		t.Errorf("gnome settings = %v, want them restored", desktop.dconf)
+	}
+}
@@ -0,0 +1,153 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Protocols a listener can speak with its clients.
+const (
+	ProtoHTTP        = "http"
+	ProtoSOCKS5      = "socks5"
+	ProtoTransparent = "transparent"
+)
+
+// Networks a listener can be bound to.
+const (
+	NetworkTCP  = "tcp"
+	NetworkUnix = "unix"
+)
+
+// unixSuffix marks a protocol served on a Unix socket, e.g. "socks5+unix".
+const unixSuffix = "+" + NetworkUnix
+
+// ListenerConfig describes a listen endpoint. For Unix sockets, Addr is the
+// socket path, and Mode and Owner are applied to the socket file when set.
+type ListenerConfig struct {
+	Proto   string
+	Network string
+	Addr    string
+	Profile string
+	Mode    os.FileMode
+	Owner   string
+}
+
+// String returns the listener in the same form it is given on the command line.
+func (l ListenerConfig) String() string {
+	s := l.Proto + "://" + l.Addr
+
+	query := url.Values{}
+	if l.Network == NetworkUnix {
+		s = l.Proto + unixSuffix + "://" + l.Addr
+		if l.Mode != 0 {
+			query.Set("mode", fmt.Sprintf("%04o", uint32(l.Mode)))
+		}
+		if l.Owner != "" {
+			query.Set("owner", l.Owner)
+		}
+	}
+	if l.Profile != "" {
+		query.Set("profile", l.Profile)
+	}
+
+	if len(query) > 0 {
+		s += "?" + query.Encode()
+	}
+	return s
+}
+
+// parseListeners parses listen endpoints of the form
+// "[proto://]host:port[?profile=name]", e.g. "127.0.0.1:8080",
+// "[::1]:8080" or "socks5://192.168.1.2:1080?profile=office", and Unix
+// sockets of the form "[proto+]unix:///path[?mode=0660&owner=user:group]".
+// The protocol defaults to http.
+func parseListeners(values StringArray) ([]ListenerConfig, error) {
+	var (
+		listeners []ListenerConfig
+		errs      []error
+	)
+
+	for _, value := range values {
+		l, err := parseListener(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid listen address %q: %w", value, err))
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, errors.Join(errs...)
+}
+
+// parseListener parses a single listen endpoint.
+func parseListener(value string) (ListenerConfig, error) {
+	if !strings.Contains(value, "://") {
+		value = ProtoHTTP + "://" + value
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return ListenerConfig{}, err
+	}
+
+	query := u.Query()
+	l := ListenerConfig{
+		Proto:   strings.ToLower(u.Scheme),
+		Network: NetworkTCP,
+		Addr:    u.Host,
+		Profile: query.Get("profile"),
+	}
+
+	if l.Proto == NetworkUnix || strings.HasSuffix(l.Proto, unixSuffix) {
+		return parseUnixListener(l, u)
+	}
+
+	switch l.Proto {
+	case ProtoHTTP, ProtoSOCKS5, ProtoTransparent:
+	default:
+		return ListenerConfig{}, fmt.Errorf("unknown protocol %q", l.Proto)
+	}
+
+	if _, _, err := net.SplitHostPort(l.Addr); err != nil {
+		return ListenerConfig{}, err
+	}
+
+	return l, nil
+}
+
+// parseUnixListener fills in a Unix socket listener from its URL.
+func parseUnixListener(l ListenerConfig, u *url.URL) (ListenerConfig, error) {
+	l.Network = NetworkUnix
+	l.Proto = strings.TrimSuffix(l.Proto, unixSuffix)
+	if l.Proto == NetworkUnix {
+		l.Proto = ProtoHTTP
+	}
+
+	switch l.Proto {
+	case ProtoHTTP, ProtoSOCKS5:
+	default:
+		return ListenerConfig{}, fmt.Errorf("protocol %q is not supported on unix sockets", l.Proto)
+	}
+
+	l.Addr = u.Host + u.Path
+	if l.Addr == "" {
+		return ListenerConfig{}, errors.New("missing socket path")
+	}
+
+	query := u.Query()
+	if mode := query.Get("mode"); mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0o777 {
+			return ListenerConfig{}, fmt.Errorf("invalid mode %q; expected octal permissions like 0660", mode)
+		}
+		l.Mode = os.FileMode(m)
+	}
+	l.Owner = query.Get("owner")
+
+	return l, nil
+}
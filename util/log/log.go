@@ -13,6 +13,7 @@ import (
 const (
 	scopeFieldName   = "scope"
 	traceIdFieldName = "trace_id"
+	userFieldName    = "user"
 )
 
 var logger zerolog.Logger
@@ -89,4 +90,8 @@ func (h ctxHook) Run(e *zerolog.Event, _ zerolog.Level, _ string) {
 	if traceId, ok := util.GetTraceIdFromCtx(ctx); ok {
 		e.Str(traceIdFieldName, traceId)
 	}
+
+	if user, ok := util.GetUserFromCtx(ctx); ok {
+		e.Str(userFieldName, user)
+	}
 }
@@ -23,8 +23,16 @@ const (
 		" -system-proxy=false."
 )
 
-// SetOsProxy sets the system proxy settings on macOS.
+// linuxSystemProxy holds the previous Linux desktop settings while the
+// system proxy is set.
+var linuxSystemProxy *linuxProxy
+
+// SetOsProxy sets the system proxy settings on macOS and on Linux desktops.
 func SetOsProxy(port uint16) error {
+	if runtime.GOOS == linuxOS {
+		linuxSystemProxy = newLinuxProxy(runCommand, linuxProxyStateFile(), config.SystemProxyEnvFile)
+		return linuxSystemProxy.set(port)
+	}
 	if runtime.GOOS != darwinOS {
 		return nil
 	}
@@ -37,8 +45,15 @@ func SetOsProxy(port uint16) error {
 	return setProxy(getProxyTypes(), network, "127.0.0.1", port)
 }
 
-// UnsetOsProxy unsets the system proxy settings on macOS.
+// UnsetOsProxy unsets the system proxy settings on macOS, and restores the
+// previous ones on Linux desktops.
 func UnsetOsProxy() error {
+	if runtime.GOOS == linuxOS {
+		if linuxSystemProxy == nil {
+			return nil
+		}
+		return linuxSystemProxy.unset()
+	}
 	if runtime.GOOS != darwinOS {
 		return nil
 	}
@@ -0,0 +1,169 @@
+package util
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// Protocols an upstream dns server can be queried with.
+const (
+	UpstreamUDP   = "udp"
+	UpstreamTLS   = "tls"
+	UpstreamHTTPS = "https"
+)
+
+// Strategies to query a list of upstream dns servers with.
+const (
+	StrategyFailover   = "failover"
+	StrategyRace       = "race"
+	StrategyRoundRobin = "round-robin"
+)
+
+// Default ports of the upstream protocols.
+const (
+	udpPort = "53"
+	tlsPort = "853"
+)
+
+// UpstreamConfig describes an upstream dns server. Addr is host:port, or the
+// DoH url for https upstreams. ServerName is the name a DoT server is
+// authenticated as, and defaults to the host of Addr. Pins replace the
+// certificate validation of a DoT server, and Bootstrap are the addresses a
+// DoH server is connected to instead of resolving its host.
+type UpstreamConfig struct {
+	Proto      string
+	Addr       string
+	ServerName string
+	Pins       [][]byte
+	Bootstrap  []netip.Addr
+}
+
+// String returns the upstream in the same form it is given on the command line.
+func (u UpstreamConfig) String() string {
+	switch u.Proto {
+	case UpstreamHTTPS:
+		if len(u.Bootstrap) == 0 {
+			return u.Addr
+		}
+		opts := url.Values{}
+		for _, addr := range u.Bootstrap {
+			opts.Add("bootstrap", addr.String())
+		}
+		return u.Addr + "#" + opts.Encode()
+	case UpstreamTLS:
+		opts := url.Values{}
+		if u.ServerName != "" {
+			opts.Set("name", u.ServerName)
+		}
+		for _, pin := range u.Pins {
+			opts.Add("pin", base64.StdEncoding.EncodeToString(pin))
+		}
+		if len(opts) > 0 {
+			return u.Proto + "://" + u.Addr + "?" + opts.Encode()
+		}
+	}
+	return u.Proto + "://" + u.Addr
+}
+
+// parseUpstreams parses upstream dns servers of the form
+// "[udp://]host[:port]", "tls://host[:port][?name=server-name][&pin=digest...]"
+// or "https://host[:port]/path[#bootstrap=address...]", e.g. "1.1.1.1",
+// "tls://9.9.9.9?name=dns.quad9.net" or
+// "https://dns.google/dns-query#bootstrap=8.8.8.8&bootstrap=8.8.4.4".
+func parseUpstreams(values StringArray) ([]UpstreamConfig, error) {
+	var (
+		upstreams []UpstreamConfig
+		errs      []error
+	)
+
+	for _, value := range values {
+		u, err := parseUpstream(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid upstream %q: %w", value, err))
+			continue
+		}
+		upstreams = append(upstreams, u)
+	}
+
+	return upstreams, errors.Join(errs...)
+}
+
+// parseUpstream parses a single upstream dns server.
+func parseUpstream(value string) (UpstreamConfig, error) {
+	if !strings.Contains(value, "://") {
+		if ip := net.ParseIP(value); ip != nil && ip.To4() == nil {
+			value = "[" + value + "]"
+		}
+		value = UpstreamUDP + "://" + value
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return UpstreamConfig{}, err
+	}
+	if u.Host == "" {
+		return UpstreamConfig{}, errors.New("missing host")
+	}
+
+	upstream := UpstreamConfig{Proto: strings.ToLower(u.Scheme)}
+	switch upstream.Proto {
+	case UpstreamHTTPS:
+		// The options are kept in the fragment, which is not part of the
+		// request, as the query belongs to the DoH url
+		opts, err := url.ParseQuery(u.Fragment)
+		if err != nil {
+			return UpstreamConfig{}, err
+		}
+		if upstream.Bootstrap, err = parseAddrs(opts["bootstrap"]); err != nil {
+			return UpstreamConfig{}, err
+		}
+		u.Fragment, u.RawFragment = "", ""
+		upstream.Addr = u.String()
+		return upstream, nil
+	case UpstreamUDP:
+		upstream.Addr = hostWithPort(u, udpPort)
+	case UpstreamTLS:
+		upstream.Addr = hostWithPort(u, tlsPort)
+		query := u.Query()
+		upstream.ServerName = query.Get("name")
+
+		// An unescaped '+' of a base64 digest is read as a space
+		pins := make(StringArray, 0, len(query["pin"]))
+		for _, pin := range query["pin"] {
+			pins = append(pins, strings.ReplaceAll(pin, " ", "+"))
+		}
+		if upstream.Pins, err = parsePins(pins); err != nil {
+			return UpstreamConfig{}, err
+		}
+	default:
+		return UpstreamConfig{}, fmt.Errorf("unknown protocol %q", upstream.Proto)
+	}
+
+	if u.Path != "" {
+		return UpstreamConfig{}, fmt.Errorf("unexpected path %q", u.Path)
+	}
+	return upstream, nil
+}
+
+// hostWithPort returns the host:port of u, with port defaulting to port.
+func hostWithPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// checkStrategy checks that value is a known upstream strategy.
+func checkStrategy(value string) error {
+	switch value {
+	case StrategyFailover, StrategyRace, StrategyRoundRobin:
+		return nil
+	}
+	return fmt.Errorf("unknown strategy %q; expected %s, %s or %s",
+		value, StrategyFailover, StrategyRace, StrategyRoundRobin)
+}
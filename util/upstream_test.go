@@ -0,0 +1,84 @@
+package util
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseUpstream(t *testing.T) {
+	pin := make([]byte, 32)
+	pin[0], pin[1] = 0xfb, 0xef // "++8" in base64
+	const pin64 = "++8AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+
+	tests := []struct {
+		value string
+		want  UpstreamConfig
+	}{
+		{value: "1.1.1.1", want: UpstreamConfig{Proto: UpstreamUDP, Addr: "1.1.1.1:53"}},
+		{value: "2001:db8::1", want: UpstreamConfig{Proto: UpstreamUDP, Addr: "[2001:db8::1]:53"}},
+		{value: "udp://1.1.1.1:5353", want: UpstreamConfig{Proto: UpstreamUDP, Addr: "1.1.1.1:5353"}},
+		{
+			value: "tls://9.9.9.9?name=dns.quad9.net",
+			want:  UpstreamConfig{Proto: UpstreamTLS, Addr: "9.9.9.9:853", ServerName: "dns.quad9.net"},
+		},
+		{
+			value: "tls://192.0.2.1:8853?pin=" + pin64,
+			want:  UpstreamConfig{Proto: UpstreamTLS, Addr: "192.0.2.1:8853", Pins: [][]byte{pin}},
+		},
+		{
+			value: "https://dns.google/dns-query",
+			want:  UpstreamConfig{Proto: UpstreamHTTPS, Addr: "https://dns.google/dns-query"},
+		},
+		{
+			value: "https://dns.google/dns-query?x=1#bootstrap=8.8.8.8&bootstrap=2001:4860:4860::8888",
+			want: UpstreamConfig{
+				Proto:     UpstreamHTTPS,
+				Addr:      "https://dns.google/dns-query?x=1",
+				Bootstrap: []netip.Addr{netip.MustParseAddr("8.8.8.8"), netip.MustParseAddr("2001:4860:4860::8888")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseUpstream(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseUpstream = %+v, want %+v", got, tt.want)
+			}
+
+			// The upstream is printed in a form it can be parsed from again
+			again, err := parseUpstream(got.String())
+			if err != nil || !reflect.DeepEqual(again, got) {
+				t.Errorf("parseUpstream(%q) = %+v, %v, want %+v", got.String(), again, err, got)
+			}
+		})
+	}
+}
+
+func TestParseUpstreamErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "unknown protocol", value: "ftp://1.1.1.1", want: "unknown protocol"},
+		{name: "missing host", value: "tls://", want: "missing host"},
+		{name: "path", value: "tls://1.1.1.1/dns", want: "unexpected path"},
+		{name: "invalid pin", value: "tls://1.1.1.1?pin=abc", want: "invalid pin"},
+		{name: "invalid bootstrap", value: "https://dns.google/dns-query#bootstrap=dns.google", want: "invalid address"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseUpstream(tt.value)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseUpstream = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}